@@ -1,18 +1,67 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"new_project/internal/authenticate"
+	"log/slog"
+	"net/http"
+	"new_project/internal/database"
+	"new_project/internal/janitor"
 	"new_project/internal/server"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
 )
 
+// shutdownTimeout is how long in-flight requests get to finish after SIGINT or SIGTERM
+const shutdownTimeout = 30 * time.Second
+
 func main() {
 	fmt.Println("Starting the server")
-	authenticate.NewAuth()
-	server := server.NewServer()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelDebug}))
+
+	server, api := server.NewServer()
 
-	err := server.ListenAndServe()
+	maintenance, err := janitor.NewFromEnv(database.New(), logger)
 	if err != nil {
+		panic(fmt.Sprintf("cannot start janitor: %s", err))
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		maintenance.Run(ctx)
+	}()
+
+	go func() {
+		defer wg.Done()
+		<-ctx.Done()
+		logger.Info("shutting down")
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			logger.Error("shutdown failed", slog.String("error", err.Error()))
+		}
+		// Emails and other work started by the last requests get the rest of the timeout
+		if err := api.Wait(shutdownCtx); err != nil {
+			logger.Error("background tasks did not finish", slog.String("error", err.Error()))
+		}
+	}()
+
+	err = server.ListenAndServe()
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
 		panic(fmt.Sprintf("cannot start server: %s", err))
 	}
+
+	// ListenAndServe returns as soon as Shutdown starts, wait for the requests and background tasks to drain
+	// and the janitor to stop
+	wg.Wait()
 }
@@ -0,0 +1,95 @@
+// Package auth describes the principal a request is made by, whichever way it authenticated.
+// The authenticator middleware stores the principal in the request context once, handlers read
+// it with FromContext instead of picking claims out of the token.
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// Method is the way the principal of a request authenticated
+type Method string
+
+const (
+	// MethodBearer is an access token in the Authorization header
+	MethodBearer Method = "bearer"
+	// MethodCookie is an access token in the jwt cookie of a browser session
+	MethodCookie Method = "cookie"
+	// MethodAPIKey is a personal API key in an "Authorization: ApiKey" header
+	MethodAPIKey Method = "api_key"
+)
+
+var (
+	// ErrUnauthenticated is returned by FromContext for requests without a principal
+	ErrUnauthenticated = errors.New("request is not authenticated")
+	// ErrMalformedClaims is returned when the claims of a token do not describe a principal
+	ErrMalformedClaims = errors.New("malformed token claims")
+)
+
+// Principal is the user a request is made on behalf of
+type Principal struct {
+	UserID string
+	// Role is empty for tokens issued before the role claim existed
+	Role string
+	// SessionID is the token family of the login, empty for API keys
+	SessionID string
+	// TokenID is the jti of the access token, empty for API keys
+	TokenID string
+	// Scopes limit the permissions of the user's role, nil when the role applies in full
+	Scopes []string
+	Method Method
+	// APIKeyID is the key the request was made with when Method is MethodAPIKey
+	APIKeyID string
+	// Impersonator is the admin acting as the user through an impersonation token
+	Impersonator string
+}
+
+// FromClaims returns the principal described by the claims of an access token.
+// user_id is required, the other claims are optional but have to be strings when present.
+func FromClaims(claims map[string]interface{}, method Method) (*Principal, error) {
+	p := &Principal{Method: method}
+	fields := []struct {
+		claim    string
+		target   *string
+		required bool
+	}{
+		{"user_id", &p.UserID, true},
+		{"role", &p.Role, false},
+		{"sid", &p.SessionID, false},
+		{"jti", &p.TokenID, false},
+		{"impersonator", &p.Impersonator, false},
+	}
+	for _, field := range fields {
+		value, found := claims[field.claim]
+		if !found {
+			if field.required {
+				return nil, fmt.Errorf("%w: missing %s", ErrMalformedClaims, field.claim)
+			}
+			continue
+		}
+		s, ok := value.(string)
+		if !ok || (field.required && s == "") {
+			return nil, fmt.Errorf("%w: %s must be a non-empty string", ErrMalformedClaims, field.claim)
+		}
+		*field.target = s
+	}
+	return p, nil
+}
+
+type principalCtxKey struct{}
+
+// NewContext returns a context carrying the principal
+func NewContext(ctx context.Context, p *Principal) context.Context {
+	return context.WithValue(ctx, principalCtxKey{}, p)
+}
+
+// FromContext returns the principal stored by the authenticator, or ErrUnauthenticated
+func FromContext(ctx context.Context) (*Principal, error) {
+	p, ok := ctx.Value(principalCtxKey{}).(*Principal)
+	if !ok || p == nil {
+		return nil, ErrUnauthenticated
+	}
+	return p, nil
+}
@@ -0,0 +1,55 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestFromClaims(t *testing.T) {
+	tests := map[string]struct {
+		claims  map[string]interface{}
+		wantErr bool
+	}{
+		"full":              {map[string]interface{}{"user_id": "u1", "role": "ADMIN", "sid": "s1", "jti": "t1", "impersonator": "a1"}, false},
+		"user only":         {map[string]interface{}{"user_id": "u1"}, false},
+		"missing user":      {map[string]interface{}{"sid": "s1"}, true},
+		"empty user":        {map[string]interface{}{"user_id": ""}, true},
+		"numeric user":      {map[string]interface{}{"user_id": 123}, true},
+		"numeric session":   {map[string]interface{}{"user_id": "u1", "sid": 1}, true},
+		"unknown claims ok": {map[string]interface{}{"user_id": "u1", "exp": 1700000000}, false},
+	}
+	for name, tt := range tests {
+		p, err := FromClaims(tt.claims, MethodBearer)
+		if tt.wantErr {
+			if !errors.Is(err, ErrMalformedClaims) {
+				t.Errorf("%s: expected ErrMalformedClaims, got %v", name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", name, err)
+			continue
+		}
+		if p.UserID != "u1" || p.Method != MethodBearer {
+			t.Errorf("%s: unexpected principal %+v", name, p)
+		}
+	}
+
+	p, _ := FromClaims(map[string]interface{}{"user_id": "u1", "role": "ADMIN", "sid": "s1", "jti": "t1", "impersonator": "a1"}, MethodCookie)
+	if p.Role != "ADMIN" || p.SessionID != "s1" || p.TokenID != "t1" || p.Impersonator != "a1" || p.Scopes != nil {
+		t.Errorf("claims were not copied, got %+v", p)
+	}
+}
+
+func TestContext(t *testing.T) {
+	if _, err := FromContext(context.Background()); !errors.Is(err, ErrUnauthenticated) {
+		t.Errorf("expected ErrUnauthenticated, got %v", err)
+	}
+
+	want := &Principal{UserID: "u1", Method: MethodAPIKey}
+	got, err := FromContext(NewContext(context.Background(), want))
+	if err != nil || got != want {
+		t.Errorf("expected %+v, got %+v (%v)", want, got, err)
+	}
+}
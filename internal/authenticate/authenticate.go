@@ -8,16 +8,19 @@ import (
 	"github.com/markbates/goth/providers/github"
 	"github.com/markbates/goth/providers/google"
 	"log"
+	"net/http"
 	"os"
+	"sort"
 )
 
 const (
 	key    = "randomString"
 	maxAge = 60 * 60 * 24 * 7 // 1 week
-	isProd = false
 )
 
-func NewAuth() {
+// NewAuth registers the OAuth and OpenID Connect providers. cookieSecure is the COOKIE_SECURE
+// setting of the server, the OAuth session cookie follows the token cookies.
+func NewAuth(cookieSecure bool) {
 	err := godotenv.Load()
 	if err != nil {
 		log.Fatal("Error loading .env file")
@@ -29,20 +32,81 @@ func NewAuth() {
 	store.MaxAge(maxAge)
 	store.Options.Path = "/"
 	store.Options.HttpOnly = true
-	store.Options.Secure = isProd
+	// Browsers accept Secure cookies on http://localhost
+	store.Options.Secure = cookieSecure
+	store.Options.SameSite = http.SameSiteLaxMode
 
 	gothic.Store = store
 
-	googleProvider := google.New(googleClientId, googleClientSecretKey, "http://localhost:8080/auth/google/callback", "https://www.googleapis.com/auth/keep.readonly")
-	googleProvider.SetPrompt("consent", "select_account")
+	// OAUTH_CALLBACK_BASE_URL is the public URL of this server the providers redirect back to
+	callbackBaseURL := os.Getenv("OAUTH_CALLBACK_BASE_URL")
+	if callbackBaseURL == "" {
+		callbackBaseURL = "http://localhost:8080"
+	}
+
+	var providers []goth.Provider
+	if googleClientId != "" {
+		googleProvider := google.New(googleClientId, googleClientSecretKey, callbackBaseURL+"/auth/google/callback", "https://www.googleapis.com/auth/keep.readonly")
+		googleProvider.SetPrompt("consent", "select_account")
+		providers = append(providers, googleProvider)
+	}
 	//githubProvider := github.New(os.Getenv("GITHUB_KEY"), os.Getenv("GITHUB_SECRET"), "http://localhost:8080/auth/github/callback")
-	githubProvider := github.New(os.Getenv("GITHUB_OAUTH_CLIENT_ID"), os.Getenv("GITHUB_OAUTH_CLIENT_SECRET"), "http://localhost:8080/auth/github/callback", "user:email")
+	if githubClientId := os.Getenv("GITHUB_OAUTH_CLIENT_ID"); githubClientId != "" {
+		githubProvider := github.New(githubClientId, os.Getenv("GITHUB_OAUTH_CLIENT_SECRET"), callbackBaseURL+"/auth/github/callback", "user:email")
+		providers = append(providers, githubProvider)
+	}
 
-	goth.UseProviders(
-		googleProvider,
-		githubProvider,
-		//google.New(googleClientId, googleClientSecretKey, "http://localhost:8080/auth/google/callback"),
-		//github.New(os.Getenv("GITHUB_KEY"), os.Getenv("GITHUB_SECRET"), "http://localhost:8080/auth/github/callback"),
-	)
+	oidcConfigs, err := LoadOIDCProvidersFromEnv()
+	if err != nil {
+		log.Fatalf("error loading OIDC providers: %v", err)
+	}
+	for _, config := range oidcConfigs {
+		// An unreachable identity provider should not keep the other login methods down
+		provider, err := config.NewProvider(callbackBaseURL)
+		if err != nil {
+			log.Printf("skipping OIDC provider %s: %v", config.Name, err)
+			continue
+		}
+		oidcProviders[config.Name] = config
+		providers = append(providers, provider)
+	}
 
+	goth.UseProviders(providers...)
+}
+
+// oidcProviders holds the configuration of the registered OIDC providers by name
+var oidcProviders = map[string]OIDCProvider{}
+
+// MappedRoles returns the roles the registered providers can give users, including DefaultRole
+// when any of them manages roles. They all have to exist in the roles table.
+func MappedRoles() []string {
+	var roles []string
+	seen := map[string]bool{}
+	add := func(role string) {
+		if !seen[role] {
+			seen[role] = true
+			roles = append(roles, role)
+		}
+	}
+	for _, config := range oidcProviders {
+		if config.RoleClaim == "" {
+			continue
+		}
+		add(DefaultRole)
+		for _, m := range config.RoleMap {
+			add(m.Role)
+		}
+	}
+	sort.Strings(roles)
+	return roles
+}
+
+// Role maps the claims returned by provider to a role, see OIDCProvider.Role.
+// It returns an empty string for providers that do not manage roles.
+func Role(provider string, claims map[string]any) string {
+	config, ok := oidcProviders[provider]
+	if !ok {
+		return ""
+	}
+	return config.Role(claims)
 }
@@ -0,0 +1,167 @@
+package authenticate
+
+import (
+	"fmt"
+	"github.com/markbates/goth/providers/openidConnect"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// OIDCProvider is an OpenID Connect provider declared in the environment, such as Keycloak,
+// Authentik or Azure AD. Its endpoints are discovered from the issuer.
+type OIDCProvider struct {
+	// Name is used in the /auth/{provider} routes and stored with linked identities
+	Name         string
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	Scopes       []string
+
+	// Claims holding the user's fields, the standard OpenID Connect claims are used when empty
+	UserIdClaim    string
+	EmailClaim     string
+	NameClaim      string
+	AvatarURLClaim string
+
+	// RoleClaim is the claim, or dotted path such as realm_access.roles, holding the user's groups
+	// or roles at the provider. RoleMap maps them to the role of the user in the users table,
+	// earlier entries take precedence. The provider is authoritative: users none of whose values
+	// are mapped get DefaultRole on their next login.
+	RoleClaim string
+	RoleMap   []RoleMapping
+}
+
+// RoleMapping maps a value of the role claim to a role
+type RoleMapping struct {
+	Value string
+	Role  string
+}
+
+// DefaultRole is the role of users the role claim of their provider does not map to any other role
+const DefaultRole = "USER"
+
+var providerName = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+
+// LoadOIDCProvidersFromEnv reads the providers listed in OIDC_PROVIDERS, e.g. "keycloak,azure".
+// Each one is configured with variables prefixed by its upper-cased name, e.g. OIDC_KEYCLOAK_ISSUER.
+func LoadOIDCProvidersFromEnv() ([]OIDCProvider, error) {
+	var providers []OIDCProvider
+	for _, name := range splitList(os.Getenv("OIDC_PROVIDERS")) {
+		name = strings.ToLower(name)
+		if !providerName.MatchString(name) {
+			return nil, fmt.Errorf("invalid OIDC provider name %q, use lower-case letters, digits and dashes", name)
+		}
+		if name == "google" || name == "github" {
+			return nil, fmt.Errorf("OIDC provider name %q is reserved", name)
+		}
+
+		prefix := "OIDC_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_")) + "_"
+		env := func(key string) string { return os.Getenv(prefix + key) }
+
+		p := OIDCProvider{
+			Name:           name,
+			Issuer:         strings.TrimSuffix(env("ISSUER"), "/"),
+			ClientID:       env("CLIENT_ID"),
+			ClientSecret:   env("CLIENT_SECRET"),
+			Scopes:         splitList(env("SCOPES")),
+			UserIdClaim:    env("CLAIM_USER_ID"),
+			EmailClaim:     env("CLAIM_EMAIL"),
+			NameClaim:      env("CLAIM_NAME"),
+			AvatarURLClaim: env("CLAIM_AVATAR_URL"),
+			RoleClaim:      env("CLAIM_ROLES"),
+		}
+		if p.Issuer == "" || p.ClientID == "" {
+			return nil, fmt.Errorf("%sISSUER and %sCLIENT_ID are required", prefix, prefix)
+		}
+		if len(p.Scopes) == 0 {
+			p.Scopes = []string{"openid", "profile", "email"}
+		}
+
+		// OIDC_<NAME>_ROLE_MAP is a list of value:ROLE pairs, e.g. "app-admins:ADMIN,staff:USER"
+		for _, pair := range splitList(env("ROLE_MAP")) {
+			value, role, ok := strings.Cut(pair, ":")
+			if !ok || value == "" || role == "" {
+				return nil, fmt.Errorf("invalid %sROLE_MAP entry %q, expected value:ROLE", prefix, pair)
+			}
+			p.RoleMap = append(p.RoleMap, RoleMapping{Value: value, Role: strings.ToUpper(role)})
+		}
+		if len(p.RoleMap) > 0 && p.RoleClaim == "" {
+			return nil, fmt.Errorf("%sROLE_MAP requires %sCLAIM_ROLES", prefix, prefix)
+		}
+
+		providers = append(providers, p)
+	}
+	return providers, nil
+}
+
+// NewProvider discovers the endpoints of the issuer and returns the goth provider
+func (p OIDCProvider) NewProvider(callbackBaseURL string) (*openidConnect.Provider, error) {
+	callbackURL := strings.TrimSuffix(callbackBaseURL, "/") + "/auth/" + p.Name + "/callback"
+	provider, err := openidConnect.New(p.ClientID, p.ClientSecret, callbackURL, p.Issuer+"/.well-known/openid-configuration", p.Scopes...)
+	if err != nil {
+		return nil, fmt.Errorf("discovering OIDC provider %s: %w", p.Name, err)
+	}
+	if provider.OpenIDConfig.Issuer != p.Issuer {
+		return nil, fmt.Errorf("OIDC provider %s: discovered issuer %q does not match %q", p.Name, provider.OpenIDConfig.Issuer, p.Issuer)
+	}
+	provider.SetName(p.Name)
+
+	if p.UserIdClaim != "" {
+		provider.UserIdClaims = []string{p.UserIdClaim}
+	}
+	if p.EmailClaim != "" {
+		provider.EmailClaims = []string{p.EmailClaim}
+	}
+	if p.NameClaim != "" {
+		provider.NameClaims = []string{p.NameClaim}
+	}
+	if p.AvatarURLClaim != "" {
+		provider.AvatarURLClaims = []string{p.AvatarURLClaim}
+	}
+	return provider, nil
+}
+
+// Role maps the role claim of the user to a role. It returns an empty string when the provider
+// does not manage roles, and DefaultRole when the claim is missing or nothing matched, so that
+// users removed from a group at the provider lose the role it granted.
+func (p OIDCProvider) Role(claims map[string]any) string {
+	if p.RoleClaim == "" {
+		return ""
+	}
+
+	var value any = claims
+	for _, key := range strings.Split(p.RoleClaim, ".") {
+		m, ok := value.(map[string]any)
+		if !ok {
+			return DefaultRole
+		}
+		value = m[key]
+	}
+
+	values := map[string]bool{}
+	switch v := value.(type) {
+	case string:
+		for _, s := range strings.Fields(v) {
+			values[s] = true
+		}
+	case []any:
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				values[s] = true
+			}
+		}
+	}
+
+	for _, m := range p.RoleMap {
+		if values[m.Value] {
+			return m.Role
+		}
+	}
+	return DefaultRole
+}
+
+// splitList splits a comma or space separated list
+func splitList(s string) []string {
+	return strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == ' ' })
+}
@@ -0,0 +1,266 @@
+package authenticate
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// mockIssuer is a minimal OpenID Connect provider serving discovery, token and userinfo endpoints
+type mockIssuer struct {
+	*httptest.Server
+	clientID string
+	// discoveredIssuer replaces the issuer announced by discovery when set
+	discoveredIssuer string
+	claims           map[string]any
+	userinfo         map[string]any
+}
+
+func newMockIssuer(t *testing.T, clientID string) *mockIssuer {
+	m := &mockIssuer{clientID: clientID}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		issuer := m.URL
+		if m.discoveredIssuer != "" {
+			issuer = m.discoveredIssuer
+		}
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 issuer,
+			"authorization_endpoint": m.URL + "/authorize",
+			"token_endpoint":         m.URL + "/token",
+			"userinfo_endpoint":      m.URL + "/userinfo",
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("code") != "valid-code" {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		claims := map[string]any{
+			"iss": m.URL,
+			"aud": m.clientID,
+			"exp": time.Now().Add(time.Hour).Unix(),
+		}
+		for k, v := range m.claims {
+			claims[k] = v
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"access_token": "access-token",
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+			"id_token":     unsignedJWT(t, claims),
+		})
+	})
+	mux.HandleFunc("/userinfo", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer access-token" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(m.userinfo)
+	})
+	m.Server = httptest.NewServer(mux)
+	t.Cleanup(m.Close)
+	return m
+}
+
+func unsignedJWT(t *testing.T, claims map[string]any) string {
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc := base64.RawURLEncoding
+	return enc.EncodeToString([]byte(`{"alg":"none"}`)) + "." + enc.EncodeToString(payload) + ".sig"
+}
+
+func TestLoadOIDCProvidersFromEnv(t *testing.T) {
+	t.Setenv("OIDC_PROVIDERS", "keycloak, corp-sso")
+	t.Setenv("OIDC_KEYCLOAK_ISSUER", "https://kc.example.com/realms/main/")
+	t.Setenv("OIDC_KEYCLOAK_CLIENT_ID", "api")
+	t.Setenv("OIDC_KEYCLOAK_CLAIM_ROLES", "realm_access.roles")
+	t.Setenv("OIDC_KEYCLOAK_ROLE_MAP", "admins:admin,staff:USER")
+	t.Setenv("OIDC_CORP_SSO_ISSUER", "https://login.example.com")
+	t.Setenv("OIDC_CORP_SSO_CLIENT_ID", "corp")
+	t.Setenv("OIDC_CORP_SSO_SCOPES", "openid email groups")
+	t.Setenv("OIDC_CORP_SSO_CLAIM_EMAIL", "upn")
+
+	providers, err := LoadOIDCProvidersFromEnv()
+	if err != nil {
+		t.Fatalf("LoadOIDCProvidersFromEnv: %v", err)
+	}
+	if len(providers) != 2 {
+		t.Fatalf("expected 2 providers, got %d", len(providers))
+	}
+
+	kc := providers[0]
+	if kc.Name != "keycloak" || kc.Issuer != "https://kc.example.com/realms/main" {
+		t.Errorf("unexpected provider %+v", kc)
+	}
+	if strings.Join(kc.Scopes, " ") != "openid profile email" {
+		t.Errorf("expected default scopes, got %v", kc.Scopes)
+	}
+	if len(kc.RoleMap) != 2 || kc.RoleMap[0] != (RoleMapping{Value: "admins", Role: "ADMIN"}) {
+		t.Errorf("unexpected role map %v", kc.RoleMap)
+	}
+
+	corp := providers[1]
+	if corp.Name != "corp-sso" || corp.EmailClaim != "upn" || strings.Join(corp.Scopes, " ") != "openid email groups" {
+		t.Errorf("unexpected provider %+v", corp)
+	}
+}
+
+func TestLoadOIDCProvidersFromEnvRejects(t *testing.T) {
+	tests := map[string]map[string]string{
+		"missing issuer":     {"OIDC_PROVIDERS": "kc", "OIDC_KC_CLIENT_ID": "api"},
+		"reserved name":      {"OIDC_PROVIDERS": "google", "OIDC_GOOGLE_ISSUER": "https://x", "OIDC_GOOGLE_CLIENT_ID": "api"},
+		"invalid name":       {"OIDC_PROVIDERS": "kc/../x"},
+		"role map no claim":  {"OIDC_PROVIDERS": "kc", "OIDC_KC_ISSUER": "https://x", "OIDC_KC_CLIENT_ID": "api", "OIDC_KC_ROLE_MAP": "admins:ADMIN"},
+		"malformed role map": {"OIDC_PROVIDERS": "kc", "OIDC_KC_ISSUER": "https://x", "OIDC_KC_CLIENT_ID": "api", "OIDC_KC_CLAIM_ROLES": "groups", "OIDC_KC_ROLE_MAP": "admins"},
+	}
+	for name, env := range tests {
+		t.Run(name, func(t *testing.T) {
+			for k, v := range env {
+				t.Setenv(k, v)
+			}
+			if _, err := LoadOIDCProvidersFromEnv(); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func TestOIDCProviderLogin(t *testing.T) {
+	issuer := newMockIssuer(t, "api")
+	issuer.claims = map[string]any{
+		"sub":          "user-123",
+		"upn":          "jane@corp.example.com",
+		"realm_access": map[string]any{"roles": []any{"offline_access", "admins"}},
+	}
+	issuer.userinfo = map[string]any{
+		"sub":            "user-123",
+		"name":           "Jane Doe",
+		"email_verified": true,
+	}
+
+	config := OIDCProvider{
+		Name:       "keycloak",
+		Issuer:     issuer.URL,
+		ClientID:   "api",
+		Scopes:     []string{"openid", "email"},
+		EmailClaim: "upn",
+		RoleClaim:  "realm_access.roles",
+		RoleMap:    []RoleMapping{{Value: "admins", Role: "ADMIN"}},
+	}
+	provider, err := config.NewProvider("https://api.example.com/")
+	if err != nil {
+		t.Fatalf("NewProvider: %v", err)
+	}
+	if provider.Name() != "keycloak" {
+		t.Errorf("expected provider name keycloak, got %q", provider.Name())
+	}
+
+	session, err := provider.BeginAuth("state-123")
+	if err != nil {
+		t.Fatalf("BeginAuth: %v", err)
+	}
+	authURL, _ := session.GetAuthURL()
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := u.Query()
+	if !strings.HasPrefix(authURL, issuer.URL+"/authorize") || q.Get("client_id") != "api" || q.Get("state") != "state-123" {
+		t.Errorf("unexpected auth URL %s", authURL)
+	}
+	if q.Get("redirect_uri") != "https://api.example.com/auth/keycloak/callback" {
+		t.Errorf("unexpected redirect_uri %q", q.Get("redirect_uri"))
+	}
+	if q.Get("scope") != "openid email" {
+		t.Errorf("unexpected scope %q", q.Get("scope"))
+	}
+
+	if _, err := session.Authorize(provider, url.Values{"code": {"valid-code"}}); err != nil {
+		t.Fatalf("Authorize: %v", err)
+	}
+	user, err := provider.FetchUser(session)
+	if err != nil {
+		t.Fatalf("FetchUser: %v", err)
+	}
+	if user.Provider != "keycloak" || user.UserID != "user-123" || user.Email != "jane@corp.example.com" || user.Name != "Jane Doe" {
+		t.Errorf("unexpected user %+v", user)
+	}
+	if role := config.Role(user.RawData); role != "ADMIN" {
+		t.Errorf("expected role ADMIN, got %q", role)
+	}
+}
+
+func TestOIDCProviderIssuerMismatch(t *testing.T) {
+	issuer := newMockIssuer(t, "api")
+	issuer.discoveredIssuer = "https://evil.example.com"
+
+	config := OIDCProvider{Name: "kc", Issuer: issuer.URL, ClientID: "api"}
+	if _, err := config.NewProvider("http://localhost:8080"); err == nil {
+		t.Error("expected an error for a mismatching issuer")
+	}
+}
+
+func TestRole(t *testing.T) {
+	p := OIDCProvider{
+		RoleClaim: "groups",
+		RoleMap:   []RoleMapping{{Value: "admins", Role: "ADMIN"}, {Value: "staff", Role: "USER"}},
+	}
+	tests := []struct {
+		name   string
+		claims map[string]any
+		want   string
+	}{
+		{"list", map[string]any{"groups": []any{"staff"}}, "USER"},
+		{"earlier entry wins", map[string]any{"groups": []any{"staff", "admins"}}, "ADMIN"},
+		{"space separated", map[string]any{"groups": "other admins"}, "ADMIN"},
+		{"no match", map[string]any{"groups": []any{"other"}}, DefaultRole},
+		{"missing claim", map[string]any{}, DefaultRole},
+		{"wrong type", map[string]any{"groups": 42}, DefaultRole},
+	}
+	for _, tt := range tests {
+		if got := p.Role(tt.claims); got != tt.want {
+			t.Errorf("%s: Role = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	nested := OIDCProvider{RoleClaim: "realm_access.roles", RoleMap: []RoleMapping{{Value: "admins", Role: "ADMIN"}}}
+	if got := nested.Role(map[string]any{"realm_access": map[string]any{"roles": []any{"admins"}}}); got != "ADMIN" {
+		t.Errorf("nested: Role = %q, want ADMIN", got)
+	}
+	if got := nested.Role(map[string]any{"realm_access": "admins"}); got != DefaultRole {
+		t.Errorf("nested without object: Role = %q, want %s", got, DefaultRole)
+	}
+	if got := (OIDCProvider{}).Role(map[string]any{"groups": []any{"admins"}}); got != "" {
+		t.Errorf("no role claim: Role = %q, want empty", got)
+	}
+}
+
+func TestMappedRoles(t *testing.T) {
+	saved := oidcProviders
+	t.Cleanup(func() { oidcProviders = saved })
+
+	oidcProviders = map[string]OIDCProvider{
+		"kc":    {RoleClaim: "groups", RoleMap: []RoleMapping{{Value: "admins", Role: "ADMIN"}, {Value: "editors", Role: "EDITOR"}}},
+		"azure": {RoleClaim: "roles", RoleMap: []RoleMapping{{Value: "admins", Role: "ADMIN"}}},
+		"plain": {},
+	}
+	got := MappedRoles()
+	want := []string{"ADMIN", "EDITOR", DefaultRole}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("MappedRoles = %v, want %v", got, want)
+	}
+
+	oidcProviders = map[string]OIDCProvider{"plain": {}}
+	if got := MappedRoles(); len(got) != 0 {
+		t.Errorf("expected no roles without a role claim, got %v", got)
+	}
+}
@@ -0,0 +1,127 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// ErrAPIKeyInvalid is returned when an API key is unknown, expired or revoked
+var ErrAPIKeyInvalid = errors.New("invalid or expired API key")
+
+// APIKey is a personal access token of a user. The key itself is never stored, only its digest.
+type APIKey struct {
+	Id         string     `json:"id"`
+	UserId     string     `json:"-"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Scopes     []string   `json:"scopes"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	LastUsedIp string     `json:"last_used_ip"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+const apiKeyColumns = `id, user_id, name, prefix, scopes, expires_at, last_used_at, COALESCE(last_used_ip, ''), created_at`
+
+func scanAPIKey(row interface{ Scan(...any) error }) (*APIKey, error) {
+	var (
+		key        APIKey
+		scopes     []byte
+		expiresAt  sql.NullTime
+		lastUsedAt sql.NullTime
+	)
+	err := row.Scan(&key.Id, &key.UserId, &key.Name, &key.Prefix, &scopes, &expiresAt, &lastUsedAt, &key.LastUsedIp, &key.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(scopes, &key.Scopes); err != nil {
+		return nil, err
+	}
+	if expiresAt.Valid {
+		key.ExpiresAt = &expiresAt.Time
+	}
+	if lastUsedAt.Valid {
+		key.LastUsedAt = &lastUsedAt.Time
+	}
+	return &key, nil
+}
+
+// CreateAPIKey stores a new API key of the user under the digest of the key
+func (s *service) CreateAPIKey(key *APIKey, keyHash string) (*APIKey, error) {
+	scopes, err := json.Marshal(key.Scopes)
+	if err != nil {
+		return nil, err
+	}
+
+	row := s.db.QueryRow(`
+		INSERT INTO api_keys (user_id, name, prefix, key_hash, scopes, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING `+apiKeyColumns,
+		key.UserId, key.Name, key.Prefix, keyHash, scopes, key.ExpiresAt,
+	)
+	return scanAPIKey(row)
+}
+
+// GetAPIKeys returns the API keys of a user that were not revoked, newest first
+func (s *service) GetAPIKeys(userID string) ([]APIKey, error) {
+	rows, err := s.db.Query(`
+		SELECT `+apiKeyColumns+`
+		FROM api_keys
+		WHERE user_id = $1 AND revoked_at IS NULL
+		ORDER BY created_at DESC
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []APIKey{}
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, *key)
+	}
+	return keys, rows.Err()
+}
+
+// RevokeAPIKey revokes an API key of the user, it reports false when the user has no such key
+func (s *service) RevokeAPIKey(userID string, keyID string) (bool, error) {
+	res, err := s.db.Exec(`
+		UPDATE api_keys
+		SET revoked_at = NOW()
+		WHERE id = $2 AND user_id = $1 AND revoked_at IS NULL
+	`, userID, keyID)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// UseAPIKey looks up a live API key by its digest and records that it was used from ipAddress.
+// It returns ErrAPIKeyInvalid for unknown, expired and revoked keys.
+// revokeAPIKeys revokes every API key of the user, after a password change the keys have to be created again
+func revokeAPIKeys(ctx context.Context, q querier, userID string) error {
+	_, err := q.ExecContext(ctx, "UPDATE api_keys SET revoked_at = NOW() WHERE user_id = $1 AND revoked_at IS NULL", userID)
+	return err
+}
+
+func (s *service) UseAPIKey(keyHash string, ipAddress string) (*APIKey, error) {
+	row := s.db.QueryRow(`
+		UPDATE api_keys
+		SET last_used_at = NOW(), last_used_ip = $2
+		WHERE key_hash = $1 AND revoked_at IS NULL AND (expires_at IS NULL OR expires_at > NOW())
+		RETURNING `+apiKeyColumns,
+		keyHash, ipAddress,
+	)
+	key, err := scanAPIKey(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrAPIKeyInvalid
+	}
+	return key, err
+}
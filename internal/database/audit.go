@@ -0,0 +1,144 @@
+package database
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Outcomes of an audit event
+const (
+	AuditSuccess = "SUCCESS"
+	AuditFailure = "FAILURE"
+)
+
+// auditJanitorLock is the advisory lock key held while purging audit events
+const auditJanitorLock int64 = 0x6175646974 // "audit"
+
+// AuditEvent is a security relevant account event such as a login or a revoked token
+type AuditEvent struct {
+	Id             string         `json:"id"`
+	Type           string         `json:"type"`
+	Outcome        string         `json:"outcome"`
+	Reason         string         `json:"reason,omitempty"`
+	ActorId        string         `json:"actor_id,omitempty"`
+	Username       string         `json:"username,omitempty"`
+	ImpersonatorId string         `json:"impersonator_id,omitempty"`
+	IpAddress      string         `json:"ip_address"`
+	UserAgent      string         `json:"user_agent"`
+	RequestId      string         `json:"request_id"`
+	Details        map[string]any `json:"details"`
+	CreatedAt      time.Time      `json:"created_at"`
+}
+
+// AuditFilter selects audit events, empty fields match everything.
+// Events are returned newest first; a page continues after the event BeforeTime and BeforeId.
+type AuditFilter struct {
+	Type       string
+	Outcome    string
+	ActorId    string
+	Username   string
+	IpAddress  string
+	Since      *time.Time
+	Until      *time.Time
+	BeforeTime *time.Time
+	BeforeId   string
+	Limit      int
+}
+
+const auditEventColumns = `id, event_type, outcome, COALESCE(reason, ''), COALESCE(actor_id::text, ''), COALESCE(username, ''),
+	COALESCE(impersonator_id::text, ''), COALESCE(ip_address, ''), COALESCE(user_agent, ''), COALESCE(request_id, ''), details, created_at`
+
+// InsertAuditEvent records an audit event
+func (s *service) InsertAuditEvent(event *AuditEvent) error {
+	details, err := json.Marshal(event.Details)
+	if err != nil {
+		return err
+	}
+	if event.Details == nil {
+		details = []byte("{}")
+	}
+
+	_, err = s.db.Exec(`
+		INSERT INTO audit_events (event_type, outcome, reason, actor_id, username, impersonator_id, ip_address, user_agent, request_id, details)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+	`, event.Type, event.Outcome, nullString(event.Reason), nullString(event.ActorId), nullString(event.Username),
+		nullString(event.ImpersonatorId), nullString(event.IpAddress), nullString(event.UserAgent), nullString(event.RequestId), details)
+	return err
+}
+
+// GetAuditEvents returns a page of the audit events matching the filter, newest first
+func (s *service) GetAuditEvents(filter AuditFilter) ([]AuditEvent, error) {
+	var (
+		conditions []string
+		args       []any
+	)
+	where := func(condition string, arg any) {
+		args = append(args, arg)
+		conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+	}
+	if filter.Type != "" {
+		where("event_type = $%d", filter.Type)
+	}
+	if filter.Outcome != "" {
+		where("outcome = $%d", filter.Outcome)
+	}
+	if filter.ActorId != "" {
+		where("actor_id = $%d", filter.ActorId)
+	}
+	if filter.Username != "" {
+		where("username = $%d", filter.Username)
+	}
+	if filter.IpAddress != "" {
+		where("ip_address = $%d", filter.IpAddress)
+	}
+	if filter.Since != nil {
+		where("created_at >= $%d", *filter.Since)
+	}
+	if filter.Until != nil {
+		where("created_at < $%d", *filter.Until)
+	}
+	if filter.BeforeTime != nil {
+		args = append(args, *filter.BeforeTime, filter.BeforeId)
+		conditions = append(conditions, fmt.Sprintf("(created_at, id) < ($%d, $%d)", len(args)-1, len(args)))
+	}
+
+	query := "SELECT " + auditEventColumns + " FROM audit_events"
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	args = append(args, filter.Limit)
+	query += fmt.Sprintf(" ORDER BY created_at DESC, id DESC LIMIT $%d", len(args))
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []AuditEvent{}
+	for rows.Next() {
+		var (
+			event   AuditEvent
+			details []byte
+		)
+		err := rows.Scan(&event.Id, &event.Type, &event.Outcome, &event.Reason, &event.ActorId, &event.Username,
+			&event.ImpersonatorId, &event.IpAddress, &event.UserAgent, &event.RequestId, &details, &event.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(details, &event.Details); err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
+
+// PurgeAuditEvents deletes the audit events recorded before the given time.
+// It reports false without deleting anything when another replica holds the lock.
+func (s *service) PurgeAuditEvents(ctx context.Context, before time.Time) (int64, bool, error) {
+	return s.purgeLocked(ctx, auditJanitorLock, "DELETE FROM audit_events WHERE created_at < $1", before)
+}
@@ -3,12 +3,14 @@ package database
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"log"
 	"new_project/internal/models"
 	"os"
 	"time"
 
+	"github.com/jackc/pgx/v5/pgconn"
 	_ "github.com/jackc/pgx/v5/stdlib"
 	_ "github.com/joho/godotenv/autoload"
 )
@@ -24,6 +26,7 @@ type Service interface {
 	Close() error
 	GetUrlByKey(urlKey string) (*Url, error)
 	AddShortenedUrl(urlResp *Url) error
+	GetUrlsByUser(userId string) ([]Url, error)
 
 	// User Table -----------------------------------
 	CountUser(username string) (int, error)
@@ -31,13 +34,96 @@ type Service interface {
 	UpdateUserImageById(userImage, userId string) error
 	GetHashedPassword(username string) (string, string, error)
 	GetUserById(userId string) (*User, error)
+	MarkEmailVerified(userId, email string) (bool, error)
+	IsEmailVerified(userId string) (bool, error)
+	MarkVerificationEmailSent(userId string, minInterval time.Duration) (string, error)
+	UpdateUser(userId string, update *UserUpdate, reservation time.Duration) (bool, error)
+	ChangePassword(userId string, hashedPassword string, currentSessionId string) error
+	ScheduleUserDeletion(userId string, at time.Time) error
+	CancelUserDeletion(userId string) (bool, error)
+	PurgeDeletedUsers(ctx context.Context, before time.Time) (int64, bool, error)
+	PurgeUsernameReservations(ctx context.Context, before time.Time) (int64, bool, error)
+
+	//Identities ------------------------------------
+	LoginWithIdentity(identity *Identity) (string, error)
+	CreateUserWithIdentity(username string, identity *Identity) (string, error)
+	LinkLegacyOAuthUser(identity *Identity) (string, error)
+	LinkIdentity(userID string, identity *Identity) error
+	GetIdentities(userID string) ([]Identity, error)
+	UnlinkIdentity(userID string, provider string) (bool, error)
+	SetLastLoginProvider(userID string, provider string) error
+
+	//Roles ------------------------------------
+	GetPermissions() ([]Permission, error)
+	GetRoles() ([]Role, error)
+	GetRole(name string) (*Role, error)
+	CreateRole(role *Role) (*Role, error)
+	UpdateRole(name string, description string, permissions []string) (*Role, error)
+	DeleteRole(name string) error
+	SetUserRole(userID string, role string) (bool, error)
+	GetUserPermissions(userID string) ([]string, error)
+
+	//Login Throttling ------------------------------------
+	ReserveLoginAttempt(scope string, key string, window time.Duration, maxFailures int, lockout time.Duration, retryAfter func(*LoginThrottle) time.Duration) (*LoginThrottle, time.Duration, error)
+	ReleaseLoginAttempt(scope string, key string) error
+	ClearLoginThrottle(scope string, key string) (bool, error)
+	PurgeLoginThrottles(ctx context.Context, before time.Time) (int64, bool, error)
+
+	//MFA ------------------------------------
+	GetTOTP(userID string) (*TOTPConfig, error)
+	SetPendingTOTPSecret(userID string, secret string) (bool, error)
+	EnableTOTP(userID string, secret string, step int64, recoveryCodeHashes []string) error
+	UseTOTPStep(userID string, step int64) (bool, error)
+	UseRecoveryCode(userID string, codeHash string) (bool, error)
+	DisableTOTP(userID string) error
+
+	//Password Reset ------------------------------------
+	CreatePasswordReset(userID string, tokenHash string, expiresAt time.Time, minInterval time.Duration) error
+	ResetPassword(tokenHash string, hashedPassword string) (string, error)
+
+	//Magic Links ------------------------------------
+	CreateMagicLink(userID string, linkID string, expiresAt time.Time, minInterval time.Duration) error
+	UseMagicLink(linkID string, userID string, email string) (bool, error)
 
 	//Token ------------------------------------
 	GetValidTokenCount(userID string) (int, error)
 	InvalidateOldestToken(userID string) error
-	InvalidateToken(token string) error
-	InsertToken(userID string, token string, expiresAt time.Time) error
-	IsTokenValid(token string) (bool, error)
+	InvalidateToken(jti string) error
+	InsertToken(userID string, familyID string, jti string, tokenHash string, expiresAt time.Time) error
+	IsTokenValid(jti string) (bool, error)
+	RotateRefreshToken(tokenHash string, newTokenHash string, expiresAt time.Time, issue func(userID string, familyID string) (*AccessToken, error)) (*RefreshToken, error)
+	RevokeTokenFamily(familyID string) error
+	PurgeTokens(ctx context.Context, before time.Time) (int64, bool, error)
+	WatchTokenRevocations(ctx context.Context, revoked func(userID string), listening func(bool))
+
+	//Sessions ------------------------------------
+	GetSessions(userID string) ([]Session, error)
+	RevokeSession(userID string, sessionID string) (bool, error)
+	RevokeOtherSessions(userID string, currentSessionID string) (int, error)
+	EndSession(sessionID string, everywhere bool) (string, int, error)
+	StartSession(userID string, familyID string, tokenHash string, expiresAt time.Time, info SessionInfo) error
+
+	//API Keys ------------------------------------
+	CreateAPIKey(key *APIKey, keyHash string) (*APIKey, error)
+	GetAPIKeys(userID string) ([]APIKey, error)
+	RevokeAPIKey(userID string, keyID string) (bool, error)
+	UseAPIKey(keyHash string, ipAddress string) (*APIKey, error)
+
+	//Impersonation ------------------------------------
+	StartImpersonation(imp *Impersonation, jti string, tokenHash string) (*Impersonation, error)
+	GetImpersonations(userID string, limit int) ([]Impersonation, error)
+	GetImpersonationBySession(sessionID string) (*Impersonation, error)
+
+	//Audit ------------------------------------
+	InsertAuditEvent(event *AuditEvent) error
+	GetAuditEvents(filter AuditFilter) ([]AuditEvent, error)
+	PurgeAuditEvents(ctx context.Context, before time.Time) (int64, bool, error)
+
+	//Session Policies ------------------------------------
+	GetSessionPolicy(userID string) (*SessionPolicy, error)
+	GetSessionPolicies() ([]SessionPolicy, error)
+	UpsertSessionPolicy(policy *SessionPolicy) (*SessionPolicy, error)
+	DeleteSessionPolicy(id string) (bool, error)
 
 	//Animals Table --------------------------------------
 	GetAnimalById(id string) (*Animal, error)
@@ -53,6 +139,8 @@ type Service interface {
 
 type service struct {
 	db *sql.DB
+	// connStr is kept for the connections that cannot come from the pool, such as LISTEN
+	connStr string
 }
 
 var (
@@ -89,7 +177,8 @@ func New() Service {
 
 	log.Println("Connected to the database ")
 	dbInstance = &service{
-		db: db,
+		db:      db,
+		connStr: connStr,
 	}
 	return dbInstance
 }
@@ -107,3 +196,15 @@ func (s *service) Close1() error {
 	log.Printf("Disconnected from database: %s", database)
 	return s.db.Close()
 }
+
+// Postgres error codes that are turned into errors of this package
+const (
+	pgForeignKeyViolation = "23503"
+	pgUniqueViolation     = "23505"
+)
+
+// isPgError reports whether err is a Postgres error with the given code
+func isPgError(err error, code string) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == code
+}
@@ -0,0 +1,312 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrIdentityLinkedElsewhere is returned when the OAuth account already belongs to another user
+	ErrIdentityLinkedElsewhere = errors.New("this account is already linked to another user")
+	// ErrProviderAlreadyLinked is returned when the user already linked another account of the same provider
+	ErrProviderAlreadyLinked = errors.New("an account of this provider is already linked, unlink it first")
+	// ErrLastLoginMethod is returned when unlinking would leave the user without a way to log in
+	ErrLastLoginMethod = errors.New("this is the only way to log in to the account, set a password first")
+	// ErrUsernameTaken is returned when a new user would get the username of an existing one
+	ErrUsernameTaken = errors.New("username is already taken")
+)
+
+// Identity is an OAuth account linked to a user
+type Identity struct {
+	Id             string          `json:"id"`
+	Provider       string          `json:"provider"`
+	ProviderUserId string          `json:"provider_user_id"`
+	Email          string          `json:"email"`
+	AvatarURL      string          `json:"avatar_url"`
+	RawProfile     json.RawMessage `json:"-"`
+	CreatedAt      time.Time       `json:"created_at"`
+	LastLoginAt    *time.Time      `json:"last_login_at"`
+
+	// Name and Role are mapped from the provider's claims on login and copied to the user,
+	// Role is left empty when the provider does not manage roles
+	Name string `json:"-"`
+	Role string `json:"-"`
+}
+
+// LoginWithIdentity refreshes the stored profile of a linked identity and returns its user.
+// It returns an empty user ID when the identity is not linked to anyone.
+func (s *service) LoginWithIdentity(identity *Identity) (string, error) {
+	ctx := context.Background()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	var userID string
+	err = tx.QueryRowContext(ctx, `
+		UPDATE user_identities
+		SET email = $3, avatar_url = $4, raw_profile = $5, last_login_at = NOW()
+		WHERE provider = $1 AND provider_user_id = $2
+		RETURNING user_id
+	`, identity.Provider, identity.ProviderUserId, nullString(identity.Email), nullString(identity.AvatarURL), nullJSON(identity.RawProfile)).Scan(&userID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", nil
+		}
+		return "", err
+	}
+
+	if err := updateLoginUser(ctx, tx, userID, identity); err != nil {
+		return "", err
+	}
+
+	return userID, tx.Commit()
+}
+
+// LinkLegacyOAuthUser links the identity to the account the OAuth login registered for its email
+// before identities existed, and returns the user. It returns an empty user ID when no such account
+// is waiting for its first login. The caller has to make sure the provider verified the email.
+func (s *service) LinkLegacyOAuthUser(identity *Identity) (string, error) {
+	ctx := context.Background()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	var userID string
+	err = tx.QueryRowContext(ctx, `
+		UPDATE users
+		SET oauth_link_pending = FALSE
+		WHERE username = $1 AND oauth_link_pending
+		RETURNING id
+	`, identity.Email).Scan(&userID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", nil
+		}
+		return "", err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO user_identities (user_id, provider, provider_user_id, email, avatar_url, raw_profile, last_login_at)
+		VALUES ($1, $2, $3, $4, $5, $6, NOW())
+	`, userID, identity.Provider, identity.ProviderUserId, nullString(identity.Email), nullString(identity.AvatarURL), nullJSON(identity.RawProfile))
+	if err != nil {
+		return "", err
+	}
+
+	if err := updateLoginUser(ctx, tx, userID, identity); err != nil {
+		return "", err
+	}
+
+	return userID, tx.Commit()
+}
+
+// updateLoginUser copies what the provider reported on login to the user
+func updateLoginUser(ctx context.Context, q querier, userID string, identity *Identity) error {
+	_, err := q.ExecContext(ctx, `
+		UPDATE users
+		SET last_login_provider = $2, role = COALESCE(NULLIF($3, ''), role)
+		WHERE id = $1
+	`, userID, loginProvider(identity.Provider), identity.Role)
+	return err
+}
+
+// CreateUserWithIdentity registers a new user without a password, who logs in through the identity
+func (s *service) CreateUserWithIdentity(username string, identity *Identity) (string, error) {
+	ctx := context.Background()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	var taken bool
+	err = tx.QueryRowContext(ctx, `
+		SELECT EXISTS (SELECT 1 FROM users WHERE username = $1)
+		    OR EXISTS (SELECT 1 FROM username_reservations WHERE username = $1 AND reserved_until > NOW())
+	`, username).Scan(&taken)
+	if err != nil {
+		return "", err
+	}
+	if taken {
+		return "", ErrUsernameTaken
+	}
+
+	fullName := identity.Name
+	if fullName == "" {
+		fullName = username
+	}
+	role := identity.Role
+	if role == "" {
+		role = RoleUser
+	}
+
+	// An empty password hash never matches, the user can set a password through the reset flow
+	var userID string
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO users (username, password, fullname, role, userimage, last_login_provider)
+		VALUES ($1, '', $2, $3, $4, $5)
+		RETURNING id
+	`, username, fullName, role, nullString(identity.AvatarURL), loginProvider(identity.Provider)).Scan(&userID)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO user_identities (user_id, provider, provider_user_id, email, avatar_url, raw_profile, last_login_at)
+		VALUES ($1, $2, $3, $4, $5, $6, NOW())
+	`, userID, identity.Provider, identity.ProviderUserId, nullString(identity.Email), nullString(identity.AvatarURL), nullJSON(identity.RawProfile))
+	if err != nil {
+		return "", err
+	}
+
+	return userID, tx.Commit()
+}
+
+// LinkIdentity links an OAuth account to an existing user, linking it again to the same user is a no-op
+func (s *service) LinkIdentity(userID string, identity *Identity) error {
+	ctx := context.Background()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var ownerID string
+	err = tx.QueryRowContext(ctx,
+		"SELECT user_id FROM user_identities WHERE provider = $1 AND provider_user_id = $2",
+		identity.Provider, identity.ProviderUserId,
+	).Scan(&ownerID)
+	switch {
+	case err == nil && ownerID != userID:
+		return ErrIdentityLinkedElsewhere
+	case err == nil:
+		return nil
+	case !errors.Is(err, sql.ErrNoRows):
+		return err
+	}
+
+	var linked bool
+	err = tx.QueryRowContext(ctx,
+		"SELECT EXISTS (SELECT 1 FROM user_identities WHERE user_id = $1 AND provider = $2)",
+		userID, identity.Provider,
+	).Scan(&linked)
+	if err != nil {
+		return err
+	}
+	if linked {
+		return ErrProviderAlreadyLinked
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO user_identities (user_id, provider, provider_user_id, email, avatar_url, raw_profile)
+		VALUES ($1, $2, $3, $4, $5, $6)
+	`, userID, identity.Provider, identity.ProviderUserId, nullString(identity.Email), nullString(identity.AvatarURL), nullJSON(identity.RawProfile))
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// GetIdentities lists the OAuth accounts linked to the user
+func (s *service) GetIdentities(userID string) ([]Identity, error) {
+	rows, err := s.db.Query(`
+		SELECT id, provider, provider_user_id, email, avatar_url, created_at, last_login_at
+		FROM user_identities
+		WHERE user_id = $1
+		ORDER BY created_at
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	identities := []Identity{}
+	for rows.Next() {
+		var (
+			identity         Identity
+			email, avatarURL sql.NullString
+			lastLoginAt      sql.NullTime
+		)
+		err := rows.Scan(&identity.Id, &identity.Provider, &identity.ProviderUserId, &email, &avatarURL, &identity.CreatedAt, &lastLoginAt)
+		if err != nil {
+			return nil, err
+		}
+		identity.Email = email.String
+		identity.AvatarURL = avatarURL.String
+		if lastLoginAt.Valid {
+			identity.LastLoginAt = &lastLoginAt.Time
+		}
+		identities = append(identities, identity)
+	}
+	return identities, rows.Err()
+}
+
+// UnlinkIdentity removes the OAuth account of provider from the user. It reports false when none is linked
+// and fails with ErrLastLoginMethod when the user has neither a password nor another identity.
+func (s *service) UnlinkIdentity(userID string, provider string) (bool, error) {
+	ctx := context.Background()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var hasPassword bool
+	err = tx.QueryRowContext(ctx, "SELECT password <> '' FROM users WHERE id = $1 FOR UPDATE", userID).Scan(&hasPassword)
+	if err != nil {
+		return false, err
+	}
+
+	res, err := tx.ExecContext(ctx, "DELETE FROM user_identities WHERE user_id = $1 AND provider = $2", userID, provider)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil || n == 0 {
+		return false, err
+	}
+
+	if !hasPassword {
+		var remaining int
+		err = tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM user_identities WHERE user_id = $1", userID).Scan(&remaining)
+		if err != nil {
+			return false, err
+		}
+		if remaining == 0 {
+			return false, ErrLastLoginMethod
+		}
+	}
+
+	return true, tx.Commit()
+}
+
+// SetLastLoginProvider records how the user logged in last, e.g. "WEB" for a password login
+func (s *service) SetLastLoginProvider(userID string, provider string) error {
+	_, err := s.db.Exec("UPDATE users SET last_login_provider = $2 WHERE id = $1", userID, loginProvider(provider))
+	return err
+}
+
+// loginProvider maps a goth provider name to the value stored in users.last_login_provider
+func loginProvider(provider string) string {
+	return strings.ToUpper(provider)
+}
+
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
+func nullJSON(raw json.RawMessage) any {
+	if len(raw) == 0 {
+		return nil
+	}
+	return string(raw)
+}
@@ -0,0 +1,55 @@
+package database
+
+import (
+	"errors"
+	"golang.org/x/crypto/bcrypt"
+	"testing"
+)
+
+func TestLinkLegacyOAuthUser(t *testing.T) {
+	s := newTestService(t, "users/create_users_table", "users/widen_last_login_provider", "user_identities/create_user_identities")
+
+	// Rows as the OAuth login wrote them before identities existed: email as username, a random
+	// bcrypt password and last_login_provider left at its default
+	random, err := bcrypt.GenerateFromPassword([]byte("Xq3vB9kLm2Pz"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacyID := insertTestUser(t, s, "old@example.com", string(random))
+	var provider string
+	if err := s.db.QueryRow("SELECT last_login_provider FROM users WHERE id = $1", legacyID).Scan(&provider); err != nil || provider != "WEB" {
+		t.Fatalf("expected the baseline default provider WEB, got %q (%v)", provider, err)
+	}
+	insertTestUser(t, s, "jane_doe", string(random))
+	migrate(t, s, "user_identities/add_legacy_oauth_users")
+	insertTestUser(t, s, "new@example.com", string(random))
+
+	identity := &Identity{Provider: "google", ProviderUserId: "g-1", Email: "old@example.com"}
+	if userID, err := s.LoginWithIdentity(identity); err != nil || userID != "" {
+		t.Fatalf("expected no linked identity yet, got %q (%v)", userID, err)
+	}
+	if _, err := s.CreateUserWithIdentity(identity.Email, identity); !errors.Is(err, ErrUsernameTaken) {
+		t.Fatalf("expected ErrUsernameTaken, got %v", err)
+	}
+
+	userID, err := s.LinkLegacyOAuthUser(identity)
+	if err != nil || userID != legacyID {
+		t.Fatalf("expected the legacy account %s, got %q (%v)", legacyID, userID, err)
+	}
+	// The next login goes through the identity, the account is only claimed once
+	if userID, err := s.LoginWithIdentity(identity); err != nil || userID != legacyID {
+		t.Errorf("expected the identity to log in to %s, got %q (%v)", legacyID, userID, err)
+	}
+	other := &Identity{Provider: "github", ProviderUserId: "gh-1", Email: "old@example.com"}
+	if userID, err := s.LinkLegacyOAuthUser(other); err != nil || userID != "" {
+		t.Errorf("expected the account to be claimed only once, got %q (%v)", userID, err)
+	}
+
+	// Accounts registered after the migration, and usernames that are no email, are never claimed
+	for _, email := range []string{"new@example.com", "jane_doe"} {
+		identity := &Identity{Provider: "google", ProviderUserId: "g-" + email, Email: email}
+		if userID, err := s.LinkLegacyOAuthUser(identity); err != nil || userID != "" {
+			t.Errorf("%s: expected the account not to be linked, got %q (%v)", email, userID, err)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package database
+
+import (
+	"context"
+	"time"
+)
+
+// Impersonation is the audit record of an admin acting as another user
+type Impersonation struct {
+	Id            string    `json:"id"`
+	AdminId       string    `json:"admin_id"`
+	AdminUsername string    `json:"admin_username"`
+	UserId        string    `json:"user_id"`
+	SessionId     string    `json:"session_id"`
+	Reason        string    `json:"reason"`
+	IpAddress     string    `json:"ip_address"`
+	UserAgent     string    `json:"user_agent"`
+	CreatedAt     time.Time `json:"created_at"`
+	ExpiresAt     time.Time `json:"expires_at"`
+}
+
+const impersonationColumns = `id, COALESCE(admin_id::text, ''), admin_username, user_id, session_id, reason,
+	COALESCE(ip_address, ''), COALESCE(user_agent, ''), created_at, expires_at`
+
+func scanImpersonation(row interface{ Scan(...any) error }) (*Impersonation, error) {
+	var imp Impersonation
+	err := row.Scan(&imp.Id, &imp.AdminId, &imp.AdminUsername, &imp.UserId, &imp.SessionId, &imp.Reason,
+		&imp.IpAddress, &imp.UserAgent, &imp.CreatedAt, &imp.ExpiresAt)
+	if err != nil {
+		return nil, err
+	}
+	return &imp, nil
+}
+
+// StartImpersonation records the impersonation together with the access token issued for it,
+// the token has no refresh token and cannot outlive imp.ExpiresAt
+func (s *service) StartImpersonation(imp *Impersonation, jti string, tokenHash string) (*Impersonation, error) {
+	ctx := context.Background()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO tokens (user_id, family_id, jti, token, expires_at, ip_address, user_agent)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+	`, imp.UserId, imp.SessionId, jti, tokenHash, imp.ExpiresAt, nullString(imp.IpAddress), nullString(imp.UserAgent))
+	if err != nil {
+		return nil, err
+	}
+
+	row := tx.QueryRowContext(ctx, `
+		INSERT INTO impersonations (admin_id, admin_username, user_id, session_id, reason, ip_address, user_agent, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		RETURNING `+impersonationColumns,
+		imp.AdminId, imp.AdminUsername, imp.UserId, imp.SessionId, imp.Reason,
+		nullString(imp.IpAddress), nullString(imp.UserAgent), imp.ExpiresAt,
+	)
+	started, err := scanImpersonation(row)
+	if err != nil {
+		return nil, err
+	}
+	return started, tx.Commit()
+}
+
+// GetImpersonations returns the latest impersonations, of one user when userID is not empty
+func (s *service) GetImpersonations(userID string, limit int) ([]Impersonation, error) {
+	rows, err := s.db.Query(`
+		SELECT `+impersonationColumns+`
+		FROM impersonations
+		WHERE $1 = '' OR user_id::text = $1
+		ORDER BY created_at DESC
+		LIMIT $2
+	`, userID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	impersonations := []Impersonation{}
+	for rows.Next() {
+		imp, err := scanImpersonation(rows)
+		if err != nil {
+			return nil, err
+		}
+		impersonations = append(impersonations, *imp)
+	}
+	return impersonations, rows.Err()
+}
+
+// GetImpersonationBySession returns the impersonation a session was started for, or sql.ErrNoRows
+func (s *service) GetImpersonationBySession(sessionID string) (*Impersonation, error) {
+	row := s.db.QueryRow("SELECT "+impersonationColumns+" FROM impersonations WHERE session_id = $1", sessionID)
+	return scanImpersonation(row)
+}
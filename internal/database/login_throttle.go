@@ -0,0 +1,123 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// Scopes failed login attempts are counted in
+const (
+	ThrottleScopeUsername = "USERNAME"
+	ThrottleScopeIP       = "IP"
+)
+
+// LoginThrottle is the failed login counter of a username or IP
+type LoginThrottle struct {
+	Failures      int        `json:"failures"`
+	LastFailureAt time.Time  `json:"last_failure_at"`
+	LockedUntil   *time.Time `json:"locked_until"`
+}
+
+// ReserveLoginAttempt counts an attempt against the key before the credentials are checked, so that
+// concurrent attempts cannot all pass the check before any of them is recorded. The row is locked while
+// retryAfter decides on the counter as it was before this attempt; a key that already reached maxFailures
+// within window is locked for lockout. It returns how long the key has to wait when the attempt was
+// refused, in which case nothing is counted, and the counter including this attempt otherwise.
+func (s *service) ReserveLoginAttempt(scope string, key string, window time.Duration, maxFailures int, lockout time.Duration, retryAfter func(*LoginThrottle) time.Duration) (*LoginThrottle, time.Duration, error) {
+	ctx := context.Background()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer tx.Rollback()
+
+	// The no-op update takes the row lock, so concurrent attempts on the key queue up here
+	// and each one sees the counter the previous one left
+	var (
+		throttle    LoginThrottle
+		lockedUntil sql.NullTime
+		now         time.Time
+	)
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO login_throttles AS t (scope, key, failures, last_failure_at)
+		VALUES ($1, $2, 0, NOW())
+		ON CONFLICT (scope, key) DO UPDATE
+		SET failures = t.failures
+		RETURNING failures, last_failure_at, locked_until, NOW()
+	`, scope, key).Scan(&throttle.Failures, &throttle.LastFailureAt, &lockedUntil, &now)
+	if err != nil {
+		return nil, 0, err
+	}
+	if lockedUntil.Valid {
+		throttle.LockedUntil = &lockedUntil.Time
+	}
+	if throttle.LastFailureAt.Before(now.Add(-window)) {
+		throttle.Failures = 0
+	}
+
+	if wait := retryAfter(&throttle); wait > 0 {
+		return &throttle, wait, nil
+	}
+
+	if throttle.Failures >= maxFailures {
+		until := now.Add(lockout)
+		_, err = tx.ExecContext(ctx, `
+			UPDATE login_throttles
+			SET locked_until = $3, failures = 0
+			WHERE scope = $1 AND key = $2
+		`, scope, key, until)
+		if err != nil {
+			return nil, 0, err
+		}
+		throttle.Failures = 0
+		throttle.LockedUntil = &until
+		return &throttle, lockout, tx.Commit()
+	}
+
+	throttle.Failures++
+	throttle.LastFailureAt = now
+	_, err = tx.ExecContext(ctx, `
+		UPDATE login_throttles
+		SET failures = $3, last_failure_at = $4
+		WHERE scope = $1 AND key = $2
+	`, scope, key, throttle.Failures, now)
+	if err != nil {
+		return nil, 0, err
+	}
+	return &throttle, 0, tx.Commit()
+}
+
+// ReleaseLoginAttempt takes back an attempt reserved with ReserveLoginAttempt that turned out not to be a failure
+func (s *service) ReleaseLoginAttempt(scope string, key string) error {
+	_, err := s.db.Exec(`
+		UPDATE login_throttles
+		SET failures = GREATEST(failures - 1, 0)
+		WHERE scope = $1 AND key = $2
+	`, scope, key)
+	return err
+}
+
+// ClearLoginThrottle resets the counter and lifts a lockout. It reports false when there was nothing to clear.
+func (s *service) ClearLoginThrottle(scope string, key string) (bool, error) {
+	res, err := s.db.Exec("DELETE FROM login_throttles WHERE scope = $1 AND key = $2", scope, key)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// loginThrottleJanitorLock is the advisory lock key held while purging login throttles
+const loginThrottleJanitorLock int64 = 0x6c6f67696e // "login"
+
+// PurgeLoginThrottles deletes the counters whose last failure was before the given time and that are
+// not locked anymore. Pass the start of the failure window: such counters restart on the next attempt
+// anyway. It reports false without deleting anything when another replica holds the lock.
+func (s *service) PurgeLoginThrottles(ctx context.Context, before time.Time) (int64, bool, error) {
+	return s.purgeLocked(ctx, loginThrottleJanitorLock, `
+		DELETE FROM login_throttles
+		WHERE last_failure_at < $1
+		  AND (locked_until IS NULL OR locked_until < NOW())
+	`, before)
+}
@@ -0,0 +1,87 @@
+package database
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestReserveLoginAttemptConcurrent(t *testing.T) {
+	s := newTestService(t, "login_throttles/create_login_throttles")
+
+	const maxFailures = 5
+	noDelay := func(throttle *LoginThrottle) time.Duration {
+		if throttle.LockedUntil != nil && throttle.LockedUntil.After(time.Now()) {
+			return time.Until(*throttle.LockedUntil)
+		}
+		return 0
+	}
+
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		allowed int
+	)
+	for i := 0; i < 4*maxFailures; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, wait, err := s.ReserveLoginAttempt(ThrottleScopeUsername, "jane", time.Minute, maxFailures, time.Hour, noDelay)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if wait <= 0 {
+				mu.Lock()
+				allowed++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if allowed != maxFailures {
+		t.Errorf("expected %d attempts to get through, got %d", maxFailures, allowed)
+	}
+	if _, wait, err := s.ReserveLoginAttempt(ThrottleScopeUsername, "jane", time.Minute, maxFailures, time.Hour, noDelay); err != nil || wait <= 0 {
+		t.Errorf("expected the username to be locked, got wait %s (%v)", wait, err)
+	}
+
+	// A released attempt is not counted, another key is not affected
+	for i := 0; i < 2*maxFailures; i++ {
+		if _, wait, err := s.ReserveLoginAttempt(ThrottleScopeUsername, "joe", time.Minute, maxFailures, time.Hour, noDelay); err != nil || wait > 0 {
+			t.Fatalf("attempt %d: expected released attempts to be given back, got wait %s (%v)", i, wait, err)
+		}
+		if err := s.ReleaseLoginAttempt(ThrottleScopeUsername, "joe"); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestPurgeLoginThrottles(t *testing.T) {
+	s := newTestService(t, "login_throttles/create_login_throttles")
+
+	_, err := s.db.Exec(`
+		INSERT INTO login_throttles (scope, key, failures, last_failure_at, locked_until) VALUES
+			('USERNAME', 'stale', 3, NOW() - INTERVAL '1 hour', NULL),
+			('USERNAME', 'expired', 0, NOW() - INTERVAL '1 hour', NOW() - INTERVAL '30 minutes'),
+			('USERNAME', 'locked', 0, NOW() - INTERVAL '1 hour', NOW() + INTERVAL '1 hour'),
+			('IP', 'recent', 2, NOW(), NULL)
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deleted, ok, err := s.PurgeLoginThrottles(context.Background(), time.Now().Add(-15*time.Minute))
+	if err != nil || !ok {
+		t.Fatalf("expected the purge to run, got %v (%v)", ok, err)
+	}
+	if deleted != 2 {
+		t.Errorf("expected the stale and expired counters to be deleted, got %d rows", deleted)
+	}
+	var left int
+	if err := s.db.QueryRow(`SELECT COUNT(*) FROM login_throttles WHERE key IN ('locked', 'recent')`).Scan(&left); err != nil || left != 2 {
+		t.Errorf("expected the locked and recent counters to be kept, got %d (%v)", left, err)
+	}
+}
@@ -0,0 +1,117 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+var (
+	// ErrMagicLinkInvalid is returned when a magic link is unknown, expired or already used
+	ErrMagicLinkInvalid = errors.New("invalid or expired login link")
+	// ErrMagicLinkThrottled is returned when the previous link of the user was sent too recently
+	ErrMagicLinkThrottled = errors.New("a login link was sent recently, please check your inbox")
+)
+
+// CreateMagicLink records a new magic link of the user, unless one was created less than minInterval ago.
+// Links issued earlier and not used yet stop working.
+func (s *service) CreateMagicLink(userID string, linkID string, expiresAt time.Time, minInterval time.Duration) error {
+	ctx := context.Background()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Serializes concurrent requests of the same user so that the interval holds
+	_, err = tx.ExecContext(ctx, "SELECT id FROM users WHERE id = $1 FOR UPDATE", userID)
+	if err != nil {
+		return err
+	}
+
+	var recent bool
+	err = tx.QueryRowContext(ctx, `
+		SELECT EXISTS (
+			SELECT 1 FROM magic_links
+			WHERE user_id = $1 AND created_at > NOW() - make_interval(secs => $2)
+		)
+	`, userID, minInterval.Seconds()).Scan(&recent)
+	if err != nil {
+		return err
+	}
+	if recent {
+		return ErrMagicLinkThrottled
+	}
+
+	_, err = tx.ExecContext(ctx, "DELETE FROM magic_links WHERE user_id = $1 AND used_at IS NULL", userID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO magic_links (id, user_id, expires_at)
+		VALUES ($1, $2, $3)
+	`, linkID, userID, expiresAt)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// UseMagicLink consumes the magic link of the user and verifies the address it was sent to, it returns
+// ErrMagicLinkInvalid when the link is unknown, expired or was used before. It reports true when the
+// password of the account was chosen at a registration nobody had verified: whoever registered never
+// proved to own the address, so the password is cleared and the tokens and API keys are revoked.
+// Passwords of accounts from before the registration was tracked are left alone.
+func (s *service) UseMagicLink(linkID string, userID string, email string) (bool, error) {
+	ctx := context.Background()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, `
+		UPDATE magic_links
+		SET used_at = NOW()
+		WHERE id = $1 AND user_id = $2 AND used_at IS NULL AND expires_at > NOW()
+	`, linkID, userID)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	if n == 0 {
+		return false, ErrMagicLinkInvalid
+	}
+
+	var claimed bool
+	err = tx.QueryRowContext(ctx, `
+		UPDATE users u
+		SET email_verified_at = NOW(),
+		    password = CASE WHEN old.password_unverified THEN '' ELSE u.password END,
+		    password_unverified = FALSE
+		FROM (SELECT id, password_unverified FROM users WHERE id = $1 FOR UPDATE) old
+		WHERE u.id = old.id AND u.username = $2 AND u.email_verified_at IS NULL
+		RETURNING old.password_unverified
+	`, userID, email).Scan(&claimed)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return false, err
+	}
+
+	if claimed {
+		_, err = tx.ExecContext(ctx, "UPDATE tokens SET is_valid = FALSE WHERE user_id = $1 AND is_valid = TRUE", userID)
+		if err != nil {
+			return false, err
+		}
+		if err := revokeAPIKeys(ctx, tx, userID); err != nil {
+			return false, err
+		}
+	}
+
+	return claimed, tx.Commit()
+}
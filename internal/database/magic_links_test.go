@@ -0,0 +1,87 @@
+package database
+
+import (
+	"errors"
+	"github.com/google/uuid"
+	"testing"
+	"time"
+)
+
+func TestUseMagicLinkClaimsUnverifiedAccount(t *testing.T) {
+	s := newTestService(t,
+		"users/create_users_table", "users/add_email_verification", "users/add_unverified_password",
+		"tokens/create_tokens_table", "api_keys/create_api_keys", "magic_links/create_magic_links",
+	)
+
+	// Someone registered the address of the owner with a password of their own and is logged in
+	// An account from before registrations were tracked keeps the password its owner chose
+	oldID := insertTestUser(t, s, "old@example.com", "$2a$10$old")
+
+	userID, err := s.InsertUserByUsernameAndPassword("owner@example.com", "$2a$10$squatter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.db.Exec("INSERT INTO tokens (user_id, token, expires_at) VALUES ($1, 'jwt', NOW() + INTERVAL '1 hour')", userID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.db.Exec("INSERT INTO api_keys (user_id, name, prefix, key_hash) VALUES ($1, 'ci', 'ak_', 'digest')", userID); err != nil {
+		t.Fatal(err)
+	}
+
+	useLink := func(userID string, email string) (bool, error) {
+		linkID := uuid.NewString()
+		if err := s.CreateMagicLink(userID, linkID, time.Now().Add(time.Minute), 0); err != nil {
+			t.Fatal(err)
+		}
+		return s.UseMagicLink(linkID, userID, email)
+	}
+
+	if claimed, err := useLink(oldID, "old@example.com"); err != nil || claimed {
+		t.Errorf("expected the old account to keep its password, got %t (%v)", claimed, err)
+	}
+	if _, hash, err := s.GetHashedPassword("old@example.com"); err != nil || hash != "$2a$10$old" {
+		t.Errorf("expected the old password to stay, got %q (%v)", hash, err)
+	}
+	if verified, err := s.IsEmailVerified(oldID); err != nil || !verified {
+		t.Errorf("expected the old address to be verified, got %t (%v)", verified, err)
+	}
+
+	claimed, err := useLink(userID, "owner@example.com")
+	if err != nil || !claimed {
+		t.Fatalf("expected the first link to claim the account, got %t (%v)", claimed, err)
+	}
+	var (
+		password             string
+		validTokens, apiKeys int
+	)
+	err = s.db.QueryRow(`
+		SELECT password,
+		       (SELECT COUNT(*) FROM tokens WHERE user_id = users.id AND is_valid),
+		       (SELECT COUNT(*) FROM api_keys WHERE user_id = users.id AND revoked_at IS NULL)
+		FROM users WHERE id = $1
+	`, userID).Scan(&password, &validTokens, &apiKeys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if password != "" || validTokens != 0 || apiKeys != 0 {
+		t.Errorf("expected the password cleared and everything revoked, got password %q, %d tokens, %d API keys", password, validTokens, apiKeys)
+	}
+	if verified, err := s.IsEmailVerified(userID); err != nil || !verified {
+		t.Errorf("expected the address to be verified, got %t (%v)", verified, err)
+	}
+
+	// Once verified, the password the owner sets stays
+	if _, err := s.db.Exec("UPDATE users SET password = '$2a$10$owner' WHERE id = $1", userID); err != nil {
+		t.Fatal(err)
+	}
+	if claimed, err := useLink(userID, "owner@example.com"); err != nil || claimed {
+		t.Errorf("expected a later link not to claim the account again, got %t (%v)", claimed, err)
+	}
+	if _, hash, err := s.GetHashedPassword("owner@example.com"); err != nil || hash != "$2a$10$owner" {
+		t.Errorf("expected the password to stay, got %q (%v)", hash, err)
+	}
+
+	if _, err := s.UseMagicLink(uuid.NewString(), userID, "owner@example.com"); !errors.Is(err, ErrMagicLinkInvalid) {
+		t.Errorf("expected ErrMagicLinkInvalid for an unknown link, got %v", err)
+	}
+}
@@ -0,0 +1,147 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+)
+
+// ErrTOTPEnrollmentChanged is returned when TOTP was enabled or its enrollment restarted with
+// another secret while a code was being confirmed
+var ErrTOTPEnrollmentChanged = errors.New("two-factor enrollment changed, start it again")
+
+// TOTPConfig is the TOTP state of a user. Secret is set once enrollment started,
+// Enabled once it was confirmed with a first code.
+type TOTPConfig struct {
+	Secret       string
+	Enabled      bool
+	LastUsedStep int64
+}
+
+// GetTOTP returns the TOTP state of the user
+func (s *service) GetTOTP(userID string) (*TOTPConfig, error) {
+	var (
+		config       TOTPConfig
+		secret       sql.NullString
+		lastUsedStep sql.NullInt64
+	)
+	err := s.db.QueryRow(
+		"SELECT totp_secret, totp_enabled_at IS NOT NULL, totp_last_used_step FROM users WHERE id = $1", userID,
+	).Scan(&secret, &config.Enabled, &lastUsedStep)
+	if err != nil {
+		return nil, err
+	}
+	config.Secret = secret.String
+	config.LastUsedStep = lastUsedStep.Int64
+	return &config, nil
+}
+
+// SetPendingTOTPSecret starts (or restarts) enrollment. It reports false when TOTP is already enabled.
+func (s *service) SetPendingTOTPSecret(userID string, secret string) (bool, error) {
+	res, err := s.db.Exec(`
+		UPDATE users
+		SET totp_secret = $2, totp_last_used_step = NULL
+		WHERE id = $1 AND totp_enabled_at IS NULL
+	`, userID, secret)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// EnableTOTP confirms enrollment with the secret the code was checked against and replaces the recovery
+// codes of the user. It returns ErrTOTPEnrollmentChanged when TOTP is enabled already or the pending
+// secret is not the given one anymore.
+func (s *service) EnableTOTP(userID string, secret string, step int64, recoveryCodeHashes []string) error {
+	ctx := context.Background()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, `
+		UPDATE users
+		SET totp_enabled_at = NOW(), totp_last_used_step = $3
+		WHERE id = $1 AND totp_secret = $2 AND totp_enabled_at IS NULL
+	`, userID, secret, step)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrTOTPEnrollmentChanged
+	}
+
+	_, err = tx.ExecContext(ctx, "DELETE FROM mfa_recovery_codes WHERE user_id = $1", userID)
+	if err != nil {
+		return err
+	}
+	for _, codeHash := range recoveryCodeHashes {
+		_, err = tx.ExecContext(ctx, "INSERT INTO mfa_recovery_codes (user_id, code_hash) VALUES ($1, $2)", userID, codeHash)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// UseTOTPStep records a successfully validated time step. It reports false when the step,
+// or a later one, was already used so that a code cannot be replayed.
+func (s *service) UseTOTPStep(userID string, step int64) (bool, error) {
+	res, err := s.db.Exec(`
+		UPDATE users
+		SET totp_last_used_step = $2
+		WHERE id = $1 AND (totp_last_used_step IS NULL OR totp_last_used_step < $2)
+	`, userID, step)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// UseRecoveryCode consumes a recovery code, it reports false when the code is unknown or already used
+func (s *service) UseRecoveryCode(userID string, codeHash string) (bool, error) {
+	res, err := s.db.Exec(`
+		UPDATE mfa_recovery_codes
+		SET used_at = NOW()
+		WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL
+	`, userID, codeHash)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// DisableTOTP removes the TOTP secret and the recovery codes of the user
+func (s *service) DisableTOTP(userID string) error {
+	ctx := context.Background()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `
+		UPDATE users
+		SET totp_secret = NULL, totp_enabled_at = NULL, totp_last_used_step = NULL
+		WHERE id = $1
+	`, userID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, "DELETE FROM mfa_recovery_codes WHERE user_id = $1", userID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,33 @@
+package database
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestEnableTOTPChecksPendingSecret(t *testing.T) {
+	s := newTestService(t, "users/create_users_table", "mfa/create_mfa")
+	userID := insertTestUser(t, s, "jane@example.com", "$2a$10$hash")
+
+	if _, err := s.SetPendingTOTPSecret(userID, "first"); err != nil {
+		t.Fatal(err)
+	}
+	// The enrollment restarted in another tab after the code was checked against the first secret
+	if _, err := s.SetPendingTOTPSecret(userID, "second"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.EnableTOTP(userID, "first", 1, []string{"code"}); !errors.Is(err, ErrTOTPEnrollmentChanged) {
+		t.Errorf("expected ErrTOTPEnrollmentChanged for a replaced secret, got %v", err)
+	}
+
+	if err := s.EnableTOTP(userID, "second", 1, []string{"code"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.EnableTOTP(userID, "second", 2, []string{"other"}); !errors.Is(err, ErrTOTPEnrollmentChanged) {
+		t.Errorf("expected ErrTOTPEnrollmentChanged once enabled, got %v", err)
+	}
+	var codes int
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM mfa_recovery_codes WHERE user_id = $1 AND code_hash = 'code'", userID).Scan(&codes); err != nil || codes != 1 {
+		t.Errorf("expected the recovery codes of the first confirmation to be kept, got %d (%v)", codes, err)
+	}
+}
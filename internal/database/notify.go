@@ -0,0 +1,59 @@
+package database
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// tokenRevokedChannel carries the user id of revoked access tokens, see the add_revocation_notify migration
+const tokenRevokedChannel = "token_revoked"
+
+// WatchTokenRevocations listens on the token_revoked channel and calls revoked with the user id of
+// every notification until ctx is cancelled. listening is called with true once LISTEN is in place
+// and with false when the connection is lost; notifications sent in between are missed, so callers
+// should not trust cached token state while not listening. Lost connections are reopened with a backoff.
+func (s *service) WatchTokenRevocations(ctx context.Context, revoked func(userID string), listening func(bool)) {
+	backoff := time.Second
+	for {
+		err := s.listen(ctx, revoked, func() {
+			backoff = time.Second
+			listening(true)
+		})
+		listening(false)
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("Listening for token revocations failed, retrying in %s: %v", backoff, err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, 30*time.Second)
+	}
+}
+
+func (s *service) listen(ctx context.Context, revoked func(userID string), ready func()) error {
+	conn, err := pgx.Connect(ctx, s.connStr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(context.Background())
+
+	if _, err := conn.Exec(ctx, "LISTEN "+tokenRevokedChannel); err != nil {
+		return err
+	}
+	ready()
+
+	for {
+		notification, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+		revoked(notification.Payload)
+	}
+}
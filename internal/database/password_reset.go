@@ -0,0 +1,102 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+var (
+	// ErrResetTokenInvalid is returned when a password reset token is unknown, expired or already used
+	ErrResetTokenInvalid = errors.New("invalid or expired password reset token")
+	// ErrPasswordResetThrottled is returned when the previous reset link of the user was sent too recently
+	ErrPasswordResetThrottled = errors.New("a password reset link was sent recently, please check your inbox")
+)
+
+// CreatePasswordReset stores the digest of a new reset token for the user, unless one was created less
+// than minInterval ago. Reset tokens issued earlier and not used yet stop working.
+func (s *service) CreatePasswordReset(userID string, tokenHash string, expiresAt time.Time, minInterval time.Duration) error {
+	ctx := context.Background()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Serializes concurrent requests of the same user so that the interval holds
+	_, err = tx.ExecContext(ctx, "SELECT id FROM users WHERE id = $1 FOR UPDATE", userID)
+	if err != nil {
+		return err
+	}
+
+	var recent bool
+	err = tx.QueryRowContext(ctx, `
+		SELECT EXISTS (
+			SELECT 1 FROM password_resets
+			WHERE user_id = $1 AND created_at > NOW() - make_interval(secs => $2)
+		)
+	`, userID, minInterval.Seconds()).Scan(&recent)
+	if err != nil {
+		return err
+	}
+	if recent {
+		return ErrPasswordResetThrottled
+	}
+
+	_, err = tx.ExecContext(ctx, "DELETE FROM password_resets WHERE user_id = $1 AND used_at IS NULL", userID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO password_resets (user_id, token_hash, expires_at)
+		VALUES ($1, $2, $3)
+	`, userID, tokenHash, expiresAt)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// ResetPassword consumes a reset token, stores the new password hash and invalidates every token and API key of the user.
+// It returns the id of the user whose password was changed.
+func (s *service) ResetPassword(tokenHash string, hashedPassword string) (string, error) {
+	ctx := context.Background()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	var userID string
+	err = tx.QueryRowContext(ctx, `
+		UPDATE password_resets
+		SET used_at = NOW()
+		WHERE token_hash = $1 AND used_at IS NULL AND expires_at > NOW()
+		RETURNING user_id
+	`, tokenHash).Scan(&userID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", ErrResetTokenInvalid
+		}
+		return "", err
+	}
+
+	_, err = tx.ExecContext(ctx, "UPDATE users SET password = $1, password_unverified = FALSE WHERE id = $2", hashedPassword, userID)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = tx.ExecContext(ctx, "UPDATE tokens SET is_valid = FALSE WHERE user_id = $1 AND is_valid = TRUE", userID)
+	if err != nil {
+		return "", err
+	}
+
+	if err := revokeAPIKeys(ctx, tx, userID); err != nil {
+		return "", err
+	}
+
+	return userID, tx.Commit()
+}
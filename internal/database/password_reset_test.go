@@ -0,0 +1,30 @@
+package database
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCreatePasswordResetThrottled(t *testing.T) {
+	s := newTestService(t, "users/create_users_table", "password_resets/create_password_resets")
+	userID := insertTestUser(t, s, "jane@example.com", "$2a$10$hash")
+
+	expiresAt := time.Now().Add(time.Hour)
+	if err := s.CreatePasswordReset(userID, "digest-1", expiresAt, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	// A second request within the interval must not replace the link that was just sent
+	if err := s.CreatePasswordReset(userID, "digest-2", expiresAt, time.Minute); !errors.Is(err, ErrPasswordResetThrottled) {
+		t.Errorf("expected ErrPasswordResetThrottled, got %v", err)
+	}
+	var pending int
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM password_resets WHERE user_id = $1 AND token_hash = 'digest-1'", userID).Scan(&pending); err != nil || pending != 1 {
+		t.Errorf("expected the first link to stay usable, got %d (%v)", pending, err)
+	}
+
+	if err := s.CreatePasswordReset(userID, "digest-3", expiresAt, 0); err != nil {
+		t.Errorf("expected a new link once the interval passed, got %v", err)
+	}
+}
@@ -0,0 +1,303 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Permissions checked by the server, they are seeded by the roles migration
+const (
+	PermAdminAccess           = "admin:access"
+	PermAnimalsWrite          = "animals:write"
+	PermRolesManage           = "roles:manage"
+	PermSessionPoliciesManage = "session_policies:manage"
+	PermUsersUnlock           = "users:unlock"
+	PermUsersImpersonate      = "users:impersonate"
+	PermAuditRead             = "audit:read"
+)
+
+var (
+	// ErrRoleNotFound is returned when no role has the given name
+	ErrRoleNotFound = errors.New("role not found")
+	// ErrRoleExists is returned when creating a role with the name of an existing one
+	ErrRoleExists = errors.New("a role with this name already exists")
+	// ErrSystemRole is returned when changing or deleting one of the seeded roles
+	ErrSystemRole = errors.New("system roles cannot be changed or deleted")
+	// ErrRoleInUse is returned when deleting a role that is still assigned to users
+	ErrRoleInUse = errors.New("role is still assigned to users")
+	// ErrUnknownPermission is returned when granting a permission that does not exist
+	ErrUnknownPermission = errors.New("unknown permission")
+)
+
+// Role is a named set of permissions assigned to users through users.role
+type Role struct {
+	Id          string    `json:"id"`
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	IsSystem    bool      `json:"is_system"`
+	Permissions []string  `json:"permissions"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// Permission is an action the server checks before letting a request through
+type Permission struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+// GetPermissions lists the permissions roles can be granted
+func (s *service) GetPermissions() ([]Permission, error) {
+	rows, err := s.db.Query("SELECT name, description FROM permissions ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	permissions := []Permission{}
+	for rows.Next() {
+		var p Permission
+		if err := rows.Scan(&p.Name, &p.Description); err != nil {
+			return nil, err
+		}
+		permissions = append(permissions, p)
+	}
+	return permissions, rows.Err()
+}
+
+// GetRoles lists the roles with their permissions
+func (s *service) GetRoles() ([]Role, error) {
+	rows, err := s.db.Query(`
+		SELECT r.id, r.name, r.description, r.is_system, r.created_at, r.updated_at, rp.permission
+		FROM roles r
+		LEFT JOIN role_permissions rp ON rp.role_id = r.id
+		ORDER BY r.is_system DESC, r.name, rp.permission
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	roles := []Role{}
+	for rows.Next() {
+		var (
+			role       Role
+			permission sql.NullString
+		)
+		err := rows.Scan(&role.Id, &role.Name, &role.Description, &role.IsSystem, &role.CreatedAt, &role.UpdatedAt, &permission)
+		if err != nil {
+			return nil, err
+		}
+		if len(roles) == 0 || roles[len(roles)-1].Id != role.Id {
+			role.Permissions = []string{}
+			roles = append(roles, role)
+		}
+		if permission.Valid {
+			last := &roles[len(roles)-1]
+			last.Permissions = append(last.Permissions, permission.String)
+		}
+	}
+	return roles, rows.Err()
+}
+
+// GetRole returns the role with its permissions, or ErrRoleNotFound
+func (s *service) GetRole(name string) (*Role, error) {
+	return getRole(context.Background(), s.db, name)
+}
+
+// CreateRole adds a custom role granting the permissions of role.Permissions
+func (s *service) CreateRole(role *Role) (*Role, error) {
+	ctx := context.Background()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var roleID string
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO roles (name, description)
+		VALUES ($1, $2)
+		ON CONFLICT (name) DO NOTHING
+		RETURNING id
+	`, role.Name, role.Description).Scan(&roleID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrRoleExists
+		}
+		return nil, err
+	}
+
+	if err := setRolePermissions(ctx, tx, roleID, role.Permissions); err != nil {
+		return nil, err
+	}
+
+	created, err := getRole(ctx, tx, role.Name)
+	if err != nil {
+		return nil, err
+	}
+	return created, tx.Commit()
+}
+
+// UpdateRole replaces the description and permissions of a custom role
+func (s *service) UpdateRole(name string, description string, permissions []string) (*Role, error) {
+	ctx := context.Background()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	role, err := getRole(ctx, tx, name)
+	if err != nil {
+		return nil, err
+	}
+	if role.IsSystem {
+		return nil, ErrSystemRole
+	}
+
+	_, err = tx.ExecContext(ctx, "UPDATE roles SET description = $2 WHERE id = $1", role.Id, description)
+	if err != nil {
+		return nil, err
+	}
+	if err := setRolePermissions(ctx, tx, role.Id, permissions); err != nil {
+		return nil, err
+	}
+
+	updated, err := getRole(ctx, tx, name)
+	if err != nil {
+		return nil, err
+	}
+	return updated, tx.Commit()
+}
+
+// DeleteRole removes a custom role that is no longer assigned to anyone, together with its session policy
+func (s *service) DeleteRole(name string) error {
+	ctx := context.Background()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	role, err := getRole(ctx, tx, name)
+	if err != nil {
+		return err
+	}
+	if role.IsSystem {
+		return ErrSystemRole
+	}
+
+	var inUse bool
+	err = tx.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM users WHERE role = $1)", name).Scan(&inUse)
+	if err != nil {
+		return err
+	}
+	if inUse {
+		return ErrRoleInUse
+	}
+
+	_, err = tx.ExecContext(ctx, "DELETE FROM roles WHERE id = $1", role.Id)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// SetUserRole assigns a role to the user, it reports false when the user does not exist
+func (s *service) SetUserRole(userID string, role string) (bool, error) {
+	if _, err := s.GetRole(role); err != nil {
+		return false, err
+	}
+
+	res, err := s.db.Exec("UPDATE users SET role = $2 WHERE id = $1", userID, role)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// GetUserPermissions returns the permissions granted by the current role of the user
+func (s *service) GetUserPermissions(userID string) ([]string, error) {
+	rows, err := s.db.Query(`
+		SELECT rp.permission
+		FROM users u
+		JOIN roles r ON r.name = u.role
+		JOIN role_permissions rp ON rp.role_id = r.id
+		WHERE u.id = $1
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	permissions := []string{}
+	for rows.Next() {
+		var permission string
+		if err := rows.Scan(&permission); err != nil {
+			return nil, err
+		}
+		permissions = append(permissions, permission)
+	}
+	return permissions, rows.Err()
+}
+
+func getRole(ctx context.Context, q querier, name string) (*Role, error) {
+	var role Role
+	err := q.QueryRowContext(ctx,
+		"SELECT id, name, description, is_system, created_at, updated_at FROM roles WHERE name = $1", name,
+	).Scan(&role.Id, &role.Name, &role.Description, &role.IsSystem, &role.CreatedAt, &role.UpdatedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrRoleNotFound
+		}
+		return nil, err
+	}
+
+	rows, err := q.QueryContext(ctx, "SELECT permission FROM role_permissions WHERE role_id = $1 ORDER BY permission", role.Id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	role.Permissions = []string{}
+	for rows.Next() {
+		var permission string
+		if err := rows.Scan(&permission); err != nil {
+			return nil, err
+		}
+		role.Permissions = append(role.Permissions, permission)
+	}
+	return &role, rows.Err()
+}
+
+func setRolePermissions(ctx context.Context, q querier, roleID string, permissions []string) error {
+	_, err := q.ExecContext(ctx, "DELETE FROM role_permissions WHERE role_id = $1", roleID)
+	if err != nil {
+		return err
+	}
+
+	for _, permission := range permissions {
+		var exists bool
+		err := q.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM permissions WHERE name = $1)", permission).Scan(&exists)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return fmt.Errorf("%w %q", ErrUnknownPermission, permission)
+		}
+
+		_, err = q.ExecContext(ctx, `
+			INSERT INTO role_permissions (role_id, permission) VALUES ($1, $2)
+			ON CONFLICT DO NOTHING
+		`, roleID, permission)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newTestService returns a service whose connections work in a fresh schema of the test container,
+// with the given migrations, e.g. "users/create_users_table", applied in order
+func newTestService(t *testing.T, migrations ...string) *service {
+	t.Helper()
+	base := New().(*service)
+
+	schema := "test_" + strings.ToLower(strings.NewReplacer("/", "_", " ", "_").Replace(t.Name()))
+	ctx := context.Background()
+	for _, stmt := range []string{
+		`CREATE EXTENSION IF NOT EXISTS "uuid-ossp" SCHEMA public`,
+		fmt.Sprintf("DROP SCHEMA IF EXISTS %s CASCADE", schema),
+		fmt.Sprintf("CREATE SCHEMA %s", schema),
+	} {
+		if _, err := base.db.ExecContext(ctx, stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	connStr := base.connStr + "&search_path=" + schema + ",public"
+	db, err := sql.Open("pgx", connStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Close()
+		base.db.ExecContext(ctx, fmt.Sprintf("DROP SCHEMA IF EXISTS %s CASCADE", schema))
+	})
+
+	s := &service{db: db, connStr: connStr}
+	migrate(t, s, migrations...)
+	return s
+}
+
+// migrate applies the up migrations to the schema of the service
+func migrate(t *testing.T, s *service, migrations ...string) {
+	t.Helper()
+	for _, migration := range migrations {
+		up, err := os.ReadFile(filepath.Join("..", "migrations", migration+".up.sql"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.db.Exec(string(up)); err != nil {
+			t.Fatalf("migration %s: %v", migration, err)
+		}
+	}
+}
+
+// insertTestUser adds a user with a password hash and returns its id
+func insertTestUser(t *testing.T, s *service, username string, hashedPassword string) string {
+	t.Helper()
+	var id string
+	err := s.db.QueryRow(
+		"INSERT INTO users (username, password, fullname) VALUES ($1, $2, $1) RETURNING id", username, hashedPassword,
+	).Scan(&id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
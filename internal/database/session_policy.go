@@ -0,0 +1,262 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"maps"
+	"time"
+)
+
+const (
+	// OnLimitEvictOldest logs out the oldest session to make room for a new one
+	OnLimitEvictOldest = "EVICT_OLDEST"
+	// OnLimitRejectNew refuses new logins once the limit is reached
+	OnLimitRejectNew = "REJECT_NEW"
+)
+
+var (
+	// ErrSessionLimitReached is returned by StartSession when the policy rejects new sessions
+	ErrSessionLimitReached = errors.New("maximum number of active sessions reached")
+	// ErrSessionPolicyTarget is returned by UpsertSessionPolicy when the user or role of the policy does not exist
+	ErrSessionPolicyTarget = errors.New("unknown user or role")
+)
+
+// SessionPolicy limits the number of concurrent sessions of a role or of a single user.
+// A MaxSessions of 0 means unlimited; DeviceLimits caps sessions per device type.
+type SessionPolicy struct {
+	Id           string         `json:"id"`
+	Role         string         `json:"role,omitempty"`
+	UserId       string         `json:"user_id,omitempty"`
+	MaxSessions  int            `json:"max_sessions"`
+	OnLimit      string         `json:"on_limit"`
+	DeviceLimits map[string]int `json:"device_limits"`
+	CreatedAt    time.Time      `json:"created_at"`
+	UpdatedAt    time.Time      `json:"updated_at"`
+}
+
+// DefaultSessionPolicy applies to users that have neither a user nor a role policy
+var DefaultSessionPolicy = SessionPolicy{
+	MaxSessions:  2,
+	OnLimit:      OnLimitEvictOldest,
+	DeviceLimits: map[string]int{},
+}
+
+type querier interface {
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+const sessionPolicyColumns = `id, COALESCE(role, ''), COALESCE(user_id::text, ''), COALESCE(max_sessions, 0), on_limit, device_limits, created_at, updated_at`
+
+func scanSessionPolicy(row interface{ Scan(...any) error }) (*SessionPolicy, error) {
+	var (
+		policy       SessionPolicy
+		deviceLimits []byte
+	)
+	err := row.Scan(&policy.Id, &policy.Role, &policy.UserId, &policy.MaxSessions, &policy.OnLimit, &deviceLimits, &policy.CreatedAt, &policy.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(deviceLimits, &policy.DeviceLimits); err != nil {
+		return nil, err
+	}
+	return &policy, nil
+}
+
+// effectiveSessionPolicy returns the policy of the user, falling back to the policy of the role
+func effectiveSessionPolicy(ctx context.Context, q querier, userID string, role string) (*SessionPolicy, error) {
+	policy, err := scanSessionPolicy(q.QueryRowContext(ctx, `
+		SELECT `+sessionPolicyColumns+`
+		FROM session_policies
+		WHERE user_id = $1 OR role = $2
+		ORDER BY user_id IS NULL
+		LIMIT 1
+	`, userID, role))
+	if errors.Is(err, sql.ErrNoRows) {
+		// Callers get a copy, so that nothing they do to it changes the default of everyone else
+		policy := DefaultSessionPolicy
+		policy.DeviceLimits = maps.Clone(DefaultSessionPolicy.DeviceLimits)
+		return &policy, nil
+	}
+	return policy, err
+}
+
+// GetSessionPolicy returns the policy that applies to the user
+func (s *service) GetSessionPolicy(userID string) (*SessionPolicy, error) {
+	ctx := context.Background()
+	var role string
+	err := s.db.QueryRowContext(ctx, "SELECT role FROM users WHERE id = $1", userID).Scan(&role)
+	if err != nil {
+		return nil, err
+	}
+	return effectiveSessionPolicy(ctx, s.db, userID, role)
+}
+
+// GetSessionPolicies returns every configured role and user policy
+func (s *service) GetSessionPolicies() ([]SessionPolicy, error) {
+	rows, err := s.db.Query(`
+		SELECT ` + sessionPolicyColumns + `
+		FROM session_policies
+		ORDER BY role NULLS LAST, created_at
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	policies := []SessionPolicy{}
+	for rows.Next() {
+		policy, err := scanSessionPolicy(rows)
+		if err != nil {
+			return nil, err
+		}
+		policies = append(policies, *policy)
+	}
+	return policies, rows.Err()
+}
+
+// UpsertSessionPolicy creates or replaces the policy of policy.Role or policy.UserId
+func (s *service) UpsertSessionPolicy(policy *SessionPolicy) (*SessionPolicy, error) {
+	deviceLimits, err := json.Marshal(policy.DeviceLimits)
+	if err != nil {
+		return nil, err
+	}
+
+	target := "(role) WHERE role IS NOT NULL"
+	if policy.UserId != "" {
+		target = "(user_id) WHERE user_id IS NOT NULL"
+	}
+
+	saved, err := scanSessionPolicy(s.db.QueryRow(`
+		INSERT INTO session_policies (role, user_id, max_sessions, on_limit, device_limits)
+		VALUES (NULLIF($1, ''), NULLIF($2, '')::uuid, NULLIF($3, 0), $4, $5)
+		ON CONFLICT `+target+` DO UPDATE
+		SET max_sessions = EXCLUDED.max_sessions,
+		    on_limit = EXCLUDED.on_limit,
+		    device_limits = EXCLUDED.device_limits
+		RETURNING `+sessionPolicyColumns,
+		policy.Role, policy.UserId, policy.MaxSessions, policy.OnLimit, deviceLimits))
+	if isPgError(err, pgForeignKeyViolation) {
+		return nil, ErrSessionPolicyTarget
+	}
+	return saved, err
+}
+
+// DeleteSessionPolicy removes a policy, it reports false when no policy has that id
+func (s *service) DeleteSessionPolicy(id string) (bool, error) {
+	res, err := s.db.Exec("DELETE FROM session_policies WHERE id = $1", id)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// StartSession enforces the session policy of the user and stores the refresh token of a new session.
+// The user row is locked for the duration of the check so that concurrent logins are counted one after the other.
+func (s *service) StartSession(userID string, familyID string, tokenHash string, expiresAt time.Time, info SessionInfo) error {
+	ctx := context.Background()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var role string
+	err = tx.QueryRowContext(ctx, "SELECT role FROM users WHERE id = $1 FOR UPDATE", userID).Scan(&role)
+	if err != nil {
+		return err
+	}
+
+	policy, err := effectiveSessionPolicy(ctx, tx, userID, role)
+	if err != nil {
+		return err
+	}
+
+	// Active sessions, oldest login first
+	rows, err := tx.QueryContext(ctx, `
+		SELECT r.family_id, COALESCE(r.device_type, '')
+		FROM tokens r
+		JOIN (
+			SELECT family_id, MIN(created_at) AS created_at
+			FROM tokens
+			WHERE user_id = $1
+			GROUP BY family_id
+		) f ON f.family_id = r.family_id
+		WHERE r.user_id = $1 AND r.token_type = 'REFRESH' AND r.is_valid = TRUE AND r.expires_at > NOW()
+		ORDER BY f.created_at ASC
+	`, userID)
+	if err != nil {
+		return err
+	}
+	type activeSession struct{ familyID, deviceType string }
+	var active []activeSession
+	for rows.Next() {
+		var session activeSession
+		if err := rows.Scan(&session.familyID, &session.deviceType); err != nil {
+			rows.Close()
+			return err
+		}
+		active = append(active, session)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	var evict []string
+	evicted := map[string]bool{}
+
+	if limit := policy.DeviceLimits[info.DeviceType]; limit > 0 {
+		var sameDevice []string
+		for _, session := range active {
+			if session.deviceType == info.DeviceType {
+				sameDevice = append(sameDevice, session.familyID)
+			}
+		}
+		if over := len(sameDevice) - limit + 1; over > 0 {
+			if policy.OnLimit == OnLimitRejectNew {
+				return ErrSessionLimitReached
+			}
+			for _, familyID := range sameDevice[:over] {
+				evict = append(evict, familyID)
+				evicted[familyID] = true
+			}
+		}
+	}
+
+	if policy.MaxSessions > 0 {
+		var remaining []string
+		for _, session := range active {
+			if !evicted[session.familyID] {
+				remaining = append(remaining, session.familyID)
+			}
+		}
+		if over := len(remaining) - policy.MaxSessions + 1; over > 0 {
+			if policy.OnLimit == OnLimitRejectNew {
+				return ErrSessionLimitReached
+			}
+			evict = append(evict, remaining[:over]...)
+		}
+	}
+
+	for _, familyID := range evict {
+		_, err = tx.ExecContext(ctx, "UPDATE tokens SET is_valid = FALSE WHERE family_id = $1", familyID)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO tokens (user_id, family_id, token, expires_at, token_type, ip_address, user_agent, device_type)
+		VALUES ($1, $2, $3, $4, 'REFRESH', $5, $6, $7)
+	`, userID, familyID, tokenHash, expiresAt, info.IpAddress, info.UserAgent, info.DeviceType)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
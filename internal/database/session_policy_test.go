@@ -0,0 +1,162 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// activeFamilies returns the token families of the user that still have a valid refresh token
+func activeFamilies(t *testing.T, s *service, userID string) map[string]bool {
+	t.Helper()
+	sessions, err := s.GetSessions(userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	families := map[string]bool{}
+	for _, session := range sessions {
+		families[session.Id] = true
+	}
+	return families
+}
+
+func TestGetSessionPolicyDefaultIsCopy(t *testing.T) {
+	s := newTestService(t, tokenMigrations...)
+	userID := insertTestUser(t, s, "jane@example.com", "$2a$10$hash")
+	if _, err := s.db.Exec("DELETE FROM session_policies"); err != nil {
+		t.Fatal(err)
+	}
+
+	policy, err := s.GetSessionPolicy(userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy.MaxSessions = 99
+	policy.DeviceLimits["mobile"] = 1
+
+	if DefaultSessionPolicy.MaxSessions != 2 || len(DefaultSessionPolicy.DeviceLimits) != 0 {
+		t.Errorf("expected the default policy to stay unchanged, got %+v", DefaultSessionPolicy)
+	}
+}
+
+func TestUpsertSessionPolicyUnknownUser(t *testing.T) {
+	s := newTestService(t, tokenMigrations...)
+
+	_, err := s.UpsertSessionPolicy(&SessionPolicy{UserId: "00000000-0000-0000-0000-000000000001", MaxSessions: 1, OnLimit: OnLimitRejectNew, DeviceLimits: map[string]int{}})
+	if !errors.Is(err, ErrSessionPolicyTarget) {
+		t.Errorf("expected ErrSessionPolicyTarget for an unknown user, got %v", err)
+	}
+}
+
+func TestStartSessionLimit(t *testing.T) {
+	tests := []struct {
+		onLimit     string
+		wantErr     error
+		wantFirst   bool
+		wantSession bool
+	}{
+		{OnLimitEvictOldest, nil, false, true},
+		{OnLimitRejectNew, ErrSessionLimitReached, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.onLimit, func(t *testing.T) {
+			s := newTestService(t, tokenMigrations...)
+			userID := insertTestUser(t, s, "jane@example.com", "$2a$10$hash")
+			if _, err := s.UpsertSessionPolicy(&SessionPolicy{UserId: userID, MaxSessions: 2, OnLimit: tt.onLimit, DeviceLimits: map[string]int{}}); err != nil {
+				t.Fatal(err)
+			}
+			expiresAt := time.Now().Add(time.Hour)
+
+			first := startTestSession(t, s, userID, "refresh-1", expiresAt, "desktop")
+			second := startTestSession(t, s, userID, "refresh-2", expiresAt, "desktop")
+			err := s.StartSession(userID, "00000000-0000-0000-0000-000000000003", "refresh-3", expiresAt, SessionInfo{DeviceType: "desktop"})
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("expected error %v, got %v", tt.wantErr, err)
+			}
+
+			active := activeFamilies(t, s, userID)
+			if active[first] != tt.wantFirst || !active[second] || active["00000000-0000-0000-0000-000000000003"] != tt.wantSession {
+				t.Errorf("unexpected active sessions %v", active)
+			}
+			if len(active) != 2 {
+				t.Errorf("expected the limit of 2 sessions to hold, got %d", len(active))
+			}
+		})
+	}
+}
+
+func TestStartSessionDeviceLimit(t *testing.T) {
+	s := newTestService(t, tokenMigrations...)
+	userID := insertTestUser(t, s, "jane@example.com", "$2a$10$hash")
+	if _, err := s.UpsertSessionPolicy(&SessionPolicy{UserId: userID, OnLimit: OnLimitEvictOldest, DeviceLimits: map[string]int{"mobile": 1}}); err != nil {
+		t.Fatal(err)
+	}
+	expiresAt := time.Now().Add(time.Hour)
+
+	phone := startTestSession(t, s, userID, "refresh-1", expiresAt, "mobile")
+	laptop := startTestSession(t, s, userID, "refresh-2", expiresAt, "desktop")
+	desktop := startTestSession(t, s, userID, "refresh-3", expiresAt, "desktop")
+	newPhone := startTestSession(t, s, userID, "refresh-4", expiresAt, "mobile")
+
+	// Only the other mobile session makes room, devices without a limit are not counted
+	active := activeFamilies(t, s, userID)
+	if active[phone] || !active[laptop] || !active[desktop] || !active[newPhone] {
+		t.Errorf("expected only the first mobile session to be evicted, got %v", active)
+	}
+
+	if _, err := s.UpsertSessionPolicy(&SessionPolicy{UserId: userID, OnLimit: OnLimitRejectNew, DeviceLimits: map[string]int{"mobile": 1}}); err != nil {
+		t.Fatal(err)
+	}
+	err := s.StartSession(userID, "00000000-0000-0000-0000-000000000005", "refresh-5", expiresAt, SessionInfo{DeviceType: "mobile"})
+	if !errors.Is(err, ErrSessionLimitReached) {
+		t.Errorf("expected ErrSessionLimitReached for a second mobile session, got %v", err)
+	}
+	startTestSession(t, s, userID, "refresh-6", expiresAt, "tablet")
+}
+
+func TestStartSessionConcurrent(t *testing.T) {
+	s := newTestService(t, tokenMigrations...)
+	userID := insertTestUser(t, s, "jane@example.com", "$2a$10$hash")
+	const limit = 2
+	if _, err := s.UpsertSessionPolicy(&SessionPolicy{UserId: userID, MaxSessions: limit, OnLimit: OnLimitRejectNew, DeviceLimits: map[string]int{}}); err != nil {
+		t.Fatal(err)
+	}
+	expiresAt := time.Now().Add(time.Hour)
+
+	// Logins at the same time are counted one after the other, only limit of them get a session
+	const logins = 10
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		started  int
+		rejected int
+	)
+	for i := 0; i < logins; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			familyID := fmt.Sprintf("00000000-0000-0000-0000-%012d", i)
+			err := s.StartSession(userID, familyID, fmt.Sprintf("refresh-%d", i), expiresAt, SessionInfo{})
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case err == nil:
+				started++
+			case errors.Is(err, ErrSessionLimitReached):
+				rejected++
+			default:
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if started != limit || rejected != logins-limit {
+		t.Errorf("expected %d sessions started and %d rejected, got %d and %d", limit, logins-limit, started, rejected)
+	}
+	if active := activeFamilies(t, s, userID); len(active) != limit {
+		t.Errorf("expected %d active sessions, got %d", limit, len(active))
+	}
+}
@@ -0,0 +1,118 @@
+package database
+
+import (
+	"database/sql"
+	"time"
+)
+
+// SessionInfo describes the client a session was created from
+type SessionInfo struct {
+	IpAddress  string
+	UserAgent  string
+	DeviceType string
+}
+
+// Session is a login of a user, i.e. a token family with a live refresh token.
+// Its id is the family id, which is also carried in the sid claim of access tokens.
+type Session struct {
+	Id              string    `json:"id"`
+	IpAddress       string    `json:"ip_address"`
+	UserAgent       string    `json:"user_agent"`
+	DeviceType      string    `json:"device_type"`
+	Current         bool      `json:"current"`
+	CreatedAt       time.Time `json:"created_at"`
+	LastRefreshedAt time.Time `json:"last_refreshed_at"`
+	ExpiresAt       time.Time `json:"expires_at"`
+}
+
+// GetSessions returns the active sessions of a user, newest first
+func (s *service) GetSessions(userID string) ([]Session, error) {
+	rows, err := s.db.Query(`
+		SELECT r.family_id, r.ip_address, r.user_agent, r.device_type, f.created_at, r.created_at, r.expires_at
+		FROM tokens r
+		JOIN (
+			SELECT family_id, MIN(created_at) AS created_at
+			FROM tokens
+			WHERE user_id = $1
+			GROUP BY family_id
+		) f ON f.family_id = r.family_id
+		WHERE r.user_id = $1 AND r.token_type = 'REFRESH' AND r.is_valid = TRUE AND r.expires_at > NOW()
+		ORDER BY f.created_at DESC
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []Session{}
+	for rows.Next() {
+		var (
+			session    Session
+			ipAddress  sql.NullString
+			userAgent  sql.NullString
+			deviceType sql.NullString
+		)
+		if err := rows.Scan(&session.Id, &ipAddress, &userAgent, &deviceType, &session.CreatedAt, &session.LastRefreshedAt, &session.ExpiresAt); err != nil {
+			return nil, err
+		}
+		session.IpAddress = ipAddress.String
+		session.UserAgent = userAgent.String
+		session.DeviceType = deviceType.String
+		sessions = append(sessions, session)
+	}
+	return sessions, rows.Err()
+}
+
+// RevokeSession invalidates every token of one session of the user.
+// It reports false when the user has no active session with that id.
+func (s *service) RevokeSession(userID string, sessionID string) (bool, error) {
+	res, err := s.db.Exec(`
+		UPDATE tokens
+		SET is_valid = FALSE
+		WHERE user_id = $1 AND family_id = $2 AND is_valid = TRUE
+	`, userID, sessionID)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// EndSession invalidates the access and refresh tokens of a session, or with everywhere every session
+// of its user. It returns the user the session belongs to, empty for an unknown session, and the
+// number of sessions that were still active.
+func (s *service) EndSession(sessionID string, everywhere bool) (string, int, error) {
+	var (
+		userID sql.NullString
+		count  int
+	)
+	err := s.db.QueryRow(`
+		WITH session AS (
+			SELECT user_id FROM tokens WHERE family_id = $1 LIMIT 1
+		), revoked AS (
+			UPDATE tokens
+			SET is_valid = FALSE
+			WHERE is_valid = TRUE
+			  AND (family_id = $1 OR ($2 AND user_id = (SELECT user_id FROM session)))
+			RETURNING family_id
+		)
+		SELECT (SELECT user_id FROM session), (SELECT COUNT(DISTINCT family_id) FROM revoked)
+	`, sessionID, everywhere).Scan(&userID, &count)
+	return userID.String, count, err
+}
+
+// RevokeOtherSessions invalidates every session of the user except the current one
+// and returns the number of sessions revoked
+func (s *service) RevokeOtherSessions(userID string, currentSessionID string) (int, error) {
+	var count int
+	err := s.db.QueryRow(`
+		WITH revoked AS (
+			UPDATE tokens
+			SET is_valid = FALSE
+			WHERE user_id = $1 AND is_valid = TRUE AND family_id IS DISTINCT FROM NULLIF($2, '')::uuid
+			RETURNING family_id
+		)
+		SELECT COUNT(DISTINCT family_id) FROM revoked
+	`, userID, currentSessionID).Scan(&count)
+	return count, err
+}
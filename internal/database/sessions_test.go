@@ -0,0 +1,43 @@
+package database
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRevokeSessions(t *testing.T) {
+	s := newTestService(t, tokenMigrations...)
+	jane := insertTestUser(t, s, "jane@example.com", "$2a$10$hash")
+	joe := insertTestUser(t, s, "joe@example.com", "$2a$10$hash")
+	expiresAt := time.Now().Add(time.Hour)
+
+	current := startTestSession(t, s, jane, "jane-1", expiresAt, "")
+	other := startTestSession(t, s, jane, "jane-2", expiresAt, "")
+	joeSession := startTestSession(t, s, joe, "joe-1", expiresAt, "")
+
+	// A session id of another user is not found, and the session stays
+	if found, err := s.RevokeSession(jane, joeSession); err != nil || found {
+		t.Errorf("expected the session of another user not to be found, got %t (%v)", found, err)
+	}
+	if sessions, err := s.GetSessions(joe); err != nil || len(sessions) != 1 {
+		t.Errorf("expected the session of another user to stay, got %d (%v)", len(sessions), err)
+	}
+
+	count, err := s.RevokeOtherSessions(jane, current)
+	if err != nil || count != 1 {
+		t.Fatalf("expected one other session revoked, got %d (%v)", count, err)
+	}
+	sessions, err := s.GetSessions(jane)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 1 || sessions[0].Id != current {
+		t.Errorf("expected only the current session %s to stay, got %+v", current, sessions)
+	}
+	if found, err := s.RevokeSession(jane, other); err != nil || found {
+		t.Errorf("expected the revoked session not to be found again, got %t (%v)", found, err)
+	}
+	if sessions, err := s.GetSessions(joe); err != nil || len(sessions) != 1 {
+		t.Errorf("expected the sessions of other users to stay, got %d (%v)", len(sessions), err)
+	}
+}
@@ -1,23 +1,157 @@
 package database
 
 import (
+	"context"
+	"database/sql"
+	"errors"
 	"time"
 )
 
-// InsertToken stores a token in the database for the user
-func (s *service) InsertToken(userID string, token string, expiresAt time.Time) error {
-	_, err := s.db.Exec("INSERT INTO tokens (user_id, token, expires_at) VALUES ($1, $2, $3)", userID, token, expiresAt)
+var (
+	// ErrRefreshTokenInvalid is returned when a refresh token is unknown, expired or revoked.
+	ErrRefreshTokenInvalid = errors.New("invalid or expired refresh token")
+	// ErrRefreshTokenReused is returned when a refresh token that was already rotated is presented again.
+	// The whole token family is revoked before it is returned.
+	ErrRefreshTokenReused = errors.New("refresh token reused")
+)
+
+// RefreshToken is a refresh token row. The token itself is never stored, only its digest.
+type RefreshToken struct {
+	Id        string    `json:"id"`
+	UserId    string    `json:"user_id"`
+	FamilyId  string    `json:"family_id"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// AccessToken is an access token to record, see RotateRefreshToken
+type AccessToken struct {
+	Jti       string
+	TokenHash string
+	ExpiresAt time.Time
+}
+
+// InsertToken records an access token of the user under its jti claim. The token itself is never stored, only its digest.
+func (s *service) InsertToken(userID string, familyID string, jti string, tokenHash string, expiresAt time.Time) error {
+	_, err := s.db.Exec(
+		"INSERT INTO tokens (user_id, family_id, jti, token, expires_at) VALUES ($1, $2, $3, $4, $5)",
+		userID, familyID, jti, tokenHash, expiresAt,
+	)
+	return err
+}
+
+// RotateRefreshToken exchanges a refresh token for a new one in the same family.
+// The old token is marked as replaced and the access tokens of the family are invalidated.
+// issue is called with the user and family to sign the new access token, which is recorded in the same
+// transaction: the old refresh token is only spent once the client can get both new tokens.
+// Presenting a token that was already replaced revokes the whole family and returns ErrRefreshTokenReused.
+func (s *service) RotateRefreshToken(tokenHash string, newTokenHash string, expiresAt time.Time, issue func(userID string, familyID string) (*AccessToken, error)) (*RefreshToken, error) {
+	ctx := context.Background()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var (
+		old        RefreshToken
+		isValid    bool
+		replacedBy sql.NullString
+	)
+	err = tx.QueryRowContext(ctx, `
+		SELECT id, user_id, family_id, expires_at, is_valid, replaced_by
+		FROM tokens
+		WHERE token = $1 AND token_type = 'REFRESH'
+		FOR UPDATE
+	`, tokenHash).Scan(&old.Id, &old.UserId, &old.FamilyId, &old.ExpiresAt, &isValid, &replacedBy)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrRefreshTokenInvalid
+		}
+		return nil, err
+	}
+
+	if !isValid {
+		if !replacedBy.Valid {
+			return nil, ErrRefreshTokenInvalid
+		}
+		// The token was already rotated, someone is replaying it
+		_, err = tx.ExecContext(ctx, "UPDATE tokens SET is_valid = FALSE WHERE family_id = $1", old.FamilyId)
+		if err != nil {
+			return nil, err
+		}
+		if err = tx.Commit(); err != nil {
+			return nil, err
+		}
+		return nil, ErrRefreshTokenReused
+	}
+
+	if old.ExpiresAt.Before(time.Now()) {
+		return nil, ErrRefreshTokenInvalid
+	}
+
+	rotated := RefreshToken{UserId: old.UserId, FamilyId: old.FamilyId, ExpiresAt: expiresAt}
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO tokens (user_id, family_id, token, expires_at, token_type, ip_address, user_agent, device_type)
+		SELECT user_id, family_id, $2, $3, 'REFRESH', ip_address, user_agent, device_type
+		FROM tokens
+		WHERE id = $1
+		RETURNING id
+	`, old.Id, newTokenHash, expiresAt).Scan(&rotated.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.ExecContext(ctx, "UPDATE tokens SET is_valid = FALSE, replaced_by = $1 WHERE id = $2", rotated.Id, old.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		UPDATE tokens
+		SET is_valid = FALSE
+		WHERE family_id = $1 AND token_type = 'ACCESS' AND is_valid = TRUE
+	`, old.FamilyId)
+	if err != nil {
+		return nil, err
+	}
+
+	access, err := issue(old.UserId, old.FamilyId)
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.ExecContext(ctx,
+		"INSERT INTO tokens (user_id, family_id, jti, token, expires_at) VALUES ($1, $2, $3, $4, $5)",
+		old.UserId, old.FamilyId, access.Jti, access.TokenHash, access.ExpiresAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	return &rotated, nil
+}
+
+// RevokeTokenFamily invalidates every access and refresh token issued for a login
+func (s *service) RevokeTokenFamily(familyID string) error {
+	_, err := s.db.Exec("UPDATE tokens SET is_valid = FALSE WHERE family_id = $1", familyID)
 	return err
 }
 
-// InvalidateOldestToken invalidates the oldest token if the user has more than 2 valid tokens
+// InvalidateOldestToken invalidates the oldest session of the user, including its refresh token
 func (s *service) InvalidateOldestToken(userID string) error {
 	_, err := s.db.Exec(`
 		UPDATE tokens
 		SET is_valid = FALSE
 		WHERE id = (
 			SELECT id FROM tokens
-			WHERE user_id = $1 AND is_valid = TRUE
+			WHERE user_id = $1 AND is_valid = TRUE AND token_type = 'ACCESS'
+			ORDER BY created_at ASC
+			LIMIT 1
+		) OR family_id = (
+			SELECT family_id FROM tokens
+			WHERE user_id = $1 AND is_valid = TRUE AND token_type = 'ACCESS'
 			ORDER BY created_at ASC
 			LIMIT 1
 		)
@@ -26,26 +160,76 @@ func (s *service) InvalidateOldestToken(userID string) error {
 	return err
 }
 
-// InvalidateOldestToken invalidates the oldest token if the user has more than 2 valid tokens
-func (s *service) InvalidateToken(token string) error {
+// InvalidateToken invalidates the access token with the given jti together with the rest of its family
+func (s *service) InvalidateToken(jti string) error {
 	_, err := s.db.Exec(`
 		UPDATE tokens
 		SET is_valid = FALSE
-		WHERE token=$1
-	`, token)
+		WHERE jti = $1 OR family_id = (
+			SELECT family_id FROM tokens WHERE jti = $1 AND token_type = 'ACCESS'
+		)
+	`, jti)
 	return err
 }
 
-// GetValidTokenCount returns the number of valid tokens for a user
+// GetValidTokenCount returns the number of valid access tokens for a user
 func (s *service) GetValidTokenCount(userID string) (int, error) {
 	var count int
-	err := s.db.QueryRow("SELECT COUNT(*) FROM tokens WHERE user_id = $1 AND is_valid = TRUE", userID).Scan(&count)
+	err := s.db.QueryRow("SELECT COUNT(*) FROM tokens WHERE user_id = $1 AND is_valid = TRUE AND token_type = 'ACCESS'", userID).Scan(&count)
 	return count, err
 }
 
-func (s *service) IsTokenValid(token string) (bool, error) {
+// IsTokenValid reports whether the access token with the given jti is neither revoked nor expired
+func (s *service) IsTokenValid(jti string) (bool, error) {
 	var valid bool
-	//err := s.db.QueryRow("SELECT EXISTS(SELECT is_valid FROM tokens WHERE token = $1 AND expires_at > NOW())", token).Scan(&valid)
-	err := s.db.QueryRow("SELECT EXISTS(SELECT 1 FROM tokens WHERE token = $1 AND is_valid=true)", token).Scan(&valid)
+	err := s.db.QueryRow(`
+		SELECT EXISTS (
+			SELECT 1 FROM tokens
+			WHERE jti = $1 AND is_valid = TRUE AND token_type = 'ACCESS' AND expires_at > NOW()
+		)
+	`, jti).Scan(&valid)
 	return valid, err
 }
+
+// tokenJanitorLock is the advisory lock key held while purging tokens, so that only one replica purges at a time
+const tokenJanitorLock int64 = 0x746f6b656e73 // "tokens"
+
+// PurgeTokens deletes tokens that expired before the given time, and revoked tokens that were invalidated before it.
+// Refresh tokens replaced by a rotation are kept until they expire so that replaying them is still detected.
+// It reports false without deleting anything when another replica holds the lock.
+func (s *service) PurgeTokens(ctx context.Context, before time.Time) (int64, bool, error) {
+	return s.purgeLocked(ctx, tokenJanitorLock, `
+		DELETE FROM tokens
+		WHERE expires_at < $1
+		   OR (is_valid = FALSE AND replaced_by IS NULL AND updated_at < $1)
+	`, before)
+}
+
+// purgeLocked runs a delete statement while holding a transaction level advisory lock,
+// it reports false without running it when the lock is held elsewhere
+func (s *service) purgeLocked(ctx context.Context, lock int64, query string, args ...any) (int64, bool, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, false, err
+	}
+	defer tx.Rollback()
+
+	// The lock is released when the transaction ends
+	var locked bool
+	if err := tx.QueryRowContext(ctx, "SELECT pg_try_advisory_xact_lock($1)", lock).Scan(&locked); err != nil {
+		return 0, false, err
+	}
+	if !locked {
+		return 0, false, nil
+	}
+
+	res, err := tx.ExecContext(ctx, query, args...)
+	if err != nil {
+		return 0, true, err
+	}
+	deleted, err := res.RowsAffected()
+	if err != nil {
+		return 0, true, err
+	}
+	return deleted, true, tx.Commit()
+}
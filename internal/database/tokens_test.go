@@ -0,0 +1,109 @@
+package database
+
+import (
+	"errors"
+	"github.com/google/uuid"
+	"testing"
+	"time"
+)
+
+// tokenMigrations create the tokens table with refresh tokens and session policies
+var tokenMigrations = []string{
+	"users/create_users_table",
+	"tokens/create_tokens_table",
+	"tokens/add_refresh_tokens",
+	"tokens/add_access_token_jti",
+	"tokens/add_session_details",
+	"session_policies/create_session_policies",
+}
+
+// issueTestToken hands RotateRefreshToken a new access token with a random jti
+func issueTestToken(userID string, familyID string) (*AccessToken, error) {
+	jti := uuid.NewString()
+	return &AccessToken{Jti: jti, TokenHash: "access-" + jti, ExpiresAt: time.Now().Add(time.Minute)}, nil
+}
+
+// startTestSession logs the user in with the refresh token digest and returns the token family
+func startTestSession(t *testing.T, s *service, userID string, tokenHash string, expiresAt time.Time, deviceType string) string {
+	t.Helper()
+	familyID := uuid.NewString()
+	if err := s.StartSession(userID, familyID, tokenHash, expiresAt, SessionInfo{DeviceType: deviceType}); err != nil {
+		t.Fatal(err)
+	}
+	return familyID
+}
+
+func TestRotateRefreshToken(t *testing.T) {
+	s := newTestService(t, tokenMigrations...)
+	userID := insertTestUser(t, s, "jane@example.com", "$2a$10$hash")
+	expiresAt := time.Now().Add(time.Hour)
+
+	familyID := startTestSession(t, s, userID, "refresh-1", expiresAt, "")
+	jti := uuid.NewString()
+	if err := s.InsertToken(userID, familyID, jti, "access-1", expiresAt); err != nil {
+		t.Fatal(err)
+	}
+
+	// An access token that cannot be recorded leaves the refresh token unspent
+	failed := errors.New("signing failed")
+	if _, err := s.RotateRefreshToken("refresh-1", "refresh-2", expiresAt, func(string, string) (*AccessToken, error) {
+		return nil, failed
+	}); !errors.Is(err, failed) {
+		t.Fatalf("expected the signing error, got %v", err)
+	}
+
+	var issued *AccessToken
+	rotated, err := s.RotateRefreshToken("refresh-1", "refresh-2", expiresAt, func(userID string, familyID string) (*AccessToken, error) {
+		access, err := issueTestToken(userID, familyID)
+		issued = access
+		return access, err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if valid, err := s.IsTokenValid(issued.Jti); err != nil || !valid {
+		t.Errorf("expected the new access token to be recorded, got %t (%v)", valid, err)
+	}
+	if rotated.UserId != userID || rotated.FamilyId != familyID {
+		t.Errorf("expected the rotated token to stay in family %s of %s, got %+v", familyID, userID, rotated)
+	}
+	if valid, err := s.IsTokenValid(jti); err != nil || valid {
+		t.Errorf("expected the access token of the family to be invalidated, got %t (%v)", valid, err)
+	}
+
+	// The rotated token is spent: presenting it again is a replay that ends the whole family
+	if _, err := s.RotateRefreshToken("refresh-1", "refresh-3", expiresAt, issueTestToken); !errors.Is(err, ErrRefreshTokenReused) {
+		t.Fatalf("expected ErrRefreshTokenReused, got %v", err)
+	}
+	if _, err := s.RotateRefreshToken("refresh-2", "refresh-4", expiresAt, issueTestToken); !errors.Is(err, ErrRefreshTokenInvalid) {
+		t.Errorf("expected the replacement to be revoked with the family, got %v", err)
+	}
+	var valid int
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM tokens WHERE family_id = $1 AND is_valid", familyID).Scan(&valid); err != nil || valid != 0 {
+		t.Errorf("expected no valid token left in the family, got %d (%v)", valid, err)
+	}
+
+	// Another login of the user is not affected
+	startTestSession(t, s, userID, "refresh-other", expiresAt, "")
+	if _, err := s.RotateRefreshToken("refresh-other", "refresh-other-2", expiresAt, issueTestToken); err != nil {
+		t.Errorf("expected the other session to rotate, got %v", err)
+	}
+
+	if _, err := s.RotateRefreshToken("unknown", "refresh-5", expiresAt, issueTestToken); !errors.Is(err, ErrRefreshTokenInvalid) {
+		t.Errorf("expected ErrRefreshTokenInvalid for an unknown token, got %v", err)
+	}
+}
+
+func TestRotateRefreshTokenExpired(t *testing.T) {
+	s := newTestService(t, tokenMigrations...)
+	userID := insertTestUser(t, s, "jane@example.com", "$2a$10$hash")
+
+	startTestSession(t, s, userID, "refresh-1", time.Now().Add(-time.Minute), "")
+	if _, err := s.RotateRefreshToken("refresh-1", "refresh-2", time.Now().Add(time.Hour), issueTestToken); !errors.Is(err, ErrRefreshTokenInvalid) {
+		t.Fatalf("expected ErrRefreshTokenInvalid for an expired token, got %v", err)
+	}
+	var exists bool
+	if err := s.db.QueryRow("SELECT EXISTS (SELECT 1 FROM tokens WHERE token = 'refresh-2')").Scan(&exists); err != nil || exists {
+		t.Errorf("expected no replacement for an expired token, got %t (%v)", exists, err)
+	}
+}
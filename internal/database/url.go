@@ -5,12 +5,16 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"time"
 )
 
 type Url struct {
 	Id      string `json:"id"`
 	Key     string `json:"key"`
 	LongUrl string `json:"longUrl"`
+	// UserId is the owner of URLs shortened while logged in
+	UserId    string     `json:"-"`
+	CreatedAt *time.Time `json:"createdAt,omitempty"`
 }
 
 func (s *service) GetUrlByKey(urlKey string) (*Url, error) {
@@ -33,7 +37,31 @@ func (s *service) GetUrlByKey(urlKey string) (*Url, error) {
 
 // AddShortenedUrl - Add shortened url into the database.
 func (s *service) AddShortenedUrl(urlResp *Url) error {
-	_, err := s.db.ExecContext(context.Background(), "INSERT INTO urls (url_key,long_url) VALUES ($1, $2)",
-		urlResp.Key, urlResp.LongUrl)
+	_, err := s.db.ExecContext(context.Background(), "INSERT INTO urls (url_key,long_url,user_id) VALUES ($1, $2, $3)",
+		urlResp.Key, urlResp.LongUrl, nullString(urlResp.UserId))
 	return err
 }
+
+// GetUrlsByUser lists the URLs the user shortened while logged in, newest first
+func (s *service) GetUrlsByUser(userId string) ([]Url, error) {
+	rows, err := s.db.Query(`
+		SELECT id, url_key, long_url, created_at
+		FROM urls
+		WHERE user_id = $1
+		ORDER BY created_at DESC`, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	urls := []Url{}
+	for rows.Next() {
+		var u Url
+		if err := rows.Scan(&u.Id, &u.Key, &u.LongUrl, &u.CreatedAt); err != nil {
+			return nil, err
+		}
+		u.UserId = userId
+		urls = append(urls, u)
+	}
+	return urls, rows.Err()
+}
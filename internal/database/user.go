@@ -1,23 +1,55 @@
 package database
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"time"
 )
 
+var (
+	// ErrEmailAlreadyVerified is returned when asking to verify an address that is already verified
+	ErrEmailAlreadyVerified = errors.New("email is already verified")
+	// ErrVerificationThrottled is returned when a verification email was sent too recently
+	ErrVerificationThrottled = errors.New("a verification email was sent recently, please try again later")
+	// ErrUsernameUnchanged is returned when renaming a user to their current username
+	ErrUsernameUnchanged = errors.New("this is already your username")
+)
+
+// Roles of the users table
+const (
+	RoleUser  = "USER"
+	RoleAdmin = "ADMIN"
+)
+
+// UserUpdate holds the profile fields to change, nil fields are left as they are
+type UserUpdate struct {
+	Username *string
+	FullName *string
+	// UserImage removes the image when empty
+	UserImage *string
+}
+
 type User struct {
-	Id        string    `json:"id"`
-	Username  string    `json:"username"`
-	FullName  string    `json:"full_name"`
-	UserImage string    `json:"user_image"`
-	Role      string    `json:"role"`
-	CreatedAt time.Time `json:"created_at"`
-	UpdatedAt time.Time `json:"updated_at"`
+	Id              string     `json:"id"`
+	Username        string     `json:"username"`
+	FullName        string     `json:"full_name"`
+	UserImage       string     `json:"user_image"`
+	Role            string     `json:"role"`
+	EmailVerifiedAt *time.Time `json:"email_verified_at"`
+	// DeletionScheduledAt is when the account will be deleted, logging in again before cancels it
+	DeletionScheduledAt *time.Time `json:"deletion_scheduled_at,omitempty"`
+	CreatedAt           time.Time  `json:"created_at"`
+	UpdatedAt           time.Time  `json:"updated_at"`
 }
 
+// CountUser counts the users and active reservations holding username, it is 0 when the name is available
 func (s *service) CountUser(username string) (int, error) {
 	var count int
-	query := `SELECT COUNT(*) FROM users WHERE username = $1`
+	query := `
+		SELECT (SELECT COUNT(*) FROM users WHERE username = $1)
+		     + (SELECT COUNT(*) FROM username_reservations WHERE username = $1 AND reserved_until > NOW())
+	`
 	err := s.db.QueryRow(query, username).Scan(&count)
 	return count, err
 }
@@ -25,9 +57,9 @@ func (s *service) CountUser(username string) (int, error) {
 func (s *service) InsertUserByUsernameAndPassword(username, hashedPassword string) (string, error) {
 	// Insert the new user into the database
 	fullName := username
-	role := "USER"
+	role := RoleUser
 	var userID string
-	err := s.db.QueryRow("INSERT INTO users (username, password, fullname, role) VALUES ($1, $2, $3, $4) RETURNING id", username, hashedPassword, fullName, role).Scan(&userID)
+	err := s.db.QueryRow("INSERT INTO users (username, password, fullname, role, password_unverified) VALUES ($1, $2, $3, $4, TRUE) RETURNING id", username, hashedPassword, fullName, role).Scan(&userID)
 	if err != nil {
 		return "", err
 	}
@@ -61,13 +93,247 @@ func (s *service) GetHashedPassword(username string) (string, string, error) {
 func (s *service) GetUserById(userId string) (*User, error) {
 	var user User
 	var userImage sql.NullString
-	err := s.db.QueryRow("SELECT id, username, fullname,userimage, role,created_at,updated_at FROM users WHERE id = $1", userId).Scan(&user.Id, &user.Username, &user.FullName, &userImage, &user.Role, &user.CreatedAt, &user.UpdatedAt)
+	var emailVerifiedAt, deletionScheduledAt sql.NullTime
+	err := s.db.QueryRow("SELECT id, username, fullname,userimage, role,email_verified_at,deletion_scheduled_at,created_at,updated_at FROM users WHERE id = $1", userId).Scan(&user.Id, &user.Username, &user.FullName, &userImage, &user.Role, &emailVerifiedAt, &deletionScheduledAt, &user.CreatedAt, &user.UpdatedAt)
 	if err != nil {
 		return nil, err
 	}
 	if userImage.Valid {
 		user.UserImage = userImage.String
 	}
+	if emailVerifiedAt.Valid {
+		user.EmailVerifiedAt = &emailVerifiedAt.Time
+	}
+	if deletionScheduledAt.Valid {
+		user.DeletionScheduledAt = &deletionScheduledAt.Time
+	}
 
 	return &user, nil
 }
+
+// MarkEmailVerified records that the user owns the address, as long as it is still the username.
+// It reports false when the user does not exist or changed username since.
+func (s *service) MarkEmailVerified(userId, email string) (bool, error) {
+	res, err := s.db.Exec(
+		"UPDATE users SET email_verified_at = COALESCE(email_verified_at, NOW()), password_unverified = FALSE WHERE id = $1 AND username = $2",
+		userId, email,
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// IsEmailVerified reports whether the user verified their email address
+func (s *service) IsEmailVerified(userId string) (bool, error) {
+	var verified bool
+	err := s.db.QueryRow("SELECT email_verified_at IS NOT NULL FROM users WHERE id = $1", userId).Scan(&verified)
+	return verified, err
+}
+
+// MarkVerificationEmailSent records that a verification email is about to be sent and returns the address to send it to.
+// It fails with ErrVerificationThrottled when the previous email was sent less than minInterval ago.
+func (s *service) MarkVerificationEmailSent(userId string, minInterval time.Duration) (string, error) {
+	var email string
+	err := s.db.QueryRow(`
+		UPDATE users
+		SET email_verification_sent_at = NOW()
+		WHERE id = $1 AND email_verified_at IS NULL
+		  AND (email_verification_sent_at IS NULL OR email_verification_sent_at < NOW() - make_interval(secs => $2))
+		RETURNING username
+	`, userId, minInterval.Seconds()).Scan(&email)
+	if err == nil {
+		return email, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return "", err
+	}
+
+	verified, err := s.IsEmailVerified(userId)
+	if err != nil {
+		return "", err
+	}
+	if verified {
+		return "", ErrEmailAlreadyVerified
+	}
+	return "", ErrVerificationThrottled
+}
+
+// UpdateUser changes the profile of the user in one transaction, either every field is changed or none.
+// It reports whether the username changed, a username equal to the current one is left alone.
+func (s *service) UpdateUser(userId string, update *UserUpdate, reservation time.Duration) (bool, error) {
+	ctx := context.Background()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	renamed := false
+	if update.Username != nil {
+		err = changeUsername(ctx, tx, userId, *update.Username, reservation)
+		switch {
+		case err == nil:
+			renamed = true
+		case !errors.Is(err, ErrUsernameUnchanged):
+			return false, err
+		}
+	}
+
+	if update.FullName != nil || update.UserImage != nil {
+		_, err = tx.ExecContext(ctx, `
+			UPDATE users
+			SET fullname = COALESCE($2, fullname),
+			    userimage = CASE WHEN $3::text IS NULL THEN userimage ELSE NULLIF($3, '') END
+			WHERE id = $1
+		`, userId, update.FullName, update.UserImage)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	return renamed, tx.Commit()
+}
+
+// changeUsername renames the user and reserves the old username for them until reservation has passed.
+// Verification is tied to the username, so the new one starts out unverified.
+func changeUsername(ctx context.Context, tx *sql.Tx, userId string, username string, reservation time.Duration) error {
+	var current string
+	err := tx.QueryRowContext(ctx, "SELECT username FROM users WHERE id = $1 FOR UPDATE", userId).Scan(&current)
+	if err != nil {
+		return err
+	}
+	if current == username {
+		return ErrUsernameUnchanged
+	}
+
+	// Users may take back a name they reserved themselves
+	var taken bool
+	err = tx.QueryRowContext(ctx, `
+		SELECT EXISTS (SELECT 1 FROM users WHERE username = $1)
+		    OR EXISTS (SELECT 1 FROM username_reservations WHERE username = $1 AND user_id <> $2 AND reserved_until > NOW())
+	`, username, userId).Scan(&taken)
+	if err != nil {
+		return err
+	}
+	if taken {
+		return ErrUsernameTaken
+	}
+
+	_, err = tx.ExecContext(ctx, "DELETE FROM username_reservations WHERE username = $1", username)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO username_reservations (username, user_id, reserved_until)
+		VALUES ($1, $2, NOW() + make_interval(secs => $3))
+		ON CONFLICT (username) DO UPDATE
+		SET user_id = EXCLUDED.user_id, reserved_until = EXCLUDED.reserved_until, created_at = NOW()
+	`, current, userId, reservation.Seconds())
+	if err != nil {
+		return err
+	}
+
+	// A registration or rename committed since the check above still gets the name first
+	_, err = tx.ExecContext(ctx, `
+		UPDATE users
+		SET username = $2, email_verified_at = NULL, email_verification_sent_at = NULL
+		WHERE id = $1
+	`, userId, username)
+	if isPgError(err, pgUniqueViolation) {
+		return ErrUsernameTaken
+	}
+	return err
+}
+
+// reservationJanitorLock is the advisory lock key held while purging username reservations
+const reservationJanitorLock int64 = 0x6e616d6573 // "names"
+
+// PurgeUsernameReservations deletes the username reservations that ended before the given time.
+// It reports false without deleting anything when another replica holds the lock.
+func (s *service) PurgeUsernameReservations(ctx context.Context, before time.Time) (int64, bool, error) {
+	return s.purgeLocked(ctx, reservationJanitorLock, "DELETE FROM username_reservations WHERE reserved_until < $1", before)
+}
+
+// ChangePassword replaces the password of the user, logs out every session but the current one
+// and revokes the API keys
+func (s *service) ChangePassword(userId string, hashedPassword string, currentSessionId string) error {
+	ctx := context.Background()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, "UPDATE users SET password = $2 WHERE id = $1", userId, hashedPassword)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		UPDATE tokens
+		SET is_valid = FALSE
+		WHERE user_id = $1 AND is_valid = TRUE AND family_id IS DISTINCT FROM NULLIF($2, '')::uuid
+	`, userId, currentSessionId)
+	if err != nil {
+		return err
+	}
+
+	if err := revokeAPIKeys(ctx, tx, userId); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// userDeletionLock is the advisory lock key held while deleting accounts whose grace period ended
+const userDeletionLock int64 = 0x7573657273 // "users"
+
+// ScheduleUserDeletion marks the account for deletion at the given time. Every session and API key
+// of the user is revoked, so that only logging in again, which cancels the deletion, gives access back.
+func (s *service) ScheduleUserDeletion(userId string, at time.Time) error {
+	ctx := context.Background()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, "UPDATE users SET deletion_scheduled_at = $2 WHERE id = $1", userId, at)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, "UPDATE tokens SET is_valid = FALSE WHERE user_id = $1 AND is_valid = TRUE", userId)
+	if err != nil {
+		return err
+	}
+
+	if err := revokeAPIKeys(ctx, tx, userId); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// CancelUserDeletion clears a scheduled deletion, it reports false when none was scheduled
+func (s *service) CancelUserDeletion(userId string) (bool, error) {
+	res, err := s.db.Exec(
+		"UPDATE users SET deletion_scheduled_at = NULL WHERE id = $1 AND deletion_scheduled_at IS NOT NULL",
+		userId,
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// PurgeDeletedUsers deletes the users whose deletion was scheduled before the given time,
+// together with every row referencing them. It reports false without deleting anything
+// when another replica holds the lock.
+func (s *service) PurgeDeletedUsers(ctx context.Context, before time.Time) (int64, bool, error) {
+	return s.purgeLocked(ctx, userDeletionLock, "DELETE FROM users WHERE deletion_scheduled_at <= $1", before)
+}
@@ -0,0 +1,62 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestUpdateUserIsAtomic(t *testing.T) {
+	s := newTestService(t, "users/create_users_table", "users/add_email_verification", "users/create_username_reservations", "users/add_account_deletion")
+	// userimage predates the migrations
+	if _, err := s.db.Exec("ALTER TABLE users ADD COLUMN IF NOT EXISTS userimage TEXT"); err != nil {
+		t.Fatal(err)
+	}
+	userID := insertTestUser(t, s, "jane@example.com", "hash")
+	insertTestUser(t, s, "taken@example.com", "hash")
+
+	str := func(s string) *string { return &s }
+	_, err := s.UpdateUser(userID, &UserUpdate{Username: str("taken@example.com"), FullName: str("Mallory")}, time.Hour)
+	if !errors.Is(err, ErrUsernameTaken) {
+		t.Fatalf("expected ErrUsernameTaken, got %v", err)
+	}
+	user, err := s.GetUserById(userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.FullName != "jane@example.com" {
+		t.Errorf("expected the full name to be left alone when the rename failed, got %q", user.FullName)
+	}
+
+	renamed, err := s.UpdateUser(userID, &UserUpdate{Username: str("new@example.com"), FullName: str("Jane")}, time.Hour)
+	if err != nil || !renamed {
+		t.Fatalf("expected the rename to succeed, got %t (%v)", renamed, err)
+	}
+	if renamed, err := s.UpdateUser(userID, &UserUpdate{Username: str("new@example.com")}, time.Hour); err != nil || renamed {
+		t.Errorf("expected an unchanged username to be left alone, got %t (%v)", renamed, err)
+	}
+}
+
+func TestPurgeUsernameReservations(t *testing.T) {
+	s := newTestService(t, "users/create_users_table", "users/create_username_reservations")
+	userID := insertTestUser(t, s, "jane@example.com", "hash")
+
+	_, err := s.db.Exec(`
+		INSERT INTO username_reservations (username, user_id, reserved_until) VALUES
+			('ended@example.com', $1, NOW() - INTERVAL '1 minute'),
+			('held@example.com', $1, NOW() + INTERVAL '1 hour')
+	`, userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deleted, ok, err := s.PurgeUsernameReservations(context.Background(), time.Now())
+	if err != nil || !ok || deleted != 1 {
+		t.Fatalf("expected the ended reservation to be deleted, got %d, %t (%v)", deleted, ok, err)
+	}
+	var held bool
+	if err := s.db.QueryRow("SELECT EXISTS (SELECT 1 FROM username_reservations WHERE username = 'held@example.com')").Scan(&held); err != nil || !held {
+		t.Errorf("expected the running reservation to be kept, got %t (%v)", held, err)
+	}
+}
@@ -0,0 +1,162 @@
+package janitor
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+)
+
+// Metrics of the janitor, published on the expvar handler under "janitor".
+// The run counters count every purge, of tokens, audit events, deleted accounts, username reservations
+// and login throttles alike.
+var (
+	metrics             = expvar.NewMap("janitor")
+	runs                = new(expvar.Int)
+	skipped             = new(expvar.Int)
+	failures            = new(expvar.Int)
+	tokensDeleted       = new(expvar.Int)
+	auditEventsDeleted  = new(expvar.Int)
+	usersDeleted        = new(expvar.Int)
+	reservationsDeleted = new(expvar.Int)
+	throttlesDeleted    = new(expvar.Int)
+	lastRunAt           = new(expvar.String)
+)
+
+func init() {
+	metrics.Set("runs", runs)
+	metrics.Set("runs_skipped", skipped)
+	metrics.Set("runs_failed", failures)
+	metrics.Set("tokens_deleted", tokensDeleted)
+	metrics.Set("audit_events_deleted", auditEventsDeleted)
+	metrics.Set("users_deleted", usersDeleted)
+	metrics.Set("username_reservations_deleted", reservationsDeleted)
+	metrics.Set("login_throttles_deleted", throttlesDeleted)
+	metrics.Set("last_run_at", lastRunAt)
+}
+
+// Purger deletes rows that were recorded, expired or revoked before a point in time.
+// Each method reports false when another replica holds its lock and nothing was done.
+type Purger interface {
+	PurgeTokens(ctx context.Context, before time.Time) (int64, bool, error)
+	PurgeAuditEvents(ctx context.Context, before time.Time) (int64, bool, error)
+	PurgeDeletedUsers(ctx context.Context, before time.Time) (int64, bool, error)
+	PurgeUsernameReservations(ctx context.Context, before time.Time) (int64, bool, error)
+	PurgeLoginThrottles(ctx context.Context, before time.Time) (int64, bool, error)
+}
+
+// Janitor periodically removes expired and revoked tokens, and audit events, that are older than their retention.
+// It also deletes the accounts whose deletion grace period ended, the username reservations that
+// ended, and the failed login counters that are older than the failure window.
+type Janitor struct {
+	Purger         Purger
+	Logger         *slog.Logger
+	Interval       time.Duration
+	Retention      time.Duration
+	AuditRetention time.Duration
+	// FailureWindow is the LOGIN_FAILURE_WINDOW of the login throttling
+	FailureWindow time.Duration
+	// now is replaced in tests
+	now func() time.Time
+}
+
+// NewFromEnv returns a janitor configured by TOKEN_JANITOR_INTERVAL (default 1h), TOKEN_RETENTION
+// (default 168h), AUDIT_RETENTION (default 2160h) and LOGIN_FAILURE_WINDOW (default 15m), all Go durations.
+func NewFromEnv(purger Purger, logger *slog.Logger) (*Janitor, error) {
+	interval, err := envDuration("TOKEN_JANITOR_INTERVAL", time.Hour)
+	if err != nil {
+		return nil, err
+	}
+	retention, err := envDuration("TOKEN_RETENTION", 7*24*time.Hour)
+	if err != nil {
+		return nil, err
+	}
+	auditRetention, err := envDuration("AUDIT_RETENTION", 90*24*time.Hour)
+	if err != nil {
+		return nil, err
+	}
+	failureWindow, err := envDuration("LOGIN_FAILURE_WINDOW", 15*time.Minute)
+	if err != nil {
+		return nil, err
+	}
+	return &Janitor{Purger: purger, Logger: logger, Interval: interval, Retention: retention, AuditRetention: auditRetention, FailureWindow: failureWindow}, nil
+}
+
+// Run purges once right away and then every Interval until ctx is cancelled.
+// A purge in progress is cancelled with ctx, its transaction is rolled back.
+func (j *Janitor) Run(ctx context.Context) {
+	j.Logger.Info("janitor started",
+		slog.Duration("interval", j.Interval),
+		slog.Duration("retention", j.Retention),
+		slog.Duration("audit_retention", j.AuditRetention),
+	)
+
+	ticker := time.NewTicker(j.Interval)
+	defer ticker.Stop()
+
+	for {
+		j.RunOnce(ctx)
+
+		select {
+		case <-ctx.Done():
+			j.Logger.Info("janitor stopped")
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// RunOnce deletes the tokens and audit events that left their retention period, the accounts
+// due for deletion, the ended username reservations and the stale login throttles, and records
+// the outcome in the metrics
+func (j *Janitor) RunOnce(ctx context.Context) {
+	now := time.Now
+	if j.now != nil {
+		now = j.now
+	}
+	start := now()
+
+	j.purge(ctx, "tokens", j.Purger.PurgeTokens, start.Add(-j.Retention), tokensDeleted)
+	j.purge(ctx, "audit events", j.Purger.PurgeAuditEvents, start.Add(-j.AuditRetention), auditEventsDeleted)
+	j.purge(ctx, "deleted accounts", j.Purger.PurgeDeletedUsers, start, usersDeleted)
+	j.purge(ctx, "username reservations", j.Purger.PurgeUsernameReservations, start, reservationsDeleted)
+	j.purge(ctx, "login throttles", j.Purger.PurgeLoginThrottles, start.Add(-j.FailureWindow), throttlesDeleted)
+
+	lastRunAt.Set(start.UTC().Format(time.RFC3339))
+	j.Logger.Debug("janitor run finished", slog.Duration("took", now().Sub(start)))
+}
+
+func (j *Janitor) purge(ctx context.Context, what string, fn func(context.Context, time.Time) (int64, bool, error), before time.Time, deletedMetric *expvar.Int) {
+	deleted, locked, err := fn(ctx, before)
+	switch {
+	case err != nil && ctx.Err() != nil:
+		// Shutting down, the purge is picked up by the next start
+		return
+	case err != nil:
+		failures.Add(1)
+		j.Logger.Error("janitor failed to purge "+what, slog.String("error", err.Error()))
+		return
+	case !locked:
+		skipped.Add(1)
+		j.Logger.Debug("janitor skipped purging " + what + ", another replica holds the lock")
+		return
+	}
+
+	runs.Add(1)
+	deletedMetric.Add(deleted)
+	j.Logger.Info("janitor purged "+what, slog.Int64("deleted", deleted))
+}
+
+func envDuration(key string, fallback time.Duration) (time.Duration, error) {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid %s %q, expected a positive duration such as 1h", key, value)
+	}
+	return d, nil
+}
@@ -0,0 +1,118 @@
+package janitor
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+)
+
+type fakePurger struct {
+	tokensBefore time.Time
+	auditBefore  time.Time
+	usersBefore  time.Time
+	namesBefore  time.Time
+	loginBefore  time.Time
+	deleted      int64
+	locked       bool
+	err          error
+}
+
+func (p *fakePurger) PurgeTokens(ctx context.Context, before time.Time) (int64, bool, error) {
+	p.tokensBefore = before
+	return p.deleted, p.locked, p.err
+}
+
+func (p *fakePurger) PurgeAuditEvents(ctx context.Context, before time.Time) (int64, bool, error) {
+	p.auditBefore = before
+	return p.deleted, p.locked, p.err
+}
+
+func (p *fakePurger) PurgeDeletedUsers(ctx context.Context, before time.Time) (int64, bool, error) {
+	p.usersBefore = before
+	return p.deleted, p.locked, p.err
+}
+
+func (p *fakePurger) PurgeUsernameReservations(ctx context.Context, before time.Time) (int64, bool, error) {
+	p.namesBefore = before
+	return p.deleted, p.locked, p.err
+}
+
+func (p *fakePurger) PurgeLoginThrottles(ctx context.Context, before time.Time) (int64, bool, error) {
+	p.loginBefore = before
+	return p.deleted, p.locked, p.err
+}
+
+func TestRunOnce(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	purger := &fakePurger{deleted: 42, locked: true}
+	j := &Janitor{Purger: purger, Logger: logger, Retention: 24 * time.Hour, AuditRetention: 48 * time.Hour, FailureWindow: 15 * time.Minute, now: func() time.Time { return now }}
+
+	tokensBefore, auditBefore, usersBefore := tokensDeleted.Value(), auditEventsDeleted.Value(), usersDeleted.Value()
+	j.RunOnce(context.Background())
+	if want := now.Add(-24 * time.Hour); !purger.tokensBefore.Equal(want) {
+		t.Errorf("expected tokens before %v to be purged, got %v", want, purger.tokensBefore)
+	}
+	if want := now.Add(-48 * time.Hour); !purger.auditBefore.Equal(want) {
+		t.Errorf("expected audit events before %v to be purged, got %v", want, purger.auditBefore)
+	}
+	if !purger.usersBefore.Equal(now) {
+		t.Errorf("expected accounts due before %v to be deleted, got %v", now, purger.usersBefore)
+	}
+	if !purger.namesBefore.Equal(now) {
+		t.Errorf("expected reservations ended before %v to be purged, got %v", now, purger.namesBefore)
+	}
+	if want := now.Add(-15 * time.Minute); !purger.loginBefore.Equal(want) {
+		t.Errorf("expected login throttles before %v to be purged, got %v", want, purger.loginBefore)
+	}
+	if got := tokensDeleted.Value() - tokensBefore; got != 42 {
+		t.Errorf("expected 42 tokens deleted, got %d", got)
+	}
+	if got := auditEventsDeleted.Value() - auditBefore; got != 42 {
+		t.Errorf("expected 42 audit events deleted, got %d", got)
+	}
+	if got := usersDeleted.Value() - usersBefore; got != 42 {
+		t.Errorf("expected 42 accounts deleted, got %d", got)
+	}
+	if lastRunAt.Value() != "2024-05-01T12:00:00Z" {
+		t.Errorf("unexpected last run %q", lastRunAt.Value())
+	}
+
+	// Another replica holds the locks
+	purger.locked, purger.deleted = false, 0
+	before := skipped.Value()
+	j.RunOnce(context.Background())
+	if skipped.Value()-before != 5 {
+		t.Error("expected every purge to be counted as skipped")
+	}
+
+	purger.err = errors.New("connection refused")
+	before = failures.Value()
+	j.RunOnce(context.Background())
+	if failures.Value()-before != 5 {
+		t.Error("expected every purge to be counted as failed")
+	}
+}
+
+func TestRunStopsWithContext(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	j := &Janitor{Purger: &fakePurger{locked: true}, Logger: logger, Interval: time.Hour, Retention: time.Hour, AuditRetention: time.Hour}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		j.Run(ctx)
+		close(done)
+	}()
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Run did not return after the context was cancelled")
+	}
+}
@@ -0,0 +1,311 @@
+package jwtkeys
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-chi/jwtauth/v5"
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/lestrrat-go/jwx/v2/jwk"
+	"github.com/lestrrat-go/jwx/v2/jwt"
+)
+
+// KeyRing holds the keys used to sign and verify access tokens.
+// Tokens are always signed with the active key, while every key in the ring
+// is accepted for verification so that keys can be rotated without logging
+// everyone out.
+type KeyRing struct {
+	active jwk.Key
+	auth   *jwtauth.JWTAuth
+	verify jwk.Set
+	public jwk.Set
+	issuer string
+}
+
+// New builds a key ring signing with active and verifying with active and keys.
+// Every key must carry a key ID and an algorithm.
+func New(issuer string, active jwk.Key, keys ...jwk.Key) (*KeyRing, error) {
+	if !canSign(active) {
+		return nil, fmt.Errorf("active key %q cannot be used for signing", active.KeyID())
+	}
+
+	k := &KeyRing{
+		active: active,
+		auth:   jwtauth.New(active.Algorithm().String(), active, nil),
+		verify: jwk.NewSet(),
+		public: jwk.NewSet(),
+		issuer: issuer,
+	}
+
+	for _, key := range append([]jwk.Key{active}, keys...) {
+		if key.KeyID() == "" {
+			return nil, fmt.Errorf("key without a key ID")
+		}
+		if _, ok := k.verify.LookupKeyID(key.KeyID()); ok {
+			continue
+		}
+		if err := checkAlgorithm(key); err != nil {
+			return nil, err
+		}
+		if err := k.verify.AddKey(key); err != nil {
+			return nil, err
+		}
+
+		// Shared secrets are never published
+		if key.KeyType() == jwa.OctetSeq {
+			continue
+		}
+		pub, err := jwk.PublicKeyOf(key)
+		if err != nil {
+			return nil, err
+		}
+		_ = pub.Set(jwk.KeyUsageKey, jwk.ForSignature)
+		if err := k.public.AddKey(pub); err != nil {
+			return nil, err
+		}
+	}
+
+	return k, nil
+}
+
+// MinSecretLength is the shortest HMAC secret accepted, in bytes, as long as the output of HS256
+const MinSecretLength = 32
+
+// LoadFromEnv builds the key ring from the environment:
+//
+//	JWT_SIGNING_KEYS   comma separated kid:alg:path entries, e.g. "2024-10:RS256:/keys/rs.pem,2024-06:EdDSA:/keys/ed.pem"
+//	JWT_ACTIVE_KEY_ID  kid used for signing, defaults to the first entry
+//	JWT_SECRET         optional HS256 shared secret, registered under JWT_SECRET_KEY_ID (default "default")
+//	JWT_ISSUER         optional iss claim set on and required from every token
+//
+// Key files may be PEM encoded or JWK JSON; HMAC keys are read as raw bytes.
+// Entries whose file only holds a public key are accepted for verification only.
+// HMAC secrets must be at least MinSecretLength bytes long. When nothing is configured it fails, unless
+// ALLOW_EPHEMERAL_KEYS=true is set for local development: an ephemeral Ed25519 key is generated then,
+// so tokens do not survive a restart.
+func LoadFromEnv() (*KeyRing, error) {
+	var keys []jwk.Key
+
+	for _, entry := range strings.Split(os.Getenv("JWT_SIGNING_KEYS"), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, ":", 3)
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("invalid JWT_SIGNING_KEYS entry %q, expected kid:alg:path", entry)
+		}
+		key, err := LoadKeyFile(parts[0], parts[1], parts[2])
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	if secret := os.Getenv("JWT_SECRET"); secret != "" {
+		if len(secret) < MinSecretLength {
+			return nil, fmt.Errorf("JWT_SECRET must be at least %d bytes long", MinSecretLength)
+		}
+		kid := os.Getenv("JWT_SECRET_KEY_ID")
+		if kid == "" {
+			kid = "default"
+		}
+		key, err := newKey(kid, jwa.HS256.String(), []byte(secret))
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	if len(keys) == 0 {
+		if os.Getenv("ALLOW_EPHEMERAL_KEYS") != "true" {
+			return nil, fmt.Errorf("no JWT signing keys configured, set JWT_SIGNING_KEYS or JWT_SECRET, or ALLOW_EPHEMERAL_KEYS=true in development")
+		}
+		log.Println("no JWT signing keys configured, generating an ephemeral key")
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		key, err := newKey(fmt.Sprintf("ephemeral-%d", time.Now().Unix()), jwa.EdDSA.String(), priv)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	active := keys[0]
+	if kid := os.Getenv("JWT_ACTIVE_KEY_ID"); kid != "" {
+		found := false
+		for _, key := range keys {
+			if key.KeyID() == kid {
+				active, found = key, true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("JWT_ACTIVE_KEY_ID %q does not match any configured key", kid)
+		}
+	}
+
+	return New(os.Getenv("JWT_ISSUER"), active, keys...)
+}
+
+// LoadKeyFile reads a key from path and tags it with kid and alg
+func LoadKeyFile(kid, alg, path string) (jwk.Key, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading key %q: %w", kid, err)
+	}
+
+	if strings.HasPrefix(alg, "HS") {
+		secret := bytes.TrimSpace(data)
+		if len(secret) < MinSecretLength {
+			return nil, fmt.Errorf("key %q: HMAC secrets must be at least %d bytes long", kid, MinSecretLength)
+		}
+		return newKey(kid, alg, secret)
+	}
+
+	key, err := jwk.ParseKey(data, jwk.WithPEM(bytes.HasPrefix(bytes.TrimSpace(data), []byte("-----BEGIN"))))
+	if err != nil {
+		return nil, fmt.Errorf("parsing key %q: %w", kid, err)
+	}
+	if err := key.Set(jwk.KeyIDKey, kid); err != nil {
+		return nil, err
+	}
+	if err := key.Set(jwk.AlgorithmKey, jwa.SignatureAlgorithm(alg)); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func newKey(kid, alg string, raw interface{}) (jwk.Key, error) {
+	key, err := jwk.FromRaw(raw)
+	if err != nil {
+		return nil, err
+	}
+	if err := key.Set(jwk.KeyIDKey, kid); err != nil {
+		return nil, err
+	}
+	if err := key.Set(jwk.AlgorithmKey, jwa.SignatureAlgorithm(alg)); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// checkAlgorithm makes sure the algorithm of the key matches its type
+func checkAlgorithm(key jwk.Key) error {
+	alg := key.Algorithm().String()
+	var want jwa.KeyType
+	switch {
+	case strings.HasPrefix(alg, "HS"):
+		want = jwa.OctetSeq
+	case strings.HasPrefix(alg, "RS"), strings.HasPrefix(alg, "PS"):
+		want = jwa.RSA
+	case strings.HasPrefix(alg, "ES"):
+		want = jwa.EC
+	case alg == jwa.EdDSA.String():
+		want = jwa.OKP
+	default:
+		return fmt.Errorf("key %q: unsupported algorithm %q", key.KeyID(), alg)
+	}
+	if key.KeyType() != want {
+		return fmt.Errorf("key %q: algorithm %s requires a %s key, got %s", key.KeyID(), alg, want, key.KeyType())
+	}
+	return nil
+}
+
+// canSign reports whether the key holds private (or shared) key material
+func canSign(key jwk.Key) bool {
+	var raw interface{}
+	if err := key.Raw(&raw); err != nil {
+		return false
+	}
+	switch raw.(type) {
+	case *rsa.PrivateKey, *ecdsa.PrivateKey, ed25519.PrivateKey, []byte:
+		return true
+	}
+	return false
+}
+
+// ActiveKeyID returns the key ID tokens are currently signed with
+func (k *KeyRing) ActiveKeyID() string {
+	return k.active.KeyID()
+}
+
+// PublicKeys returns the public halves of the asymmetric keys, as served on the JWKS endpoint
+func (k *KeyRing) PublicKeys() jwk.Set {
+	return k.public
+}
+
+// Encode signs the claims with the active key. The kid header is set from the key.
+func (k *KeyRing) Encode(claims map[string]interface{}) (jwt.Token, string, error) {
+	if k.issuer != "" {
+		claims[jwt.IssuerKey] = k.issuer
+	}
+	return k.auth.Encode(claims)
+}
+
+// Decode parses a token string and verifies its signature against the key with the matching kid.
+// It does not validate the claims, see Verify.
+func (k *KeyRing) Decode(tokenString string) (jwt.Token, error) {
+	return jwt.Parse([]byte(tokenString), jwt.WithKeySet(k.verify), jwt.WithValidate(false))
+}
+
+// Verify decodes the token and validates its claims, normalizing errors the same way jwtauth does
+func (k *KeyRing) Verify(tokenString string) (jwt.Token, error) {
+	token, err := k.Decode(tokenString)
+	if err != nil {
+		return token, jwtauth.ErrorReason(err)
+	}
+
+	opts := []jwt.ValidateOption{jwt.WithAcceptableSkew(30 * time.Second)}
+	if k.issuer != "" {
+		opts = append(opts, jwt.WithIssuer(k.issuer))
+	}
+	if err := jwt.Validate(token, opts...); err != nil {
+		return token, jwtauth.ErrorReason(err)
+	}
+	return token, nil
+}
+
+// Verifier is the key ring counterpart of jwtauth.Verify. It looks for a token with the
+// given lookups, by default in the Authorization header and then in the jwt cookie,
+// verifies it and stores the result in the request context so that jwtauth.FromContext
+// keeps working.
+func (k *KeyRing) Verifier(findTokenFns ...func(r *http.Request) string) func(http.Handler) http.Handler {
+	if len(findTokenFns) == 0 {
+		findTokenFns = []func(r *http.Request) string{jwtauth.TokenFromHeader, jwtauth.TokenFromCookie}
+	}
+	return func(next http.Handler) http.Handler {
+		hfn := func(w http.ResponseWriter, r *http.Request) {
+			var tokenString string
+			for _, fn := range findTokenFns {
+				tokenString = fn(r)
+				if tokenString != "" {
+					break
+				}
+			}
+
+			var (
+				token jwt.Token
+				err   = jwtauth.ErrNoTokenFound
+			)
+			if tokenString != "" {
+				token, err = k.Verify(tokenString)
+			}
+
+			ctx := jwtauth.NewContext(r.Context(), token, err)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		}
+		return http.HandlerFunc(hfn)
+	}
+}
@@ -0,0 +1,129 @@
+package jwtkeys
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"strings"
+	"testing"
+
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/lestrrat-go/jwx/v2/jws"
+)
+
+func mustKey(t *testing.T, kid, alg string, raw interface{}) *KeyRing {
+	t.Helper()
+	key, err := newKey(kid, alg, raw)
+	if err != nil {
+		t.Fatalf("newKey(%s): %v", kid, err)
+	}
+	ring, err := New("", key)
+	if err != nil {
+		t.Fatalf("New(%s): %v", kid, err)
+	}
+	return ring
+}
+
+func TestEncodeSetsKid(t *testing.T) {
+	_, priv, _ := ed25519.GenerateKey(rand.Reader)
+	ring := mustKey(t, "ed-1", jwa.EdDSA.String(), priv)
+
+	_, tokenString, err := ring.Encode(map[string]interface{}{"user_id": "abc"})
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+
+	msg, err := jws.Parse([]byte(tokenString))
+	if err != nil {
+		t.Fatalf("jws.Parse: %v", err)
+	}
+	if kid := msg.Signatures()[0].ProtectedHeaders().KeyID(); kid != "ed-1" {
+		t.Fatalf("expected kid ed-1, got %q", kid)
+	}
+}
+
+func TestRotation(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+
+	oldJWK, _ := newKey("old", jwa.RS256.String(), rsaKey)
+	newJWK, _ := newKey("new", jwa.EdDSA.String(), edKey)
+
+	before, err := New("", oldJWK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, oldToken, err := before.Encode(map[string]interface{}{"user_id": "abc"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	after, err := New("", newJWK, oldJWK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := after.Verify(oldToken); err != nil {
+		t.Fatalf("token signed with the previous key should still verify: %v", err)
+	}
+	if after.PublicKeys().Len() != 2 {
+		t.Fatalf("expected 2 published keys, got %d", after.PublicKeys().Len())
+	}
+
+	// A ring that dropped the old key rejects its tokens
+	dropped, _ := New("", newJWK)
+	if _, err := dropped.Verify(oldToken); err == nil {
+		t.Fatal("expected token signed with a removed key to be rejected")
+	}
+}
+
+func TestSharedSecretIsNotPublished(t *testing.T) {
+	ring := mustKey(t, "hs", jwa.HS256.String(), []byte("0123456789abcdef0123456789abcdef"))
+	if ring.PublicKeys().Len() != 0 {
+		t.Fatalf("expected no published keys, got %d", ring.PublicKeys().Len())
+	}
+}
+
+func TestAlgorithmMismatch(t *testing.T) {
+	_, priv, _ := ed25519.GenerateKey(rand.Reader)
+	key, _ := newKey("bad", jwa.RS256.String(), priv)
+	if _, err := New("", key); err == nil {
+		t.Fatal("expected an EdDSA key tagged RS256 to be rejected")
+	}
+}
+
+func TestPublicKeyCannotSign(t *testing.T) {
+	pub, _, _ := ed25519.GenerateKey(rand.Reader)
+	key, _ := newKey("pub", jwa.EdDSA.String(), pub)
+	if _, err := New("", key); err == nil {
+		t.Fatal("expected a public key to be refused as the active key")
+	}
+}
+
+func TestLoadFromEnv(t *testing.T) {
+	t.Setenv("JWT_SIGNING_KEYS", "")
+	t.Setenv("JWT_ACTIVE_KEY_ID", "")
+	t.Setenv("ALLOW_EPHEMERAL_KEYS", "")
+	t.Setenv("JWT_SECRET", "")
+	if _, err := LoadFromEnv(); err == nil {
+		t.Error("expected an error without any key")
+	}
+
+	t.Setenv("JWT_SECRET", "too-short")
+	if _, err := LoadFromEnv(); err == nil {
+		t.Error("expected an error for a short JWT_SECRET")
+	}
+
+	t.Setenv("JWT_SECRET", strings.Repeat("s", MinSecretLength))
+	if ring, err := LoadFromEnv(); err != nil || ring.ActiveKeyID() != "default" {
+		t.Errorf("expected the shared secret to be used, got %v", err)
+	}
+
+	t.Setenv("JWT_SECRET", "")
+	t.Setenv("ALLOW_EPHEMERAL_KEYS", "true")
+	if _, err := LoadFromEnv(); err != nil {
+		t.Errorf("expected an ephemeral key in development, got %v", err)
+	}
+}
@@ -0,0 +1,59 @@
+package mailer
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFileMailer(t *testing.T) {
+	dir := t.TempDir()
+	m := &FileMailer{Dir: dir, From: "no-reply@example.com"}
+
+	err := m.Send(context.Background(), Message{
+		To:      "jane@example.com",
+		Subject: "Reset your password",
+		Body:    "line one\nline two",
+	})
+	if err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.eml"))
+	if err != nil || len(files) != 1 {
+		t.Fatalf("expected one .eml file, got %v (%v)", files, err)
+	}
+	if !strings.HasSuffix(files[0], "-jane_example.com.eml") {
+		t.Errorf("unexpected file name %s", files[0])
+	}
+
+	data, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"From: no-reply@example.com\r\n", "To: jane@example.com\r\n", "Subject: Reset your password\r\n", "\r\n\r\nline one\r\nline two"} {
+		if !strings.Contains(string(data), want) {
+			t.Errorf("message does not contain %q:\n%s", want, data)
+		}
+	}
+}
+
+func TestNewFromEnvRequiresMailer(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	t.Setenv("MAILER", "")
+	if _, err := NewFromEnv(logger); err == nil {
+		t.Error("expected an error when MAILER is not set")
+	}
+
+	t.Setenv("MAILER", "log")
+	if m, err := NewFromEnv(logger); err != nil {
+		t.Errorf("expected MAILER=log to be accepted, got %v", err)
+	} else if _, ok := m.(*LogMailer); !ok {
+		t.Errorf("expected a LogMailer, got %T", m)
+	}
+}
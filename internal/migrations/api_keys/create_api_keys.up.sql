@@ -0,0 +1,19 @@
+CREATE EXTENSION IF NOT EXISTS "uuid-ossp";
+
+-- Personal access tokens for scripts and CI jobs. Only the SHA-256 digest of the
+-- key is stored, prefix is the start of the key shown to tell keys apart.
+CREATE TABLE api_keys (
+                       id UUID DEFAULT uuid_generate_v4() PRIMARY KEY,
+                       user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+                       name VARCHAR(100) NOT NULL,
+                       prefix VARCHAR(20) NOT NULL,
+                       key_hash VARCHAR(64) NOT NULL UNIQUE,
+                       scopes JSONB NOT NULL DEFAULT '[]',       -- e.g. ["read", "animals:write"]
+                       expires_at TIMESTAMP WITH TIME ZONE,       -- NULL means the key does not expire
+                       last_used_at TIMESTAMP WITH TIME ZONE,
+                       last_used_ip VARCHAR(45),
+                       revoked_at TIMESTAMP WITH TIME ZONE,
+                       created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_api_keys_user_id ON api_keys(user_id);
@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS audit_events;
+
+DELETE FROM role_permissions WHERE permission = 'audit:read';
+DELETE FROM permissions WHERE name = 'audit:read';
@@ -0,0 +1,30 @@
+CREATE EXTENSION IF NOT EXISTS "uuid-ossp";
+
+INSERT INTO permissions (name, description) VALUES
+    ('audit:read', 'Read the security audit log');
+
+INSERT INTO role_permissions (role_id, permission)
+SELECT id, 'audit:read' FROM roles WHERE name = 'ADMIN';
+
+-- Security relevant account events such as logins, logouts and revoked tokens.
+-- Events outlive the users they are about; username keeps who it was, and is
+-- the only reference for failed logins of unknown usernames.
+CREATE TABLE audit_events (
+                       id UUID DEFAULT uuid_generate_v4() PRIMARY KEY,
+                       event_type VARCHAR(50) NOT NULL,              -- e.g. login, logout, session.created
+                       outcome VARCHAR(10) NOT NULL CHECK (outcome IN ('SUCCESS', 'FAILURE')),
+                       reason VARCHAR(50),                           -- why a FAILURE failed, e.g. invalid_credentials
+                       actor_id UUID REFERENCES users(id) ON DELETE SET NULL,
+                       username VARCHAR(50),
+                       impersonator_id UUID REFERENCES users(id) ON DELETE SET NULL,
+                       ip_address VARCHAR(45),
+                       user_agent TEXT,
+                       request_id VARCHAR(100),
+                       details JSONB NOT NULL DEFAULT '{}',
+                       created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Pages are read newest first, by created_at and id
+CREATE INDEX idx_audit_events_created_at ON audit_events(created_at DESC, id DESC);
+CREATE INDEX idx_audit_events_actor_id ON audit_events(actor_id, created_at DESC);
+CREATE INDEX idx_audit_events_event_type ON audit_events(event_type, created_at DESC);
@@ -0,0 +1,26 @@
+CREATE EXTENSION IF NOT EXISTS "uuid-ossp";
+
+INSERT INTO permissions (name, description) VALUES
+    ('users:impersonate', 'Act as another user to see what they see');
+
+INSERT INTO role_permissions (role_id, permission)
+SELECT id, 'users:impersonate' FROM roles WHERE name = 'ADMIN';
+
+-- Audit record of every impersonation. The access token handed to the admin
+-- belongs to the token family session_id, revoking it ends the impersonation.
+-- Records outlive the admin account, admin_username keeps who it was.
+CREATE TABLE impersonations (
+                       id UUID DEFAULT uuid_generate_v4() PRIMARY KEY,
+                       admin_id UUID REFERENCES users(id) ON DELETE SET NULL,
+                       admin_username VARCHAR(50) NOT NULL,
+                       user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+                       session_id UUID NOT NULL,
+                       reason TEXT NOT NULL,
+                       ip_address VARCHAR(45),
+                       user_agent TEXT,
+                       created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+                       expires_at TIMESTAMP WITH TIME ZONE NOT NULL
+);
+
+CREATE INDEX idx_impersonations_user_id ON impersonations(user_id);
+CREATE INDEX idx_impersonations_admin_id ON impersonations(admin_id);
@@ -0,0 +1,12 @@
+-- Failed login attempts, counted per username and per client IP. Counters
+-- restart once no failure happened for the configured window.
+CREATE TABLE login_throttles (
+                       scope VARCHAR(10) NOT NULL CHECK (scope IN ('USERNAME', 'IP')),
+                       key VARCHAR(255) NOT NULL,
+                       failures INT NOT NULL DEFAULT 0,
+                       last_failure_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+                       locked_until TIMESTAMP WITH TIME ZONE,
+                       PRIMARY KEY (scope, key)
+);
+
+CREATE INDEX idx_login_throttles_last_failure_at ON login_throttles(last_failure_at);
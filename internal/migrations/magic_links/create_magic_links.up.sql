@@ -0,0 +1,11 @@
+-- Magic login links. The link itself is signed and carries the id of its row,
+-- the row makes it usable only once.
+CREATE TABLE magic_links (
+                       id UUID PRIMARY KEY,
+                       user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+                       expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+                       used_at TIMESTAMP WITH TIME ZONE,
+                       created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_magic_links_user_id ON magic_links(user_id, created_at);
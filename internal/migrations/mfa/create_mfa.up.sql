@@ -0,0 +1,20 @@
+CREATE EXTENSION IF NOT EXISTS "uuid-ossp";
+
+-- TOTP (RFC 6238) second factor. The secret is stored when enrollment starts and
+-- only enforced once totp_enabled_at is set. totp_last_used_step prevents a code
+-- from being used twice.
+ALTER TABLE users
+    ADD COLUMN totp_secret VARCHAR(64),
+    ADD COLUMN totp_enabled_at TIMESTAMP WITH TIME ZONE,
+    ADD COLUMN totp_last_used_step BIGINT;
+
+-- Single-use recovery codes, only the SHA-256 digest is stored
+CREATE TABLE mfa_recovery_codes (
+                       id UUID DEFAULT uuid_generate_v4() PRIMARY KEY,
+                       user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+                       code_hash VARCHAR(64) NOT NULL,
+                       used_at TIMESTAMP WITH TIME ZONE,
+                       created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_mfa_recovery_codes_user_id ON mfa_recovery_codes(user_id);
@@ -0,0 +1,13 @@
+CREATE EXTENSION IF NOT EXISTS "uuid-ossp";
+
+-- Single-use password reset tokens. Only the SHA-256 digest of a token is stored.
+CREATE TABLE password_resets (
+                       id UUID DEFAULT uuid_generate_v4() PRIMARY KEY,
+                       user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+                       token_hash VARCHAR(64) NOT NULL UNIQUE,
+                       expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+                       used_at TIMESTAMP WITH TIME ZONE,
+                       created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_password_resets_user_id ON password_resets(user_id);
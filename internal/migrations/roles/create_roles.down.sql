@@ -0,0 +1,15 @@
+UPDATE users SET role = 'USER' WHERE role NOT IN ('USER', 'ADMIN');
+DELETE FROM session_policies WHERE role NOT IN ('USER', 'ADMIN');
+
+ALTER TABLE session_policies
+    DROP CONSTRAINT IF EXISTS session_policies_role_fkey,
+    ALTER COLUMN role TYPE VARCHAR(20);
+
+ALTER TABLE users
+    DROP CONSTRAINT IF EXISTS users_role_fkey,
+    ALTER COLUMN role TYPE VARCHAR(20),
+    ADD CONSTRAINT users_role_check CHECK (role IN ('USER', 'ADMIN'));
+
+DROP TABLE IF EXISTS role_permissions;
+DROP TABLE IF EXISTS permissions;
+DROP TABLE IF EXISTS roles;
@@ -0,0 +1,53 @@
+CREATE EXTENSION IF NOT EXISTS "uuid-ossp";
+
+-- Roles are referenced by name from users.role and session_policies.role.
+-- System roles are seeded here and cannot be deleted.
+CREATE TABLE roles (
+                       id UUID DEFAULT uuid_generate_v4() PRIMARY KEY,
+                       name VARCHAR(50) NOT NULL UNIQUE,
+                       description TEXT NOT NULL DEFAULT '',
+                       is_system BOOLEAN NOT NULL DEFAULT FALSE,
+                       created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+                       updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TRIGGER update_roles_updated_at
+    BEFORE UPDATE ON roles
+    FOR EACH ROW
+EXECUTE FUNCTION update_updated_at_column();
+
+-- The permissions checked by the code, new ones are added by later migrations
+CREATE TABLE permissions (
+                       name VARCHAR(100) PRIMARY KEY,
+                       description TEXT NOT NULL DEFAULT ''
+);
+
+CREATE TABLE role_permissions (
+                       role_id UUID NOT NULL REFERENCES roles(id) ON DELETE CASCADE,
+                       permission VARCHAR(100) NOT NULL REFERENCES permissions(name) ON DELETE CASCADE,
+                       PRIMARY KEY (role_id, permission)
+);
+
+INSERT INTO permissions (name, description) VALUES
+    ('admin:access', 'Open the admin area'),
+    ('animals:write', 'Add and change animals'),
+    ('roles:manage', 'Create, change and assign roles'),
+    ('session_policies:manage', 'Change session limits of roles and users'),
+    ('users:unlock', 'Lift login lockouts');
+
+INSERT INTO roles (name, description, is_system) VALUES
+    ('USER', 'Default role of every user', TRUE),
+    ('ADMIN', 'Full access', TRUE);
+
+INSERT INTO role_permissions (role_id, permission)
+SELECT roles.id, permissions.name FROM roles, permissions WHERE roles.name = 'ADMIN';
+
+-- Replace the fixed USER/ADMIN check with references to the seeded roles
+ALTER TABLE users
+    DROP CONSTRAINT IF EXISTS users_role_check,
+    ALTER COLUMN role TYPE VARCHAR(50),
+    ADD CONSTRAINT users_role_fkey FOREIGN KEY (role) REFERENCES roles(name);
+
+ALTER TABLE session_policies
+    ALTER COLUMN role TYPE VARCHAR(50),
+    ADD CONSTRAINT session_policies_role_fkey FOREIGN KEY (role) REFERENCES roles(name) ON DELETE CASCADE;
@@ -0,0 +1,3 @@
+ALTER TABLE tokens DROP COLUMN IF EXISTS device_type;
+
+DROP TABLE IF EXISTS session_policies;
@@ -0,0 +1,32 @@
+CREATE EXTENSION IF NOT EXISTS "uuid-ossp";
+
+-- A policy applies either to a role or to a single user. The most specific
+-- policy wins: a user policy replaces the policy of the user's role.
+CREATE TABLE session_policies (
+                       id UUID DEFAULT uuid_generate_v4() PRIMARY KEY,
+                       role VARCHAR(20),
+                       user_id UUID REFERENCES users(id) ON DELETE CASCADE,
+                       max_sessions INT CHECK (max_sessions > 0),      -- NULL means unlimited
+                       on_limit VARCHAR(12) NOT NULL DEFAULT 'EVICT_OLDEST'
+                           CHECK (on_limit IN ('EVICT_OLDEST', 'REJECT_NEW')),
+                       device_limits JSONB NOT NULL DEFAULT '{}',     -- e.g. {"mobile": 2, "desktop": 1}
+                       created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+                       updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+                       CHECK ((role IS NULL) <> (user_id IS NULL))
+);
+
+CREATE UNIQUE INDEX idx_session_policies_role ON session_policies(role) WHERE role IS NOT NULL;
+CREATE UNIQUE INDEX idx_session_policies_user_id ON session_policies(user_id) WHERE user_id IS NOT NULL;
+
+CREATE TRIGGER update_session_policies_updated_at
+    BEFORE UPDATE ON session_policies
+    FOR EACH ROW
+EXECUTE FUNCTION update_updated_at_column();
+
+-- Keep the previous behaviour of two sessions per user, evicting the oldest
+INSERT INTO session_policies (role, max_sessions, on_limit) VALUES
+    ('USER', 2, 'EVICT_OLDEST'),
+    ('ADMIN', 2, 'EVICT_OLDEST');
+
+-- Device type of the client a session was created from, used for per-device limits
+ALTER TABLE tokens ADD COLUMN device_type VARCHAR(10);
@@ -0,0 +1,6 @@
+-- The plaintext tokens cannot be restored, access tokens issued until now stay invalid
+UPDATE tokens SET is_valid = FALSE WHERE token_type = 'ACCESS';
+
+DROP INDEX IF EXISTS idx_tokens_jti;
+
+ALTER TABLE tokens DROP COLUMN IF EXISTS jti;
@@ -0,0 +1,12 @@
+-- Access tokens are looked up and revoked by their jti claim. The token column
+-- keeps the SHA-256 digest of the JWT, like it does for refresh tokens, so that
+-- a copy of the table holds no usable bearer tokens.
+ALTER TABLE tokens ADD COLUMN jti UUID;
+
+CREATE UNIQUE INDEX idx_tokens_jti ON tokens(jti) WHERE jti IS NOT NULL;
+
+-- Tokens issued before carry no jti and can no longer be checked, they expire within minutes anyway
+UPDATE tokens
+SET token = encode(sha256(convert_to(token, 'UTF8')), 'hex'),
+    is_valid = FALSE
+WHERE token_type = 'ACCESS';
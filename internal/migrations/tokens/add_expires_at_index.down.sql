@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS idx_tokens_invalidated;
+DROP INDEX IF EXISTS idx_tokens_expires_at;
@@ -0,0 +1,3 @@
+-- The token janitor deletes by expiry and invalidation time
+CREATE INDEX idx_tokens_expires_at ON tokens(expires_at);
+CREATE INDEX idx_tokens_invalidated ON tokens(updated_at) WHERE is_valid = FALSE;
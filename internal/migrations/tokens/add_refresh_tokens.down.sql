@@ -0,0 +1,9 @@
+DROP INDEX IF EXISTS idx_tokens_refresh_token;
+DROP INDEX IF EXISTS idx_tokens_family_id;
+
+DELETE FROM tokens WHERE token_type = 'REFRESH';
+
+ALTER TABLE tokens
+    DROP COLUMN IF EXISTS replaced_by,
+    DROP COLUMN IF EXISTS family_id,
+    DROP COLUMN IF EXISTS token_type;
@@ -0,0 +1,13 @@
+-- Refresh tokens live next to access tokens. Every login starts a new token
+-- family; rotating a refresh token keeps the family and links the old row to
+-- its replacement so that a replayed token can be detected.
+ALTER TABLE tokens
+    ADD COLUMN token_type VARCHAR(10) NOT NULL DEFAULT 'ACCESS'
+        CHECK (token_type IN ('ACCESS', 'REFRESH')),
+    ADD COLUMN family_id UUID,
+    ADD COLUMN replaced_by UUID REFERENCES tokens(id) ON DELETE SET NULL;
+
+CREATE INDEX idx_tokens_family_id ON tokens(family_id);
+
+-- Refresh tokens are stored as a SHA-256 digest and looked up by it.
+CREATE UNIQUE INDEX idx_tokens_refresh_token ON tokens(token) WHERE token_type = 'REFRESH';
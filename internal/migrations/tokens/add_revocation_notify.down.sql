@@ -0,0 +1,3 @@
+DROP TRIGGER IF EXISTS notify_tokens_deleted ON tokens;
+DROP TRIGGER IF EXISTS notify_tokens_revoked ON tokens;
+DROP FUNCTION IF EXISTS notify_token_revoked();
@@ -0,0 +1,27 @@
+-- Servers cache the validity of access tokens in memory. Whenever access tokens
+-- are revoked or deleted, the id of their user is sent on the token_revoked
+-- channel so that every replica drops the cached tokens of that user. Postgres
+-- folds identical notifications of one transaction into one.
+CREATE OR REPLACE FUNCTION notify_token_revoked()
+RETURNS TRIGGER AS $$
+BEGIN
+    IF TG_OP = 'DELETE' THEN
+        PERFORM pg_notify('token_revoked', OLD.user_id::text);
+        RETURN OLD;
+    END IF;
+    PERFORM pg_notify('token_revoked', NEW.user_id::text);
+    RETURN NEW;
+END;
+$$ language 'plpgsql';
+
+CREATE TRIGGER notify_tokens_revoked
+    AFTER UPDATE OF is_valid ON tokens
+    FOR EACH ROW
+    WHEN (OLD.is_valid AND NOT NEW.is_valid AND NEW.token_type = 'ACCESS')
+EXECUTE FUNCTION notify_token_revoked();
+
+CREATE TRIGGER notify_tokens_deleted
+    AFTER DELETE ON tokens
+    FOR EACH ROW
+    WHEN (OLD.is_valid AND OLD.token_type = 'ACCESS')
+EXECUTE FUNCTION notify_token_revoked();
@@ -0,0 +1,5 @@
+-- Client details captured at login, shown in the session list.
+-- Rotated refresh tokens inherit them from the token they replace.
+ALTER TABLE tokens
+    ADD COLUMN ip_address VARCHAR(45),
+    ADD COLUMN user_agent TEXT;
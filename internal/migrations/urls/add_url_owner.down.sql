@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS idx_urls_user_id;
+
+ALTER TABLE urls
+    DROP COLUMN IF EXISTS created_at,
+    DROP COLUMN IF EXISTS user_id;
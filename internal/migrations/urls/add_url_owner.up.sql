@@ -0,0 +1,6 @@
+-- Short URLs created while logged in belong to the user, anonymous ones have no owner
+ALTER TABLE urls
+    ADD COLUMN user_id UUID REFERENCES users(id) ON DELETE CASCADE,
+    ADD COLUMN created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP;
+
+CREATE INDEX idx_urls_user_id ON urls(user_id) WHERE user_id IS NOT NULL;
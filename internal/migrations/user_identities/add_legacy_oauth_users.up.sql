@@ -0,0 +1,13 @@
+-- Users registered by the OAuth login before identities existed have their email as username and
+-- a random password nobody knows. That login wrote the same row as the web registration, it left
+-- last_login_provider at 'WEB', so nothing tells the two apart: every account that predates this
+-- migration, has an email as username and no identity yet is flagged. It is linked to the identity
+-- of its next Google or GitHub login reporting a verified email matching the username, see
+-- LinkLegacyOAuthUser. Accounts registered from now on are never flagged.
+ALTER TABLE users
+    ADD COLUMN oauth_link_pending BOOLEAN NOT NULL DEFAULT FALSE;
+
+UPDATE users u
+SET oauth_link_pending = TRUE
+WHERE u.username LIKE '%_@_%'
+  AND NOT EXISTS (SELECT 1 FROM user_identities ui WHERE ui.user_id = u.id);
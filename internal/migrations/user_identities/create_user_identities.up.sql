@@ -0,0 +1,19 @@
+CREATE EXTENSION IF NOT EXISTS "uuid-ossp";
+
+-- OAuth accounts linked to a user. Logins are matched on the provider's user ID,
+-- never on the email address, which is only kept for display.
+CREATE TABLE user_identities (
+                       id UUID DEFAULT uuid_generate_v4() PRIMARY KEY,
+                       user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+                       provider VARCHAR(50) NOT NULL,
+                       provider_user_id VARCHAR(255) NOT NULL,
+                       email VARCHAR(255),
+                       avatar_url TEXT,
+                       raw_profile JSONB,
+                       created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+                       last_login_at TIMESTAMP WITH TIME ZONE,
+                       UNIQUE (provider, provider_user_id),
+                       UNIQUE (user_id, provider)
+);
+
+CREATE INDEX idx_user_identities_user_id ON user_identities(user_id);
@@ -0,0 +1,6 @@
+-- Set when the user asked to delete the account, the janitor deletes the user once it has passed.
+-- Every row referencing the user is removed through its ON DELETE CASCADE foreign key.
+ALTER TABLE users
+    ADD COLUMN deletion_scheduled_at TIMESTAMP WITH TIME ZONE;
+
+CREATE INDEX idx_users_deletion_scheduled_at ON users(deletion_scheduled_at) WHERE deletion_scheduled_at IS NOT NULL;
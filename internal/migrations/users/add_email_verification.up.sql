@@ -0,0 +1,4 @@
+-- Set once the user proved ownership of the address used as username
+ALTER TABLE users
+    ADD COLUMN email_verified_at TIMESTAMP WITH TIME ZONE,
+    ADD COLUMN email_verification_sent_at TIMESTAMP WITH TIME ZONE;
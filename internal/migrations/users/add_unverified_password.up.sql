@@ -0,0 +1,5 @@
+-- Set for passwords chosen at a registration whose address nobody verified yet. Whoever registered
+-- may not own the address, so the first magic link of the owner clears such a password. Accounts
+-- registered before this column existed keep their password, their owners chose it.
+ALTER TABLE users
+    ADD COLUMN password_unverified BOOLEAN NOT NULL DEFAULT FALSE;
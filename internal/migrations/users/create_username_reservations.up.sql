@@ -0,0 +1,10 @@
+-- Usernames given up by a rename stay reserved for their previous owner for a while,
+-- so nobody can pick up a name (often an email address) others still associate with them
+CREATE TABLE username_reservations (
+                       username VARCHAR(50) PRIMARY KEY,
+                       user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+                       reserved_until TIMESTAMP WITH TIME ZONE NOT NULL,
+                       created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_username_reservations_user_id ON username_reservations(user_id);
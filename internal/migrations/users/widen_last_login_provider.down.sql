@@ -0,0 +1,6 @@
+UPDATE users SET last_login_provider = 'WEB' WHERE last_login_provider NOT IN ('WEB', 'GOOGLE', 'GITHUB');
+
+ALTER TABLE users
+    ALTER COLUMN last_login_provider TYPE VARCHAR(6),
+    ADD CONSTRAINT users_last_login_provider_check
+        CHECK (last_login_provider IN ('WEB', 'GOOGLE', 'GITHUB'));
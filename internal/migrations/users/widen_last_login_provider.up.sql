@@ -0,0 +1,4 @@
+-- OIDC providers are named in the configuration, so last_login_provider is no longer a fixed list
+ALTER TABLE users
+    DROP CONSTRAINT IF EXISTS users_last_login_provider_check,
+    ALTER COLUMN last_login_provider TYPE VARCHAR(50);
@@ -0,0 +1,228 @@
+package server
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"golang.org/x/crypto/bcrypt"
+	"io"
+	"net/http"
+	"new_project/internal/auth"
+	"new_project/internal/database"
+	"new_project/internal/models"
+	"new_project/internal/response"
+	"time"
+)
+
+// Types of audit events of the account lifecycle
+const (
+	auditAccountExported          = "account.exported"
+	auditAccountDeletionScheduled = "account.deletion_scheduled"
+	auditAccountDeletionCancelled = "account.deletion_cancelled"
+)
+
+// UserExport is the copy of the personal data handed out by GET /api/p/v1/user/export
+type UserExport struct {
+	ExportedAt time.Time          `json:"exported_at"`
+	Profile    *database.User     `json:"profile"`
+	Sessions   []database.Session `json:"sessions"`
+	Workspaces []models.Workspace `json:"workspaces"`
+	ShortUrls  []database.Url     `json:"short_urls"`
+}
+
+// DeleteUserRequest confirms the deletion of the account, the password is required when the account has one
+type DeleteUserRequest struct {
+	Password string `json:"password"`
+}
+
+type DeleteUserResp struct {
+	Message     string    `json:"message"`
+	ScheduledAt time.Time `json:"deletion_scheduled_at"`
+	// Workspaces are deleted together with the account
+	Workspaces []models.Workspace `json:"workspaces"`
+}
+
+// ExportUserData sends a copy of the data stored about the logged-in user, as a JSON document
+// or, with ?format=zip, as a ZIP archive holding one JSON file per kind of data
+func (s *Server) ExportUserData(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "json"
+	}
+	if format != "json" && format != "zip" {
+		s.badRequest(w, r, fmt.Errorf("format must be json or zip"))
+		return
+	}
+
+	principal, err := auth.FromContext(r.Context())
+	if err != nil {
+		s.unauthorized(w, r)
+		return
+	}
+	userId := principal.UserID
+
+	// Everything is read before the first byte is written, so that errors still get a proper response
+	export, err := s.userExport(userId)
+	if err != nil {
+		s.serverError(w, r, err)
+		return
+	}
+	s.audit(r, database.AuditEvent{Type: auditAccountExported, ActorId: userId, Username: export.Profile.Username, Details: map[string]any{"format": format}})
+
+	filename := "export-" + export.ExportedAt.Format("20060102-150405") + "." + format
+	w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+	w.Header().Set("Cache-Control", "no-store")
+	if format == "json" {
+		err = response.JSON(w, http.StatusOK, export)
+		if err != nil {
+			s.serverError(w, r, err)
+		}
+		return
+	}
+
+	// The status is left implicit, WriteHeader of the JSON error middleware would turn the archive into JSON
+	w.Header().Set("Content-Type", "application/zip")
+	if err := writeExportZip(w, export); err != nil {
+		// The archive is already partly sent, the client sees a truncated file
+		s.reportServerError(r, err)
+	}
+}
+
+// DeleteUser schedules the deletion of the logged-in user's account after ACCOUNT_DELETION_GRACE_PERIOD.
+// Every session and API key is revoked right away, logging in again before the deletion cancels it.
+func (s *Server) DeleteUser(w http.ResponseWriter, r *http.Request) {
+	var req DeleteUserRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			s.badRequest(w, r, err)
+			return
+		}
+	}
+
+	principal, err := auth.FromContext(r.Context())
+	if err != nil {
+		s.unauthorized(w, r)
+		return
+	}
+	userId := principal.UserID
+
+	user, err := s.db.GetUserById(userId)
+	if err != nil {
+		s.serverError(w, r, err)
+		return
+	}
+
+	// Accounts created through a provider may have no password, their session is the only proof
+	_, hashedPassword, err := s.db.GetHashedPassword(user.Username)
+	if err != nil {
+		s.serverError(w, r, err)
+		return
+	}
+	if hashedPassword != "" {
+		if !s.reserveLoginAttempt(w, r, user.Username) {
+			return
+		}
+		if err := bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(req.Password)); err != nil {
+			s.recordLoginFailure(r, user.Username)
+			s.badRequest(w, r, fmt.Errorf("password is incorrect"))
+			return
+		}
+		s.releaseLoginAttempt(r, user.Username)
+	}
+
+	// Workspaces have a single owner, join codes do not add members to them yet, so no workspace
+	// is shared with anyone else and all of them go with the account. They are returned so that
+	// the client can tell the user what is going to be deleted.
+	workspaces, err := s.db.GetWorkspaces(userId)
+	if err != nil {
+		s.serverError(w, r, err)
+		return
+	}
+
+	scheduledAt := time.Now().Add(accountDeletionGracePeriod)
+	if err := s.db.ScheduleUserDeletion(userId, scheduledAt); err != nil {
+		s.serverError(w, r, err)
+		return
+	}
+	s.tokenCache.revokeUser(userId)
+	clearSessionCookies(w)
+
+	s.audit(r, database.AuditEvent{
+		Type: auditAccountDeletionScheduled, ActorId: userId, Username: user.Username,
+		Details: map[string]any{"deletion_scheduled_at": scheduledAt, "workspaces": len(workspaces)},
+	})
+
+	err = response.JSON(w, http.StatusAccepted, DeleteUserResp{
+		Message:     "account scheduled for deletion, log in again before then to keep it",
+		ScheduledAt: scheduledAt,
+		Workspaces:  workspaces,
+	})
+	if err != nil {
+		s.serverError(w, r, err)
+	}
+}
+
+// cancelAccountDeletion keeps the account of a user logging in during the deletion grace period
+func (s *Server) cancelAccountDeletion(r *http.Request, userId string) error {
+	cancelled, err := s.db.CancelUserDeletion(userId)
+	if err != nil {
+		return err
+	}
+	if cancelled {
+		s.audit(r, database.AuditEvent{Type: auditAccountDeletionCancelled, ActorId: userId})
+	}
+	return nil
+}
+
+func (s *Server) userExport(userId string) (*UserExport, error) {
+	user, err := s.db.GetUserById(userId)
+	if err != nil {
+		return nil, err
+	}
+	sessions, err := s.db.GetSessions(userId)
+	if err != nil {
+		return nil, err
+	}
+	workspaces, err := s.db.GetWorkspaces(userId)
+	if err != nil {
+		return nil, err
+	}
+	urls, err := s.db.GetUrlsByUser(userId)
+	if err != nil {
+		return nil, err
+	}
+
+	return &UserExport{
+		ExportedAt: time.Now().UTC(),
+		Profile:    user,
+		Sessions:   sessions,
+		Workspaces: workspaces,
+		ShortUrls:  urls,
+	}, nil
+}
+
+// writeExportZip writes the export as a ZIP archive with one JSON file per kind of data
+func writeExportZip(w io.Writer, export *UserExport) error {
+	archive := zip.NewWriter(w)
+	files := []struct {
+		name string
+		data any
+	}{
+		{"profile.json", export.Profile},
+		{"sessions.json", export.Sessions},
+		{"workspaces.json", export.Workspaces},
+		{"short_urls.json", export.ShortUrls},
+	}
+	for _, file := range files {
+		f, err := archive.CreateHeader(&zip.FileHeader{Name: file.name, Method: zip.Deflate, Modified: export.ExportedAt})
+		if err != nil {
+			return err
+		}
+		encoder := json.NewEncoder(f)
+		encoder.SetIndent("", "\t")
+		if err := encoder.Encode(file.data); err != nil {
+			return err
+		}
+	}
+	return archive.Close()
+}
@@ -0,0 +1,53 @@
+package server
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"new_project/internal/database"
+	"new_project/internal/models"
+	"testing"
+	"time"
+)
+
+func TestWriteExportZip(t *testing.T) {
+	export := &UserExport{
+		ExportedAt: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+		Profile:    &database.User{Id: "u1", Username: "jane@example.com"},
+		Sessions:   []database.Session{},
+		Workspaces: []models.Workspace{{Id: "w1", Name: "Home"}},
+		ShortUrls:  []database.Url{{Key: "abc", LongUrl: "https://example.com"}},
+	}
+
+	var buf bytes.Buffer
+	if err := writeExportZip(&buf, export); err != nil {
+		t.Fatal(err)
+	}
+	archive, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := map[string]*zip.File{}
+	for _, f := range archive.File {
+		files[f.Name] = f
+	}
+	for _, name := range []string{"profile.json", "sessions.json", "workspaces.json", "short_urls.json"} {
+		if files[name] == nil {
+			t.Errorf("expected %s in the archive", name)
+		}
+	}
+
+	f, err := files["profile.json"].Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var profile database.User
+	if err := json.NewDecoder(f).Decode(&profile); err != nil {
+		t.Fatal(err)
+	}
+	if profile.Username != "jane@example.com" {
+		t.Errorf("unexpected profile %+v", profile)
+	}
+}
@@ -0,0 +1,228 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"net/http"
+	"new_project/internal/auth"
+	"new_project/internal/database"
+	"new_project/internal/response"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// apiKeyPrefix starts every API key so that leaked keys are easy to recognise
+const apiKeyPrefix = "pat_"
+
+// Scopes an API key needs for reading and for changing data on the /api/p/v1 routes.
+// Keys may also carry permission names, which RequirePermission checks on top of the role of the user.
+const (
+	scopeRead  = "read"
+	scopeWrite = "write"
+)
+
+type APIKeysResp struct {
+	APIKeys []database.APIKey `json:"api_keys"`
+}
+
+// CreateAPIKeyRequest represents the data needed to create an API key
+type CreateAPIKeyRequest struct {
+	Name      string     `json:"name"`
+	Scopes    []string   `json:"scopes"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+// CreateAPIKeyResp carries the new key, it is only ever shown in this response
+type CreateAPIKeyResp struct {
+	*database.APIKey
+	Key string `json:"key"`
+}
+
+// CreateAPIKey creates a named API key with scopes for the logged-in user
+func (s *Server) CreateAPIKey(w http.ResponseWriter, r *http.Request) {
+	var req CreateAPIKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.badRequest(w, r, err)
+		return
+	}
+
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" || utf8.RuneCountInString(req.Name) > 100 {
+		s.badRequest(w, r, fmt.Errorf("name must be between 1 and 100 characters long"))
+		return
+	}
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+		s.badRequest(w, r, fmt.Errorf("expires_at must be in the future"))
+		return
+	}
+	if err := s.validateScopes(req.Scopes); err != nil {
+		if errors.Is(err, database.ErrUnknownPermission) {
+			s.badRequest(w, r, err)
+			return
+		}
+		s.serverError(w, r, err)
+		return
+	}
+
+	principal, err := auth.FromContext(r.Context())
+	if err != nil {
+		s.unauthorized(w, r)
+		return
+	}
+	userId := principal.UserID
+
+	key := apiKeyPrefix + generateOpaqueToken()
+	apiKey, err := s.db.CreateAPIKey(&database.APIKey{
+		UserId:    userId,
+		Name:      req.Name,
+		Prefix:    key[:len(apiKeyPrefix)+6],
+		Scopes:    req.Scopes,
+		ExpiresAt: req.ExpiresAt,
+	}, hashToken(key))
+	if err != nil {
+		s.serverError(w, r, err)
+		return
+	}
+
+	err = response.JSON(w, http.StatusCreated, CreateAPIKeyResp{APIKey: apiKey, Key: key})
+	if err != nil {
+		s.serverError(w, r, err)
+	}
+}
+
+// GetAPIKeys lists the API keys of the logged-in user, without the keys themselves
+func (s *Server) GetAPIKeys(w http.ResponseWriter, r *http.Request) {
+	principal, err := auth.FromContext(r.Context())
+	if err != nil {
+		s.unauthorized(w, r)
+		return
+	}
+	userId := principal.UserID
+
+	keys, err := s.db.GetAPIKeys(userId)
+	if err != nil {
+		s.serverError(w, r, err)
+		return
+	}
+
+	err = response.JSON(w, http.StatusOK, APIKeysResp{APIKeys: keys})
+	if err != nil {
+		s.serverError(w, r, err)
+	}
+}
+
+// RevokeAPIKey revokes an API key of the logged-in user, it stops working immediately
+func (s *Server) RevokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	keyId := chi.URLParam(r, "id")
+	if _, err := uuid.Parse(keyId); err != nil {
+		s.notFound(w, r)
+		return
+	}
+
+	principal, err := auth.FromContext(r.Context())
+	if err != nil {
+		s.unauthorized(w, r)
+		return
+	}
+	userId := principal.UserID
+
+	found, err := s.db.RevokeAPIKey(userId, keyId)
+	if err != nil {
+		s.serverError(w, r, err)
+		return
+	}
+	if !found {
+		s.notFound(w, r)
+		return
+	}
+
+	err = response.JSON(w, http.StatusOK, struct {
+		Message string `json:"message"`
+	}{Message: "API key revoked"})
+	if err != nil {
+		s.serverError(w, r, err)
+	}
+}
+
+// validateScopes checks that every scope is read, write or a known permission
+func (s *Server) validateScopes(scopes []string) error {
+	if len(scopes) == 0 {
+		return fmt.Errorf("%w: at least one scope is required", database.ErrUnknownPermission)
+	}
+
+	permissions, err := s.db.GetPermissions()
+	if err != nil {
+		return err
+	}
+	for _, scope := range scopes {
+		if scope == scopeRead || scope == scopeWrite {
+			continue
+		}
+		if !slices.ContainsFunc(permissions, func(p database.Permission) bool { return p.Name == scope }) {
+			return fmt.Errorf("%w %q", database.ErrUnknownPermission, scope)
+		}
+	}
+	return nil
+}
+
+// apiKeyFromHeader returns the key of an "Authorization: ApiKey <key>" header
+func apiKeyFromHeader(r *http.Request) (string, bool) {
+	scheme, key, found := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !found || !strings.EqualFold(scheme, "ApiKey") {
+		return "", false
+	}
+	return strings.TrimSpace(key), true
+}
+
+// authenticateAPIKey checks an API key and returns the request carrying its user in the same
+// claims as an access token, so that handlers do not have to tell the two apart.
+// It writes the error response and returns false when the key cannot be used for this request.
+func (s *Server) authenticateAPIKey(w http.ResponseWriter, r *http.Request, key string) (*http.Request, bool) {
+	apiKey, err := s.db.UseAPIKey(hashToken(key), clientIP(r))
+	if err != nil {
+		if errors.Is(err, database.ErrAPIKeyInvalid) {
+			http.Error(w, "Invalid or expired API key", http.StatusUnauthorized)
+			return r, false
+		}
+		s.serverError(w, r, err)
+		return r, false
+	}
+
+	scope := scopeWrite
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		scope = scopeRead
+	}
+	if !slices.Contains(apiKey.Scopes, scope) {
+		s.errorMessage(w, r, http.StatusForbidden, fmt.Sprintf("this API key is missing the %s scope", scope), nil)
+		return r, false
+	}
+
+	principal := &auth.Principal{
+		UserID:   apiKey.UserId,
+		Scopes:   apiKey.Scopes,
+		Method:   auth.MethodAPIKey,
+		APIKeyID: apiKey.Id,
+	}
+	return r.WithContext(auth.NewContext(r.Context(), principal)), true
+}
+
+// rejectAPIKeys keeps API keys away from routes that manage the account itself,
+// such as creating more keys or changing the password. It has to run after the authenticator.
+func (s *Server) rejectAPIKeys() func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		hfn := func(w http.ResponseWriter, r *http.Request) {
+			if principal, err := auth.FromContext(r.Context()); err == nil && principal.Method == auth.MethodAPIKey {
+				s.errorMessage(w, r, http.StatusForbidden, "this route cannot be used with an API key", nil)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		}
+		return http.HandlerFunc(hfn)
+	}
+}
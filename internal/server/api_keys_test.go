@@ -0,0 +1,110 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"new_project/internal/auth"
+	"new_project/internal/database"
+	"testing"
+)
+
+func TestAPIKeyFromHeader(t *testing.T) {
+	tests := map[string]string{
+		"ApiKey pat_abc": "pat_abc",
+		"apikey pat_abc": "pat_abc",
+		"Bearer eyJhbGc": "",
+		"pat_abc":        "",
+		"":               "",
+	}
+	for header, want := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/api/p/v1/user", nil)
+		req.Header.Set("Authorization", header)
+
+		key, ok := apiKeyFromHeader(req)
+		if key != want || ok != (want != "") {
+			t.Errorf("%q: expected %q, got %q (%v)", header, want, key, ok)
+		}
+	}
+}
+
+func TestRejectAPIKeys(t *testing.T) {
+	s := &Server{}
+	handler := s.rejectAPIKeys()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	req := httptest.NewRequest(http.MethodPost, "/api/p/v1/api-keys", nil)
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusNoContent {
+		t.Errorf("expected status %d without an API key, got %d", http.StatusNoContent, rr.Code)
+	}
+
+	req = req.WithContext(auth.NewContext(req.Context(), &auth.Principal{UserID: "u1", Scopes: []string{scopeWrite}, Method: auth.MethodAPIKey}))
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("expected status %d with an API key, got %d", http.StatusForbidden, rr.Code)
+	}
+}
+
+// apiKeyDB knows a single API key, its user's role grants animals:write and admin:access
+type apiKeyDB struct {
+	database.Service
+	key *database.APIKey
+}
+
+func (db *apiKeyDB) UseAPIKey(keyHash string, ipAddress string) (*database.APIKey, error) {
+	if keyHash != hashToken("pat_valid") {
+		return nil, database.ErrAPIKeyInvalid
+	}
+	return db.key, nil
+}
+
+func (db *apiKeyDB) GetUserPermissions(userID string) ([]string, error) {
+	return []string{database.PermAnimalsWrite, database.PermAdminAccess}, nil
+}
+
+func TestAuthenticateAPIKeyScopes(t *testing.T) {
+	tests := []struct {
+		name       string
+		key        string
+		scopes     []string
+		method     string
+		permission string
+		want       int
+	}{
+		{"read key reads", "pat_valid", []string{scopeRead}, http.MethodGet, "", http.StatusNoContent},
+		{"read key writes", "pat_valid", []string{scopeRead}, http.MethodPost, "", http.StatusForbidden},
+		{"write key reads", "pat_valid", []string{scopeWrite}, http.MethodGet, "", http.StatusForbidden},
+		{"write key writes", "pat_valid", []string{scopeWrite}, http.MethodPost, "", http.StatusNoContent},
+		{"unknown key", "pat_other", []string{scopeRead, scopeWrite}, http.MethodGet, "", http.StatusUnauthorized},
+		{"key with the permission", "pat_valid", []string{scopeWrite, database.PermAnimalsWrite}, http.MethodPost, database.PermAnimalsWrite, http.StatusNoContent},
+		{"key without the permission of the role", "pat_valid", []string{scopeWrite}, http.MethodPost, database.PermAnimalsWrite, http.StatusForbidden},
+		{"permission the role lacks", "pat_valid", []string{scopeWrite, database.PermRolesManage}, http.MethodPost, database.PermRolesManage, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		s := &Server{db: &apiKeyDB{key: &database.APIKey{Id: "k1", UserId: "u1", Scopes: tt.scopes}}}
+		var principal *auth.Principal
+		var handler http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			principal, _ = auth.FromContext(r.Context())
+			w.WriteHeader(http.StatusNoContent)
+		})
+		if tt.permission != "" {
+			handler = s.RequirePermission(tt.permission)(handler)
+		}
+		handler = s.authenticator()(handler)
+
+		req := httptest.NewRequest(tt.method, "/api/p/v1/workspace", nil)
+		req.Header.Set("Authorization", "ApiKey "+tt.key)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != tt.want {
+			t.Errorf("%s: expected status %d, got %d", tt.name, tt.want, rr.Code)
+		}
+		if rr.Code == http.StatusNoContent && (principal == nil || principal.Method != auth.MethodAPIKey || principal.UserID != "u1" || principal.APIKeyID != "k1") {
+			t.Errorf("%s: expected the principal of the key, got %+v", tt.name, principal)
+		}
+	}
+}
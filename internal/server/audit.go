@@ -0,0 +1,162 @@
+package server
+
+import (
+	"encoding/base64"
+	"fmt"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/google/uuid"
+	"net/http"
+	"new_project/internal/database"
+	"new_project/internal/response"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Types of audit events
+const (
+	auditRegister        = "register"
+	auditLogin           = "login"
+	auditLoginMFA        = "login.mfa"
+	auditLoginMagicLink  = "login.magic_link"
+	auditOAuthLogin      = "oauth.login"
+	auditLogout          = "logout"
+	auditSessionCreated  = "session.created"
+	auditTokenReused     = "token.reused"
+	auditImpersonation   = "impersonation.started"
+	auditPasswordCleared = "password.cleared"
+)
+
+// Reasons recorded for failed logins
+const (
+	auditReasonBadLogin   = "invalid_credentials"
+	auditReasonLockedOut  = "locked_out"
+	auditReasonBadMFACode = "invalid_code"
+)
+
+const (
+	defaultAuditPageSize = 50
+	maximumAuditPageSize = 200
+)
+
+type AuditEventsResp struct {
+	Events []database.AuditEvent `json:"events"`
+	// NextCursor is passed as ?cursor= to get the next page, it is empty on the last page
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// audit records an account event of the request together with the client it came from.
+// Failing to record it is reported but does not fail the request.
+func (s *Server) audit(r *http.Request, event database.AuditEvent) {
+	if event.Outcome == "" {
+		event.Outcome = database.AuditSuccess
+	}
+	if event.ImpersonatorId == "" {
+		event.ImpersonatorId = impersonator(r)
+	}
+	event.IpAddress = clientIP(r)
+	event.UserAgent = r.UserAgent()
+	event.RequestId = middleware.GetReqID(r.Context())
+
+	if err := s.db.InsertAuditEvent(&event); err != nil {
+		s.reportServerError(r, err)
+	}
+}
+
+// GetAuditEvents lists audit events newest first. They can be filtered with ?type=, ?outcome=,
+// ?actor_id=, ?username=, ?ip_address=, ?since= and ?until= (RFC 3339), and paged with ?limit= and ?cursor=.
+func (s *Server) GetAuditEvents(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter := database.AuditFilter{
+		Type:      query.Get("type"),
+		Outcome:   strings.ToUpper(query.Get("outcome")),
+		ActorId:   query.Get("actor_id"),
+		Username:  query.Get("username"),
+		IpAddress: query.Get("ip_address"),
+		Limit:     defaultAuditPageSize,
+	}
+
+	if filter.Outcome != "" && filter.Outcome != database.AuditSuccess && filter.Outcome != database.AuditFailure {
+		s.badRequest(w, r, fmt.Errorf("outcome must be %s or %s", database.AuditSuccess, database.AuditFailure))
+		return
+	}
+	if filter.ActorId != "" {
+		if _, err := uuid.Parse(filter.ActorId); err != nil {
+			s.badRequest(w, r, fmt.Errorf("invalid actor_id"))
+			return
+		}
+	}
+	for name, target := range map[string]**time.Time{"since": &filter.Since, "until": &filter.Until} {
+		if value := query.Get(name); value != "" {
+			t, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				s.badRequest(w, r, fmt.Errorf("%s must be an RFC 3339 time", name))
+				return
+			}
+			*target = &t
+		}
+	}
+	if value := query.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > maximumAuditPageSize {
+			s.badRequest(w, r, fmt.Errorf("limit must be between 1 and %d", maximumAuditPageSize))
+			return
+		}
+		filter.Limit = limit
+	}
+	if cursor := query.Get("cursor"); cursor != "" {
+		before, id, err := decodeAuditCursor(cursor)
+		if err != nil {
+			s.badRequest(w, r, err)
+			return
+		}
+		filter.BeforeTime, filter.BeforeId = &before, id
+	}
+
+	// One more event than asked for tells whether there is a next page
+	limit := filter.Limit
+	filter.Limit++
+	events, err := s.db.GetAuditEvents(filter)
+	if err != nil {
+		s.serverError(w, r, err)
+		return
+	}
+
+	resp := AuditEventsResp{Events: events}
+	if len(events) > limit {
+		resp.Events = events[:limit]
+		last := resp.Events[limit-1]
+		resp.NextCursor = encodeAuditCursor(last.CreatedAt, last.Id)
+	}
+
+	err = response.JSON(w, http.StatusOK, resp)
+	if err != nil {
+		s.serverError(w, r, err)
+	}
+}
+
+// encodeAuditCursor returns an opaque cursor pointing after the event
+func encodeAuditCursor(createdAt time.Time, id string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(createdAt.UTC().Format(time.RFC3339Nano) + "," + id))
+}
+
+func decodeAuditCursor(cursor string) (time.Time, string, error) {
+	errInvalid := fmt.Errorf("invalid cursor")
+
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return time.Time{}, "", errInvalid
+	}
+	createdAt, id, found := strings.Cut(string(raw), ",")
+	if !found {
+		return time.Time{}, "", errInvalid
+	}
+	t, err := time.Parse(time.RFC3339Nano, createdAt)
+	if err != nil {
+		return time.Time{}, "", errInvalid
+	}
+	if _, err := uuid.Parse(id); err != nil {
+		return time.Time{}, "", errInvalid
+	}
+	return t, id, nil
+}
@@ -0,0 +1,32 @@
+package server
+
+import (
+	"encoding/base64"
+	"testing"
+	"time"
+)
+
+func TestAuditCursor(t *testing.T) {
+	createdAt := time.Date(2024, 5, 1, 12, 30, 0, 123456000, time.UTC)
+	id := "5f1c3a52-8f0e-4d5c-9a4b-0c1d2e3f4a5b"
+
+	gotTime, gotId, err := decodeAuditCursor(encodeAuditCursor(createdAt, id))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !gotTime.Equal(createdAt) || gotId != id {
+		t.Errorf("expected %v %s, got %v %s", createdAt, id, gotTime, gotId)
+	}
+
+	invalid := []string{
+		"not base64!",
+		base64.RawURLEncoding.EncodeToString([]byte("no separator")),
+		base64.RawURLEncoding.EncodeToString([]byte("yesterday," + id)),
+		base64.RawURLEncoding.EncodeToString([]byte(createdAt.Format(time.RFC3339Nano) + ",1 OR 1=1")),
+	}
+	for _, cursor := range invalid {
+		if _, _, err := decodeAuditCursor(cursor); err == nil {
+			t.Errorf("expected an error for cursor %q", cursor)
+		}
+	}
+}
@@ -2,16 +2,22 @@ package server
 
 import (
 	"context"
-	"crypto/rand"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/jwtauth/v5"
+	"github.com/google/uuid"
+	"github.com/markbates/goth"
 	"github.com/markbates/goth/gothic"
 	"golang.org/x/crypto/bcrypt"
 	"log"
 	"net/http"
+	"net/mail"
+	"new_project/internal/auth"
+	"new_project/internal/database"
 	"new_project/internal/response"
+	"slices"
 	"strings"
 	"time"
 )
@@ -36,6 +42,12 @@ func (s *Server) Register(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Unverified accounts are locked out, so the username has to be an address we can verify
+	if _, err := mail.ParseAddress(req.Username); requireVerifiedEmail && err != nil {
+		s.badRequest(w, r, fmt.Errorf("username must be a valid email address"))
+		return
+	}
+
 	// Check if the username already exists in the database
 	count, err := s.db.CountUser(req.Username)
 	if err != nil {
@@ -43,6 +55,7 @@ func (s *Server) Register(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	if count > 0 {
+		s.audit(r, database.AuditEvent{Type: auditRegister, Outcome: database.AuditFailure, Reason: "username_taken", Username: req.Username})
 		http.Error(w, "Username already exists", http.StatusConflict)
 		return
 	}
@@ -61,21 +74,44 @@ func (s *Server) Register(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Return success response
-	w.WriteHeader(http.StatusCreated)
-	fmt.Println("userID ", userID)
-	tokenString, err := s.createToken(w, userID)
-	fmt.Println("token", tokenString)
+	s.audit(r, database.AuditEvent{Type: auditRegister, ActorId: userID, Username: req.Username})
+
+	// Send the verification link, usernames that are not email addresses can not be verified
+	if _, err := mail.ParseAddress(req.Username); err == nil {
+		if err := s.sendVerificationEmail(r, userID); err != nil {
+			s.reportServerError(r, err)
+		}
+	}
+
+	tokens, err := s.createToken(r, userID)
 	if err != nil {
-		http.Error(w, "Error creating token", http.StatusInternalServerError)
+		s.createTokenError(w, r, err)
 		return
 	}
-	// Return the token as a JSON response
-	w.Header().Set("Content-Type", "application/json")
-	err = json.NewEncoder(w).Encode(map[string]string{"message": "User registered successfully", "token": tokenString})
-	//err = json.NewEncoder(w).Encode(map[string]string{"message": "User registered successfully"})
+
+	if cookieMode(r) {
+		session, err := s.setSessionCookies(w, tokens)
+		if err != nil {
+			s.serverError(w, r, err)
+			return
+		}
+		err = response.JSON(w, http.StatusCreated, struct {
+			Message string `json:"message"`
+			*CookieSession
+		}{Message: "User registered successfully", CookieSession: session})
+		if err != nil {
+			s.serverError(w, r, err)
+		}
+		return
+	}
+
+	// Return success response with the token
+	err = response.JSON(w, http.StatusCreated, struct {
+		Message string `json:"message"`
+		*TokenPair
+	}{Message: "User registered successfully", TokenPair: tokens})
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		s.serverError(w, r, err)
 	}
 }
 
@@ -99,17 +135,27 @@ func (s *Server) NewLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Refuse locked out usernames and IPs before looking at the password
+	if !s.reserveLoginAttempt(w, r, req.Username) {
+		s.audit(r, database.AuditEvent{Type: auditLogin, Outcome: database.AuditFailure, Reason: auditReasonLockedOut, Username: req.Username})
+		return
+	}
+
 	// Retrieve the stored hashed password for the username
 	userID, hashedPassword, err := s.db.GetHashedPassword(req.Username)
 	if err != nil {
 		//http.Error(w, fmt.Sprintf("Error retrieving user: %v", err), http.StatusInternalServerError)
 		//http.Error(w, fmt.Sprintf("Invalid username or password"), http.StatusBadRequest)
+		s.recordLoginFailure(r, req.Username)
+		s.audit(r, database.AuditEvent{Type: auditLogin, Outcome: database.AuditFailure, Reason: auditReasonBadLogin, Username: req.Username})
 		s.badRequest(w, r, fmt.Errorf("invalid username or password"))
 		return
 	}
 
 	// If no user found
 	if hashedPassword == "" {
+		s.recordLoginFailure(r, req.Username)
+		s.audit(r, database.AuditEvent{Type: auditLogin, Outcome: database.AuditFailure, Reason: auditReasonBadLogin, Username: req.Username})
 		http.Error(w, "Invalid username or password", http.StatusUnauthorized)
 		return
 	}
@@ -119,33 +165,72 @@ func (s *Server) NewLogin(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		// Password does not match
 		//http.Error(w, "Invalid username or password", http.StatusUnauthorized)
+		s.recordLoginFailure(r, req.Username)
+		s.audit(r, database.AuditEvent{Type: auditLogin, Outcome: database.AuditFailure, Reason: auditReasonBadLogin, ActorId: userID, Username: req.Username})
 		s.badRequest(w, r, fmt.Errorf("invalid username or password"))
 		return
 	}
 
-	// Password matches, login is successful
-	w.WriteHeader(http.StatusOK)
-	fmt.Println("userId ", userID)
-	tokenString, err := s.createToken(w, userID)
-	fmt.Println("token ", tokenString)
+	// Users with two-factor authentication get a challenge to complete at /api/v1/login/mfa,
+	// the failure counter is only reset once that step succeeds, this attempt is not counted as a failure
+	totpConfig, err := s.db.GetTOTP(userID)
 	if err != nil {
-		http.Error(w, "Error creating token", http.StatusInternalServerError)
+		s.serverError(w, r, err)
+		return
+	}
+	if totpConfig.Enabled {
+		challenge, err := s.mfaChallenge(userID)
+		if err != nil {
+			s.serverError(w, r, err)
+			return
+		}
+		s.releaseLoginAttempt(r, req.Username)
+		s.audit(r, database.AuditEvent{
+			Type: auditLogin, ActorId: userID, Username: req.Username,
+			Details: map[string]any{"mfa_required": true},
+		})
+		err = response.JSON(w, http.StatusOK, challenge)
+		if err != nil {
+			s.serverError(w, r, err)
+		}
 		return
 	}
 
-	// Return the token as a JSON response
-	w.Header().Set("Content-Type", "application/json")
-	err = json.NewEncoder(w).Encode(map[string]string{"token": tokenString})
+	// Password matches, login is successful
+	s.recordLoginSuccess(r, req.Username)
+	if err := s.db.SetLastLoginProvider(userID, "web"); err != nil {
+		s.reportServerError(r, err)
+	}
+	s.audit(r, database.AuditEvent{Type: auditLogin, ActorId: userID, Username: req.Username})
+	tokens, err := s.createToken(r, userID)
 	if err != nil {
-		http.Error(w, "Error encoding response", http.StatusInternalServerError)
+		s.createTokenError(w, r, err)
+		return
 	}
+
+	// Return the token as a JSON response
+	s.writeSession(w, r, tokens)
 }
 
-// Logout handles the user logout process
+// Logout ends the session of the access token, with ?everywhere=true every session of the user
 func (s *Server) Logout(w http.ResponseWriter, r *http.Request) {
-	tokenString := extractTokenFromHeader(r)
+	principal, err := auth.FromContext(r.Context())
+	if err != nil {
+		s.unauthorized(w, r)
+		return
+	}
+
+	everywhere, err := s.logoutEverywhere(r, principal, r.Header.Get(csrfHeader))
+	if err != nil {
+		s.errorMessage(w, r, http.StatusForbidden, err.Error(), nil)
+		return
+	}
 
-	err := s.db.InvalidateToken(tokenString)
+	if err := s.endSession(r, everywhere, nil); err != nil {
+		s.serverError(w, r, err)
+		return
+	}
+	clearSessionCookies(w)
 
 	// Return the token as a JSON response
 	w.Header().Set("Content-Type", "application/json")
@@ -156,50 +241,68 @@ func (s *Server) Logout(w http.ResponseWriter, r *http.Request) {
 
 }
 
-func (s *Server) createToken(w http.ResponseWriter, userId string) (string, error) {
-	// Create JWT claims (you can add more claims as necessary)
-	claims := map[string]interface{}{
-		//"user_id": username, // or a real user ID
-		"user_id": userId,
+// createToken starts a new session for the user, subject to the user's session policy,
+// and returns its access and refresh tokens
+func (s *Server) createToken(r *http.Request, userId string) (*TokenPair, error) {
+	// Logging in during the grace period of an account deletion keeps the account
+	if err := s.cancelAccountDeletion(r, userId); err != nil {
+		return nil, err
 	}
 
-	// Set expiry and issued time for the token
-	jwtauth.SetExpiryIn(claims, time.Hour*15) // Token valid for 15 hours
-	jwtauth.SetIssuedNow(claims)
+	// Every login starts a new token family shared by its access and refresh tokens
+	familyId := uuid.NewString()
 
-	// Encode the claims into a signed JWT token
-	_, tokenString, err := tokenAuth.Encode(claims)
+	// Enforce the session policy and store the refresh token, only its digest is stored
+	refreshToken := generateOpaqueToken()
+	err := s.db.StartSession(userId, familyId, hashToken(refreshToken), time.Now().Add(refreshTokenTTL), sessionInfo(r))
 	if err != nil {
-		http.Error(w, "Error generating token", http.StatusInternalServerError)
-		return "", err
+		if errors.Is(err, database.ErrSessionLimitReached) {
+			s.audit(r, database.AuditEvent{Type: auditSessionCreated, Outcome: database.AuditFailure, Reason: "session_limit_reached", ActorId: userId})
+		}
+		return nil, err
 	}
+	s.audit(r, database.AuditEvent{Type: auditSessionCreated, ActorId: userId, Details: map[string]any{"session_id": familyId}})
 
-	// Check if user already has 2 valid tokens
-	tokenCount, err := s.db.GetValidTokenCount(userId)
+	// Sign the access token and insert it into the database
+	tokenString, err := s.issueAccessToken(userId, familyId)
 	if err != nil {
-		http.Error(w, "Error checking token count", http.StatusInternalServerError)
-		return "", err
+		return nil, err
 	}
 
-	// If user has 2 tokens, invalidate the oldest one
-	if tokenCount >= 2 {
-		err = s.db.InvalidateOldestToken(userId)
+	return &TokenPair{
+		AccessToken:  tokenString,
+		RefreshToken: refreshToken,
+		ExpiresIn:    int64(accessTokenTTL.Seconds()),
+		sessionId:    familyId,
+	}, nil
+}
+
+// writeSession sends the tokens of a new session, clients in cookie mode get them in cookies
+// and only receive the CSRF token
+func (s *Server) writeSession(w http.ResponseWriter, r *http.Request, tokens *TokenPair) {
+	var body any = tokens
+	if cookieMode(r) {
+		session, err := s.setSessionCookies(w, tokens)
 		if err != nil {
-			http.Error(w, "Error invalidating oldest token", http.StatusInternalServerError)
-			return "", err
+			s.serverError(w, r, err)
+			return
 		}
+		body = session
 	}
 
-	// Insert the new token into the database
-	expiresAt := time.Now().Add(time.Hour * 15)
-	err = s.db.InsertToken(userId, tokenString, expiresAt)
+	err := response.JSON(w, http.StatusOK, body)
 	if err != nil {
-		http.Error(w, "Error saving token", http.StatusInternalServerError)
-		return "", err
+		s.serverError(w, r, err)
 	}
+}
 
-	return tokenString, nil
-
+// createTokenError writes the response for a failed createToken
+func (s *Server) createTokenError(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, database.ErrSessionLimitReached) {
+		s.errorMessage(w, r, http.StatusConflict, "maximum number of active sessions reached, log out another session first", nil)
+		return
+	}
+	s.serverError(w, r, err)
 }
 
 // r.Use(s.authenticator(tokenAuth))
@@ -210,7 +313,16 @@ func (s *Server) createToken(w http.ResponseWriter, userId string) (string, erro
 func (s *Server) authenticator() func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		hfn := func(w http.ResponseWriter, r *http.Request) {
-			token, _, err := jwtauth.FromContext(r.Context())
+			// Scripts and CI jobs authenticate with "Authorization: ApiKey <key>" instead of a JWT
+			if key, ok := apiKeyFromHeader(r); ok {
+				r, ok = s.authenticateAPIKey(w, r, key)
+				if ok {
+					next.ServeHTTP(w, r)
+				}
+				return
+			}
+
+			token, claims, err := jwtauth.FromContext(r.Context())
 
 			if err != nil {
 				http.Error(w, err.Error(), http.StatusUnauthorized)
@@ -222,178 +334,299 @@ func (s *Server) authenticator() func(http.Handler) http.Handler {
 				return
 			}
 
-			// Extract token string from Authorization header
-			tokenString := extractTokenFromHeader(r)
-			if tokenString == "" {
-				http.Error(w, "Missing or invalid authorization token", http.StatusUnauthorized)
+			// The Verifier prefers a bearer token in the header over the jwt cookie
+			method := auth.MethodCookie
+			if jwtauth.TokenFromHeader(r) != "" {
+				method = auth.MethodBearer
+			}
+			principal, err := auth.FromClaims(claims, method)
+			if err != nil {
+				http.Error(w, "Malformed authorization token", http.StatusUnauthorized)
 				return
 			}
 
-			// Check if the token is valid in the database
-			valid, err := s.db.IsTokenValid(tokenString)
-			if err != nil {
-				http.Error(w, fmt.Sprintf("Error validating token %v", err), http.StatusInternalServerError)
+			// Tokens are revoked by their jti, tokens without one were not issued by us
+			jti := principal.TokenID
+			if jti == "" {
+				http.Error(w, "Missing or invalid authorization token", http.StatusUnauthorized)
 				return
 			}
 
+			// Check if the token is valid, the database is only asked when the cache does not know the token
+			valid, cached, epoch := s.tokenCache.get(jti)
+			if !cached {
+				valid, err = s.db.IsTokenValid(jti)
+				if err != nil {
+					http.Error(w, fmt.Sprintf("Error validating token %v", err), http.StatusInternalServerError)
+					return
+				}
+				s.tokenCache.add(jti, principal.UserID, valid, token.Expiration(), epoch)
+			}
+
 			if !valid {
 				http.Error(w, "Invalid or expired token", http.StatusUnauthorized)
 				return
 			}
 
-			// Token is authenticated, pass it through
-			next.ServeHTTP(w, r)
+			// Token is authenticated, pass its principal through
+			next.ServeHTTP(w, r.WithContext(auth.NewContext(r.Context(), principal)))
 		}
 		return http.HandlerFunc(hfn)
 	}
 }
-func extractTokenFromHeader(r *http.Request) string {
-	bearToken := r.Header.Get("Authorization")
-	strArr := strings.Split(bearToken, " ")
-	if len(strArr) == 2 {
-		return strArr[1]
-	}
-	return ""
-}
 
 func (s *Server) getAuthCallbackFunction(w http.ResponseWriter, r *http.Request) {
 	provider := chi.URLParam(r, "provider")
 	r = r.WithContext(context.WithValue(context.Background(), "provider", provider))
+
+	// The provider reports a refused consent screen with ?error=
+	if providerErr := r.URL.Query().Get("error"); providerErr != "" {
+		code := oauthErrProvider
+		if providerErr == "access_denied" {
+			code = oauthErrAccessDenied
+		}
+		s.oauthRedirectError(w, r, code, fmt.Errorf("provider returned %s", providerErr))
+		return
+	}
+
+	var state oauthState
+	if err := s.signer.Verify(purposeOAuthState, r.URL.Query().Get("state"), &state); err != nil {
+		s.oauthRedirectError(w, r, oauthErrInvalidState, err)
+		return
+	}
+
 	user, err := gothic.CompleteUserAuth(w, r)
 	if err != nil {
 		log.Printf("error in user authentication %v : %v", provider, err)
-		fmt.Fprintln(w, err)
+		s.oauthRedirectError(w, r, oauthErrProvider, err)
 		return
 	}
-	postJsonBytes, err := json.MarshalIndent(user, "", "    ")
-	// postJsonBytes, err := JSONMarshal(postJson, "", "    ")
-	if err != nil {
-		fmt.Fprintln(w, err)
-	}
-	fmt.Println(string(postJsonBytes))
 	//http.Redirect(w, r, "http://localhost:3000/movies/dashboard", http.StatusFound)
-	tokenString, err := s.RegisterOrLogin(w, user.Email, user.AvatarURL)
+	identity := identityFromGothUser(user)
+
+	// Linking an account to the logged-in user started with POST /api/p/v1/identities/{provider}
+	if state.LinkUserId != "" {
+		if err := s.checkLinkState(r, state); err != nil {
+			s.oauthRedirectError(w, r, oauthErrInvalidState, err)
+			return
+		}
+		clearLinkCookie(w)
+		err = s.db.LinkIdentity(state.LinkUserId, identity)
+		if err != nil {
+			s.oauthRedirectError(w, r, oauthLoginErrorCode(err), err)
+			return
+		}
+		http.Redirect(w, r, state.ReturnTo, http.StatusFound)
+		return
+	}
+
+	tokens, err := s.RegisterOrLogin(r, identity, providerEmailVerified(user))
 	if err != nil {
-		// TODO: redirect to proper page with a error message in query params
-		http.Error(w, fmt.Sprintf("Error creating token: %v", err), http.StatusInternalServerError)
+		s.oauthRedirectError(w, r, oauthLoginErrorCode(err), err)
 		return
 	}
 
-	// Create and set the cookie
-	cookie := &http.Cookie{
-		Name:   "token",
-		Value:  tokenString,
-		Path:   "/",
-		MaxAge: 86400, // 24 hours in seconds
-		//HttpOnly: true,  // Cannot be accessed by JavaScript (more secure)
-		HttpOnly: false, // Cannot be accessed by JavaScript (more secure)
-		Secure:   true,  // Only sent over HTTPS
-		SameSite: http.SameSiteLaxMode,
-		Domain:   "localhost", // Change this in production
+	if _, err := s.setSessionCookies(w, tokens); err != nil {
+		s.oauthRedirectError(w, r, oauthErrServerError, err)
+		return
 	}
-	http.SetCookie(w, cookie)
 
-	http.Redirect(w, r, "http://localhost:3000/", http.StatusFound)
+	http.Redirect(w, r, state.ReturnTo, http.StatusFound)
 }
 
+// beginAuthProvideCallback redirects to the provider's consent screen. The page to return to
+// afterwards is given in ?return_to= and has to match OAUTH_ALLOWED_REDIRECTS.
 func (s *Server) beginAuthProvideCallback(w http.ResponseWriter, r *http.Request) {
 
 	provider := chi.URLParam(r, "provider")
 
 	r = r.WithContext(context.WithValue(context.Background(), "provider", provider))
 
+	if _, err := goth.GetProvider(provider); err != nil {
+		s.oauthRedirectError(w, r, oauthErrUnknownProvider, err)
+		return
+	}
+
+	returnTo, ok := resolveReturnTo(r.URL.Query().Get("return_to"))
+	if !ok {
+		s.oauthRedirectError(w, r, oauthErrInvalidRedirect, fmt.Errorf("return_to %q is not allowed", r.URL.Query().Get("return_to")))
+		return
+	}
+
+	// Links started with POST /api/p/v1/identities/{provider} carry the user in the link cookie
+	var link *linkIdentityClaims
+	if r.URL.Query().Get("link") == "true" {
+		var err error
+		link, err = s.linkFromCookie(r)
+		if err != nil {
+			s.oauthRedirectError(w, r, oauthErrInvalidRequest, err)
+			return
+		}
+	}
+
+	state, err := s.newOAuthState(returnTo, link)
+	if err != nil {
+		s.oauthRedirectError(w, r, oauthErrServerError, err)
+		return
+	}
+
+	// gothic uses the state query parameter when present instead of generating one
+	query := r.URL.Query()
+	query.Set("state", state)
+	r.URL.RawQuery = query.Encode()
+
 	gothic.BeginAuthHandler(w, r)
 }
 
+// logOutProvider is the logout of browser sessions, such as the ones started through an OAuth provider.
+// It ends the session of the cookies, or with ?everywhere=true every session of the user, clears the
+// provider session and the cookies, and redirects to LOGOUT_REDIRECT_URL or an allow-listed ?return_to=.
+// Logging out everywhere needs a POST with the CSRF token in the X-CSRF-Token header or a csrf_token field.
 func (s *Server) logOutProvider(w http.ResponseWriter, r *http.Request) {
 	provider := chi.URLParam(r, "provider")
 
-	r = r.WithContext(context.WithValue(context.Background(), "provider", provider))
+	r = r.WithContext(context.WithValue(r.Context(), "provider", provider))
 
-	gothic.Logout(w, r)
-	w.Header().Set("Location", "http://localhost:3000/movies/login")
-	w.WriteHeader(http.StatusTemporaryRedirect)
-}
+	target := logoutRedirectURL
+	if returnTo := r.URL.Query().Get("return_to"); returnTo != "" {
+		resolved, ok := resolveReturnTo(returnTo)
+		if !ok {
+			s.oauthRedirectError(w, r, oauthErrInvalidRedirect, fmt.Errorf("return_to %q is not allowed", returnTo))
+			return
+		}
+		target = resolved
+	}
+
+	r = s.sessionFromCookies(r)
 
-func (s *Server) RegisterOrLogin(w http.ResponseWriter, username string, userImage string) (string, error) {
-	if strings.TrimSpace(username) == "" {
-		return "", fmt.Errorf("Invalid username")
+	var csrfToken string
+	if r.Method == http.MethodPost {
+		csrfToken = r.Header.Get(csrfHeader)
+		if csrfToken == "" {
+			csrfToken = r.PostFormValue(csrfCookie)
+		}
 	}
-	count, err := s.db.CountUser(username)
+	// Without a session in the cookies there is nothing to end, but the cookies are still cleared
+	principal, _ := auth.FromContext(r.Context())
+	everywhere, err := s.logoutEverywhere(r, principal, csrfToken)
 	if err != nil {
-		//http.Error(w, fmt.Sprintf("Error checking username availability: %v", err), http.StatusInternalServerError)
-		return "", err
+		s.errorMessage(w, r, http.StatusForbidden, err.Error(), nil)
+		return
 	}
 
-	userID := ""
-	if count > 0 {
-		// signin in the user
-		// Retrieve the stored hashed password for the username
-		userID, _, err = s.db.GetHashedPassword(username)
-		if err != nil {
-			return "", err
-		}
+	if err := s.endSession(r, everywhere, map[string]any{"provider": provider}); err != nil {
+		s.serverError(w, r, err)
+		return
+	}
 
-	} else { // registering the user for the first time
+	if err := gothic.Logout(w, r); err != nil {
+		s.reportServerError(r, err)
+	}
+	clearSessionCookies(w)
 
-		randomPassword := generateSecureRandomString(12)
-		hashedPassword, err := bcrypt.GenerateFromPassword([]byte(randomPassword), bcrypt.DefaultCost)
-		if err != nil {
-			return "", err
-		}
+	http.Redirect(w, r, target, http.StatusSeeOther)
+}
+
+// RegisterOrLogin logs in the user the OAuth identity is linked to, or registers a new user for it.
+// Existing accounts are never matched on the email address, their owner has to link the identity
+// while logged in, otherwise anyone controlling an OAuth account with that email could take them over.
+func (s *Server) RegisterOrLogin(r *http.Request, identity *database.Identity, emailVerified bool) (*TokenPair, error) {
+	userID, registered, err := s.registerOrLoginIdentity(identity, emailVerified)
+	if err != nil {
+		s.audit(r, database.AuditEvent{
+			Type: auditOAuthLogin, Outcome: database.AuditFailure, Reason: oauthLoginErrorCode(err), Username: identity.Email,
+			Details: map[string]any{"provider": identity.Provider},
+		})
+		return nil, err
+	}
+	s.audit(r, database.AuditEvent{
+		Type: auditOAuthLogin, ActorId: userID, Username: identity.Email,
+		Details: map[string]any{"provider": identity.Provider, "registered": registered},
+	})
+
+	tokens, err := s.createToken(r, userID)
+	if err != nil {
+		return nil, err
+	}
 
-		// Insert the new user into the database
-		userID, err = s.db.InsertUserByUsernameAndPassword(username, string(hashedPassword))
+	return tokens, nil
+}
+
+// legacyOAuthProviders are the providers of the OAuth login from before identities existed
+var legacyOAuthProviders = []string{"google", "github"}
+
+// registerOrLoginIdentity returns the user the identity belongs to and whether it was registered just now
+func (s *Server) registerOrLoginIdentity(identity *database.Identity, emailVerified bool) (string, bool, error) {
+	userID, err := s.db.LoginWithIdentity(identity)
+	if err != nil {
+		return "", false, err
+	}
+
+	// Accounts the OAuth login registered before identities existed are claimed by a verified email.
+	// That login only offered these providers, other ones never created such an account.
+	if userID == "" && emailVerified && strings.TrimSpace(identity.Email) != "" && slices.Contains(legacyOAuthProviders, identity.Provider) {
+		userID, err = s.db.LinkLegacyOAuthUser(identity)
 		if err != nil {
-			return "", err
+			return "", false, err
 		}
+	}
 
-		if strings.TrimSpace(userImage) != "" {
-			err = s.db.UpdateUserImageById(userImage, userID)
+	registered := false
+	if userID == "" { // registering the user for the first time
+		if strings.TrimSpace(identity.Email) == "" {
+			return "", false, errEmailMissing
 		}
+		userID, err = s.db.CreateUserWithIdentity(identity.Email, identity)
 		if err != nil {
-			return "", err
+			return "", false, err
 		}
-
-	}
-	if strings.TrimSpace(userID) == "" {
-		return "", fmt.Errorf("invalid username or password")
+		registered = true
 	}
 
-	// Return success response
-	fmt.Println("userID ", userID)
-	tokenString, err := s.createToken(w, userID)
-	fmt.Println("token", tokenString)
-
-	if err != nil {
-		return "", err
-	}
-
-	return tokenString, nil
-}
-
-// Secure method using crypto/rand
-func generateSecureRandomString(length int) string {
-	const charset = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
-	b := make([]byte, length)
-	rand.Read(b)
-	for i := range b {
-		b[i] = charset[b[i]%byte(len(charset))]
+	// The provider already verified the address
+	if emailVerified {
+		if _, err := s.db.MarkEmailVerified(userID, identity.Email); err != nil {
+			return "", false, err
+		}
 	}
-	return string(b)
+	return userID, registered, nil
 }
 
 func (s *Server) GetUserDetailsByUserId(w http.ResponseWriter, r *http.Request) {
-	_, claims, _ := jwtauth.FromContext(r.Context())
-	//message := fmt.Sprintf("protected area. hi %v", claims["user_id"])
-	userId := claims["user_id"].(string)
+	principal, err := auth.FromContext(r.Context())
+	if err != nil {
+		s.unauthorized(w, r)
+		return
+	}
+	//message := fmt.Sprintf("protected area. hi %v", principal.UserID)
+	userId := principal.UserID
 
 	user, err := s.db.GetUserById(userId)
 	if err != nil {
 		s.badRequest(w, r, err)
+		return
 	}
-	err = response.JSON(w, http.StatusOK, user)
+
+	resp := UserDetailsResp{User: user}
+	if principal.Impersonator != "" {
+		resp.Impersonated = true
+		resp.Impersonation, err = s.db.GetImpersonationBySession(principal.SessionID)
+		if err != nil {
+			s.serverError(w, r, err)
+			return
+		}
+	}
+
+	err = response.JSON(w, http.StatusOK, resp)
 	if err != nil {
 		s.serverError(w, r, err)
 	}
 }
+
+// UserDetailsResp is the logged-in user. Impersonated tells the frontend to show a banner,
+// the session belongs to an admin acting as the user.
+type UserDetailsResp struct {
+	*database.User
+	Impersonated  bool                    `json:"impersonated"`
+	Impersonation *database.Impersonation `json:"impersonation,omitempty"`
+}
@@ -0,0 +1,134 @@
+package server
+
+import (
+	"errors"
+	"github.com/go-chi/jwtauth/v5"
+	"net/http"
+	"net/http/httptest"
+	"new_project/internal/database"
+	"testing"
+)
+
+func TestAuthenticatorRejectsTokenWithoutJti(t *testing.T) {
+	s := &Server{}
+	tokenAuth := jwtauth.New("HS256", []byte("secret"), nil)
+	handler := s.authenticator()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	// Tokens without a jti cannot be looked up or revoked, so the database is never asked
+	token, _, err := tokenAuth.Encode(map[string]interface{}{"user_id": "u1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/api/p/v1/user", nil)
+	req = req.WithContext(jwtauth.NewContext(req.Context(), token, nil))
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected status %d, got %d", http.StatusUnauthorized, rr.Code)
+	}
+}
+
+func TestAuthenticatorRejectsMalformedClaims(t *testing.T) {
+	s := &Server{}
+	tokenAuth := jwtauth.New("HS256", []byte("secret"), nil)
+	handler := s.authenticator()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	// A numeric user_id is rejected before the token is looked up
+	token, _, err := tokenAuth.Encode(map[string]interface{}{"user_id": 123, "jti": "token-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/api/p/v1/user", nil)
+	req = req.WithContext(jwtauth.NewContext(req.Context(), token, nil))
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected status %d, got %d", http.StatusUnauthorized, rr.Code)
+	}
+}
+
+// identityDB knows one account registered by the OAuth login before identities existed
+type identityDB struct {
+	database.Service
+	legacyUsername, legacyID string
+}
+
+func (db *identityDB) LoginWithIdentity(identity *database.Identity) (string, error) {
+	return "", nil
+}
+
+func (db *identityDB) LinkLegacyOAuthUser(identity *database.Identity) (string, error) {
+	if identity.Email == db.legacyUsername {
+		return db.legacyID, nil
+	}
+	return "", nil
+}
+
+func (db *identityDB) CreateUserWithIdentity(username string, identity *database.Identity) (string, error) {
+	if username == db.legacyUsername {
+		return "", database.ErrUsernameTaken
+	}
+	return "new-user", nil
+}
+
+func (db *identityDB) MarkEmailVerified(userId, email string) (bool, error) {
+	return true, nil
+}
+
+func TestRegisterOrLoginLegacyAccount(t *testing.T) {
+	s := &Server{db: &identityDB{legacyUsername: "old@example.com", legacyID: "u1"}}
+	identity := &database.Identity{Provider: "google", ProviderUserId: "g-1", Email: "old@example.com"}
+
+	userID, registered, err := s.registerOrLoginIdentity(identity, true)
+	if err != nil || userID != "u1" || registered {
+		t.Errorf("expected the existing account u1 to log in, got %q, registered %t (%v)", userID, registered, err)
+	}
+
+	// Without a verified email the account cannot be claimed
+	if _, _, err := s.registerOrLoginIdentity(identity, false); !errors.Is(err, database.ErrUsernameTaken) {
+		t.Errorf("expected ErrUsernameTaken for an unverified email, got %v", err)
+	}
+
+	// Providers added since then cannot claim the old accounts
+	other := &database.Identity{Provider: "gitlab", ProviderUserId: "l-1", Email: "old@example.com"}
+	if _, _, err := s.registerOrLoginIdentity(other, true); !errors.Is(err, database.ErrUsernameTaken) {
+		t.Errorf("expected ErrUsernameTaken for another provider, got %v", err)
+	}
+
+	identity = &database.Identity{Provider: "google", ProviderUserId: "g-2", Email: "new@example.com"}
+	userID, registered, err = s.registerOrLoginIdentity(identity, true)
+	if err != nil || userID != "new-user" || !registered {
+		t.Errorf("expected a new account, got %q, registered %t (%v)", userID, registered, err)
+	}
+}
+
+type roleDB struct {
+	database.Service
+	roles map[string]bool
+}
+
+func (db *roleDB) GetRole(name string) (*database.Role, error) {
+	if !db.roles[name] {
+		return nil, database.ErrRoleNotFound
+	}
+	return &database.Role{Name: name}, nil
+}
+
+func TestCheckMappedRoles(t *testing.T) {
+	db := &roleDB{roles: map[string]bool{"USER": true, "ADMIN": true}}
+	if err := checkMappedRoles(db, []string{"ADMIN", "USER"}); err != nil {
+		t.Errorf("expected existing roles to pass, got %v", err)
+	}
+	if err := checkMappedRoles(db, nil); err != nil {
+		t.Errorf("expected no roles to pass, got %v", err)
+	}
+	if err := checkMappedRoles(db, []string{"ADMIN", "ADMINS"}); err == nil {
+		t.Error("expected an error for a role that does not exist")
+	}
+}
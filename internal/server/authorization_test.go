@@ -0,0 +1,65 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"new_project/internal/auth"
+	"testing"
+)
+
+func TestRequireRole(t *testing.T) {
+	s := &Server{}
+	handler := s.RequireRole("ADMIN")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	tests := map[string]int{
+		"ADMIN": http.StatusNoContent,
+		"USER":  http.StatusForbidden,
+	}
+	for role, want := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/admin", nil)
+		req = req.WithContext(auth.NewContext(req.Context(), &auth.Principal{UserID: "u1", Role: role}))
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != want {
+			t.Errorf("%s: expected status %d, got %d", role, want, rr.Code)
+		}
+	}
+}
+
+func TestRequirePermission(t *testing.T) {
+	s := &Server{}
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	tests := map[string]int{
+		"animals:write": http.StatusNoContent,
+		"roles:manage":  http.StatusForbidden,
+	}
+	for permission, want := range tests {
+		// The permissions cached by an earlier check are used without going to the database
+		handler := s.RequirePermission("admin:access")(s.RequirePermission(permission)(ok))
+		req := httptest.NewRequest(http.MethodGet, "/admin", nil)
+		req = req.WithContext(context.WithValue(req.Context(), permissionsCtxKey{}, map[string]bool{
+			"admin:access":  true,
+			"animals:write": true,
+		}))
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != want {
+			t.Errorf("%s: expected status %d, got %d", permission, want, rr.Code)
+		}
+		if want == http.StatusForbidden {
+			var body map[string]string
+			if err := json.NewDecoder(rr.Body).Decode(&body); err != nil || body["message"] == "" {
+				t.Errorf("%s: expected a JSON error message, got %q", permission, rr.Body.String())
+			}
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+)
+
+// backgroundTask runs fn in a goroutine tracked by the server wait group.
+// Errors and panics are reported like server errors of the request that started the task.
+func (s *Server) backgroundTask(r *http.Request, fn func() error) {
+	s.wg.Add(1)
+
+	go func() {
+		defer s.wg.Done()
+
+		defer func() {
+			if err := recover(); err != nil {
+				s.reportServerError(r, fmt.Errorf("%s", err))
+			}
+		}()
+
+		if err := fn(); err != nil {
+			s.reportServerError(r, err)
+		}
+	}()
+}
+
+// Wait blocks until every background task finished, or until ctx is done. Call it once the HTTP server
+// was shut down, so that no request starts another task.
+func (s *Server) Wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
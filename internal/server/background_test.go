@@ -0,0 +1,30 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWait(t *testing.T) {
+	s := &Server{}
+	release := make(chan struct{})
+	s.backgroundTask(httptest.NewRequest(http.MethodPost, "/", nil), func() error {
+		<-release
+		return nil
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := s.Wait(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected Wait to give up on a running task, got %v", err)
+	}
+
+	close(release)
+	if err := s.Wait(context.Background()); err != nil {
+		t.Errorf("expected Wait to return once the task finished, got %v", err)
+	}
+}
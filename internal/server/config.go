@@ -0,0 +1,151 @@
+package server
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// accessTokenTTL is the lifetime of the JWT handed out on login and refresh
+	accessTokenTTL = envDuration("ACCESS_TOKEN_TTL", 15*time.Minute)
+	// refreshTokenTTL is the lifetime of a refresh token, every rotation starts a new one
+	refreshTokenTTL = envDuration("REFRESH_TOKEN_TTL", 30*24*time.Hour)
+	// tokenCacheSize is the number of access tokens whose validity is kept in memory, 0 disables the cache
+	tokenCacheSize = envInt("TOKEN_CACHE_SIZE", 10000)
+	// tokenCacheTTL is the longest a token stays cached, a safety net in case a revocation notification is lost
+	tokenCacheTTL = envDuration("TOKEN_CACHE_TTL", time.Minute)
+
+	// passwordResetTTL is how long a password reset link stays usable
+	passwordResetTTL = envDuration("PASSWORD_RESET_TTL", time.Hour)
+	// passwordResetURL is the frontend page the reset link points to, the token is appended as a query parameter
+	passwordResetURL = envString("PASSWORD_RESET_URL", "http://localhost:3000/reset-password")
+	// passwordResetResendInterval is the minimum time between two reset links sent to the same user
+	passwordResetResendInterval = envDuration("PASSWORD_RESET_RESEND_INTERVAL", time.Minute)
+
+	// magicLinkEnabled turns passwordless login through emailed links on or off
+	magicLinkEnabled = envBool("MAGIC_LINK_ENABLED", true)
+	// magicLinkURL is the frontend page of magic login links, it posts the token to /api/v1/login/magic/verify
+	magicLinkURL = envString("MAGIC_LINK_URL", "http://localhost:3000/magic-login")
+	// magicLinkTTL is the lifetime of a magic login link
+	magicLinkTTL = envDuration("MAGIC_LINK_TTL", 15*time.Minute)
+	// magicLinkResendInterval is the minimum time between two magic links sent to the same user
+	magicLinkResendInterval = envDuration("MAGIC_LINK_RESEND_INTERVAL", time.Minute)
+
+	// emailVerificationURL is the frontend page the verification link points to
+	emailVerificationURL = envString("EMAIL_VERIFICATION_URL", "http://localhost:3000/verify-email")
+	// emailVerificationTTL is how long a verification link stays usable
+	emailVerificationTTL = envDuration("EMAIL_VERIFICATION_TTL", 48*time.Hour)
+	// emailVerificationResendInterval is the minimum time between two verification emails to the same user
+	emailVerificationResendInterval = envDuration("EMAIL_VERIFICATION_RESEND_INTERVAL", 5*time.Minute)
+	// requireVerifiedEmail blocks users that did not verify their email from the /api/p/v1 routes
+	requireVerifiedEmail = envBool("REQUIRE_VERIFIED_EMAIL", false)
+
+	// totpIssuer is the account issuer shown in authenticator apps
+	totpIssuer = envString("TOTP_ISSUER", "new_project")
+	// mfaChallengeTTL is how long the second login step may take
+	mfaChallengeTTL = envDuration("MFA_CHALLENGE_TTL", 5*time.Minute)
+
+	// impersonationTTL is the lifetime of the token an admin gets to act as another user
+	impersonationTTL = envDuration("IMPERSONATION_TTL", 15*time.Minute)
+
+	// usernameReservationPeriod is how long a username given up by a rename stays reserved for its previous owner
+	usernameReservationPeriod = envDuration("USERNAME_RESERVATION_PERIOD", 30*24*time.Hour)
+
+	// accountDeletionGracePeriod is how long a deleted account can still be restored by logging in
+	accountDeletionGracePeriod = envDuration("ACCOUNT_DELETION_GRACE_PERIOD", 30*24*time.Hour)
+
+	// oauthRedirectURL is where the browser lands after an OAuth login when no return_to was given
+	oauthRedirectURL = envString("OAUTH_REDIRECT_URL", "http://localhost:3000/")
+	// oauthErrorURL is the frontend page failed OAuth logins redirect to, with an error code in ?error=
+	oauthErrorURL = envString("OAUTH_ERROR_URL", "http://localhost:3000/login")
+	// oauthAllowedRedirects lists the URL prefixes return_to may point to, only the origin of oauthRedirectURL when empty
+	oauthAllowedRedirects = envList("OAUTH_ALLOWED_REDIRECTS")
+	// logoutRedirectURL is where the browser lands after /logout/{provider} when no return_to was given
+	logoutRedirectURL = envString("LOGOUT_REDIRECT_URL", "http://localhost:3000/movies/login")
+
+	// cookieDomain is the Domain of the token cookies, they are host-only when empty
+	cookieDomain = envString("COOKIE_DOMAIN", "")
+	// cookieSecure limits the token cookies to HTTPS, browsers make an exception for localhost
+	cookieSecure = envBool("COOKIE_SECURE", true)
+	// corsAllowedOrigins lists the frontends allowed to make credentialed requests in cookie mode
+	corsAllowedOrigins = envList("CORS_ALLOWED_ORIGINS")
+
+	// loginMaxFailures is the number of failed logins after which a username is locked
+	loginMaxFailures = envInt("LOGIN_MAX_FAILURES", 5)
+	// loginIPMaxFailures is the number of failed logins after which a client IP is locked
+	loginIPMaxFailures = envInt("LOGIN_IP_MAX_FAILURES", 20)
+	// loginFailureWindow is how long a failed login counts, the counter restarts after a quiet period this long
+	loginFailureWindow = envDuration("LOGIN_FAILURE_WINDOW", 15*time.Minute)
+	// loginLockoutDuration is how long a locked username or IP has to wait
+	loginLockoutDuration = envDuration("LOGIN_LOCKOUT_DURATION", 15*time.Minute)
+	// loginDelayAfter is the number of failures after which every further attempt has to wait, doubling each time
+	loginDelayAfter = envInt("LOGIN_DELAY_AFTER", 3)
+	// loginMaxDelay caps the wait between two attempts before the lockout kicks in
+	loginMaxDelay = envDuration("LOGIN_MAX_DELAY", 30*time.Second)
+)
+
+// envString reads a string from the environment, falling back to def when the variable is unset
+func envString(key string, def string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return def
+}
+
+// envList reads a comma separated list from the environment
+func envList(key string) []string {
+	var list []string
+	for _, item := range strings.Split(os.Getenv(key), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// envBool reads a boolean such as "true" or "0" from the environment,
+// falling back to def when the variable is unset or invalid.
+func envBool(key string, def bool) bool {
+	value := os.Getenv(key)
+	if value == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Printf("invalid boolean %q for %s, using %t", value, key, def)
+		return def
+	}
+	return b
+}
+
+// envInt reads an integer from the environment, falling back to def when the variable is unset or invalid
+func envInt(key string, def int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return def
+	}
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		log.Printf("invalid integer %q for %s, using %d", value, key, def)
+		return def
+	}
+	return i
+}
+
+// envDuration reads a duration such as "15m" or "720h" from the environment,
+// falling back to def when the variable is unset or invalid.
+func envDuration(key string, def time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return def
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Printf("invalid duration %q for %s, using %s", value, key, def)
+		return def
+	}
+	return d
+}
@@ -0,0 +1,189 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/markbates/goth"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"new_project/internal/auth"
+	"new_project/internal/database"
+	"new_project/internal/mailer"
+	"new_project/internal/response"
+	"new_project/internal/signing"
+	"time"
+)
+
+// purposeVerifyEmail binds signed verification links to this flow
+const purposeVerifyEmail = "verify-email"
+
+type emailVerificationClaims struct {
+	UserId string `json:"user_id"`
+	Email  string `json:"email"`
+}
+
+// VerifyEmailRequest represents the data needed to verify an email address
+type VerifyEmailRequest struct {
+	Token string `json:"token"`
+}
+
+// VerifyEmail marks the address of the user as verified using the token of a verification link
+func (s *Server) VerifyEmail(w http.ResponseWriter, r *http.Request) {
+	var req VerifyEmailRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.badRequest(w, r, err)
+		return
+	}
+
+	var claims emailVerificationClaims
+	err := s.signer.Verify(purposeVerifyEmail, req.Token, &claims)
+	if err != nil {
+		if errors.Is(err, signing.ErrExpired) {
+			s.badRequest(w, r, fmt.Errorf("verification link has expired, please request a new one"))
+			return
+		}
+		s.badRequest(w, r, fmt.Errorf("invalid verification link"))
+		return
+	}
+
+	// The link only verifies the address it was sent to
+	found, err := s.db.MarkEmailVerified(claims.UserId, claims.Email)
+	if err != nil {
+		s.serverError(w, r, err)
+		return
+	}
+	if !found {
+		s.badRequest(w, r, fmt.Errorf("invalid verification link"))
+		return
+	}
+
+	err = response.JSON(w, http.StatusOK, struct {
+		Message string `json:"message"`
+	}{Message: "email verified"})
+	if err != nil {
+		s.serverError(w, r, err)
+	}
+}
+
+// ResendVerificationEmail sends a new verification link to the logged-in user, at most once per resend interval
+func (s *Server) ResendVerificationEmail(w http.ResponseWriter, r *http.Request) {
+	principal, err := auth.FromContext(r.Context())
+	if err != nil {
+		s.unauthorized(w, r)
+		return
+	}
+	userId := principal.UserID
+
+	err = s.sendVerificationEmail(r, userId)
+	switch {
+	case errors.Is(err, database.ErrEmailAlreadyVerified):
+		s.errorMessage(w, r, http.StatusConflict, err.Error(), nil)
+		return
+	case errors.Is(err, database.ErrVerificationThrottled):
+		headers := http.Header{}
+		headers.Set("Retry-After", fmt.Sprintf("%.0f", emailVerificationResendInterval.Seconds()))
+		s.errorMessage(w, r, http.StatusTooManyRequests, err.Error(), headers)
+		return
+	case err != nil:
+		s.badRequest(w, r, err)
+		return
+	}
+
+	err = response.JSON(w, http.StatusAccepted, struct {
+		Message string `json:"message"`
+	}{Message: "verification email sent"})
+	if err != nil {
+		s.serverError(w, r, err)
+	}
+}
+
+// sendVerificationEmail emails a signed verification link to the user in the background
+func (s *Server) sendVerificationEmail(r *http.Request, userId string) error {
+	email, err := s.db.MarkVerificationEmailSent(userId, emailVerificationResendInterval)
+	if err != nil {
+		return err
+	}
+	if _, err := mail.ParseAddress(email); err != nil {
+		return fmt.Errorf("username %q is not an email address", email)
+	}
+
+	token, err := s.signer.Sign(purposeVerifyEmail, emailVerificationClaims{UserId: userId, Email: email}, emailVerificationTTL)
+	if err != nil {
+		return err
+	}
+
+	link, err := url.Parse(emailVerificationURL)
+	if err != nil {
+		return err
+	}
+	query := link.Query()
+	query.Set("token", token)
+	link.RawQuery = query.Encode()
+
+	s.backgroundTask(r, func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		return s.mailer.Send(ctx, mailer.Message{
+			To:      email,
+			Subject: "Verify your email address",
+			Body: fmt.Sprintf("Please confirm that this is your email address by opening the link below. "+
+				"It expires in %s.\n\n%s\n\nIf you did not create an account, you can ignore this email.\n", emailVerificationTTL, link),
+		})
+	})
+	return nil
+}
+
+// requireVerifiedEmailMiddleware blocks users that did not verify their email address,
+// it only has an effect when REQUIRE_VERIFIED_EMAIL is enabled
+func (s *Server) requireVerifiedEmailMiddleware() func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		hfn := func(w http.ResponseWriter, r *http.Request) {
+			if !requireVerifiedEmail {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			principal, err := auth.FromContext(r.Context())
+			if err != nil {
+				s.unauthorized(w, r)
+				return
+			}
+			userId := principal.UserID
+
+			verified, err := s.db.IsEmailVerified(userId)
+			if err != nil {
+				s.serverError(w, r, err)
+				return
+			}
+			if !verified {
+				s.errorMessage(w, r, http.StatusForbidden, "please verify your email address first", nil)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		}
+		return http.HandlerFunc(hfn)
+	}
+}
+
+// providerEmailVerified reports whether the OAuth provider vouches for the email of the user
+func providerEmailVerified(user goth.User) bool {
+	// GitHub only exposes verified addresses, either the public one or the verified primary one
+	if user.Provider == "github" {
+		return user.Email != ""
+	}
+
+	// Google userinfo v2 uses verified_email, OpenID Connect uses email_verified
+	for _, key := range []string{"email_verified", "verified_email"} {
+		switch v := user.RawData[key].(type) {
+		case bool:
+			return v
+		case string:
+			return v == "true"
+		}
+	}
+	return false
+}
@@ -43,6 +43,16 @@ func (app *Server) notFound(w http.ResponseWriter, r *http.Request) {
 	app.errorMessage(w, r, http.StatusNotFound, message, nil)
 }
 
+func (app *Server) unauthorized(w http.ResponseWriter, r *http.Request) {
+	message := "You must be authenticated to access this resource"
+	app.errorMessage(w, r, http.StatusUnauthorized, message, nil)
+}
+
+func (app *Server) forbidden(w http.ResponseWriter, r *http.Request) {
+	message := "You do not have permission to perform this action"
+	app.errorMessage(w, r, http.StatusForbidden, message, nil)
+}
+
 func (app *Server) methodNotAllowed(w http.ResponseWriter, r *http.Request) {
 	message := fmt.Sprintf("The %s method is not supported for this resource", r.Method)
 	app.errorMessage(w, r, http.StatusMethodNotAllowed, message, nil)
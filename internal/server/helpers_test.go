@@ -0,0 +1,28 @@
+package server
+
+import (
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/lestrrat-go/jwx/v2/jwk"
+	"new_project/internal/jwtkeys"
+	"testing"
+)
+
+// testKeyRing returns a key ring signing with a HS256 test secret
+func testKeyRing(t *testing.T) *jwtkeys.KeyRing {
+	t.Helper()
+	key, err := jwk.FromRaw([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := key.Set(jwk.KeyIDKey, "test"); err != nil {
+		t.Fatal(err)
+	}
+	if err := key.Set(jwk.AlgorithmKey, jwa.HS256); err != nil {
+		t.Fatal(err)
+	}
+	ring, err := jwtkeys.New("", key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ring
+}
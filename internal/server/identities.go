@@ -0,0 +1,179 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"github.com/markbates/goth"
+	"net/http"
+	"net/url"
+	"new_project/internal/auth"
+	"new_project/internal/authenticate"
+	"new_project/internal/database"
+	"new_project/internal/response"
+	"time"
+)
+
+// purposeLinkIdentity binds the token of a link flow to /auth/{provider}
+const purposeLinkIdentity = "link-identity"
+
+// linkIdentityCookie carries the link token to /auth/{provider} and its callback. Being HttpOnly and
+// set for the browser that asked for the link, nobody can hand their link to another user.
+const linkIdentityCookie = "link_identity"
+
+// linkIdentityTTL is how long the browser has to open the link and complete the provider's consent screen
+const linkIdentityTTL = 5*time.Minute + oauthStateTTL
+
+type linkIdentityClaims struct {
+	UserId string `json:"user_id"`
+	// Nonce is repeated in the OAuth state, the callback only links when the cookie still matches it
+	Nonce string `json:"nonce"`
+}
+
+type IdentitiesResp struct {
+	Identities []database.Identity `json:"identities"`
+}
+
+// GetIdentities lists the OAuth accounts linked to the logged-in user
+func (s *Server) GetIdentities(w http.ResponseWriter, r *http.Request) {
+	principal, err := auth.FromContext(r.Context())
+	if err != nil {
+		s.unauthorized(w, r)
+		return
+	}
+	userId := principal.UserID
+
+	identities, err := s.db.GetIdentities(userId)
+	if err != nil {
+		s.serverError(w, r, err)
+		return
+	}
+
+	err = response.JSON(w, http.StatusOK, IdentitiesResp{Identities: identities})
+	if err != nil {
+		s.serverError(w, r, err)
+	}
+}
+
+// LinkIdentity returns the URL the browser has to open to link an account of the provider
+// to the logged-in user. The OAuth flow itself cannot carry the bearer token, so a short-lived
+// signed token is set in an HttpOnly cookie instead, it never appears in the URL.
+func (s *Server) LinkIdentity(w http.ResponseWriter, r *http.Request) {
+	provider := chi.URLParam(r, "provider")
+	if _, err := goth.GetProvider(provider); err != nil {
+		s.notFound(w, r)
+		return
+	}
+
+	principal, err := auth.FromContext(r.Context())
+	if err != nil {
+		s.unauthorized(w, r)
+		return
+	}
+	userId := principal.UserID
+
+	token, err := s.signer.Sign(purposeLinkIdentity, linkIdentityClaims{UserId: userId, Nonce: uuid.NewString()}, linkIdentityTTL)
+	if err != nil {
+		s.serverError(w, r, err)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     linkIdentityCookie,
+		Value:    token,
+		Path:     "/auth/",
+		MaxAge:   int(linkIdentityTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   cookieSecure,
+		SameSite: http.SameSiteLaxMode,
+		Domain:   cookieDomain,
+	})
+
+	link := url.URL{Path: "/auth/" + provider, RawQuery: url.Values{"link": {"true"}}.Encode()}
+	err = response.JSON(w, http.StatusOK, struct {
+		URL string `json:"url"`
+	}{URL: link.String()})
+	if err != nil {
+		s.serverError(w, r, err)
+	}
+}
+
+// UnlinkIdentity removes the account of the provider from the logged-in user
+func (s *Server) UnlinkIdentity(w http.ResponseWriter, r *http.Request) {
+	provider := chi.URLParam(r, "provider")
+
+	principal, err := auth.FromContext(r.Context())
+	if err != nil {
+		s.unauthorized(w, r)
+		return
+	}
+	userId := principal.UserID
+
+	found, err := s.db.UnlinkIdentity(userId, provider)
+	if err != nil {
+		if errors.Is(err, database.ErrLastLoginMethod) {
+			s.errorMessage(w, r, http.StatusConflict, err.Error(), nil)
+			return
+		}
+		s.serverError(w, r, err)
+		return
+	}
+	if !found {
+		s.notFound(w, r)
+		return
+	}
+
+	err = response.JSON(w, http.StatusOK, struct {
+		Message string `json:"message"`
+	}{Message: fmt.Sprintf("%s account unlinked", provider)})
+	if err != nil {
+		s.serverError(w, r, err)
+	}
+}
+
+// linkFromCookie returns the link flow started by this browser with LinkIdentity
+func (s *Server) linkFromCookie(r *http.Request) (*linkIdentityClaims, error) {
+	cookie, err := r.Cookie(linkIdentityCookie)
+	if err != nil {
+		return nil, errors.New("the link was not started in this browser")
+	}
+	var link linkIdentityClaims
+	if err := s.signer.Verify(purposeLinkIdentity, cookie.Value, &link); err != nil {
+		return nil, err
+	}
+	return &link, nil
+}
+
+// clearLinkCookie removes the cookie of a finished link flow
+func clearLinkCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{Name: linkIdentityCookie, Path: "/auth/", MaxAge: -1, Secure: cookieSecure, Domain: cookieDomain})
+}
+
+// identityFromGothUser converts the profile returned by goth
+func identityFromGothUser(user goth.User) *database.Identity {
+	raw, _ := json.Marshal(user.RawData)
+	return &database.Identity{
+		Provider:       user.Provider,
+		ProviderUserId: user.UserID,
+		Email:          user.Email,
+		AvatarURL:      user.AvatarURL,
+		RawProfile:     raw,
+		Name:           user.Name,
+		Role:           authenticate.Role(user.Provider, user.RawData),
+	}
+}
+
+// checkMappedRoles makes sure that the roles identity providers give users exist, so that a typo
+// in a ROLE_MAP is found at startup rather than by the first login it breaks
+func checkMappedRoles(db database.Service, roles []string) error {
+	for _, role := range roles {
+		if _, err := db.GetRole(role); err != nil {
+			if errors.Is(err, database.ErrRoleNotFound) {
+				return fmt.Errorf("role %s of an OIDC ROLE_MAP does not exist, create it first", role)
+			}
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,209 @@
+package server
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/jwtauth/v5"
+	"github.com/google/uuid"
+	"log/slog"
+	"net/http"
+	"new_project/internal/auth"
+	"new_project/internal/database"
+	"new_project/internal/response"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// ImpersonateRequest represents why an admin acts as another user, it is kept in the audit record
+type ImpersonateRequest struct {
+	Reason string `json:"reason"`
+}
+
+// ImpersonateResp carries the access token of an impersonation. It cannot be refreshed.
+type ImpersonateResp struct {
+	Token         string                  `json:"token"`
+	ExpiresIn     int64                   `json:"expires_in"`
+	Impersonation *database.Impersonation `json:"impersonation"`
+}
+
+type ImpersonationsResp struct {
+	Impersonations []database.Impersonation `json:"impersonations"`
+}
+
+// Impersonate issues a short-lived access token for the user, marked with the impersonator claim.
+// Users with admin access, or with a permission the impersonator lacks, cannot be impersonated.
+func (s *Server) Impersonate(w http.ResponseWriter, r *http.Request) {
+	targetId := chi.URLParam(r, "id")
+	if _, err := uuid.Parse(targetId); err != nil {
+		s.notFound(w, r)
+		return
+	}
+
+	var req ImpersonateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.badRequest(w, r, err)
+		return
+	}
+	req.Reason = strings.TrimSpace(req.Reason)
+	if req.Reason == "" || utf8.RuneCountInString(req.Reason) > 500 {
+		s.badRequest(w, r, fmt.Errorf("reason must be between 1 and 500 characters long"))
+		return
+	}
+
+	principal, err := auth.FromContext(r.Context())
+	if err != nil {
+		s.unauthorized(w, r)
+		return
+	}
+	adminId := principal.UserID
+	if targetId == adminId {
+		s.badRequest(w, r, fmt.Errorf("you cannot impersonate yourself"))
+		return
+	}
+
+	target, err := s.db.GetUserById(targetId)
+	if errors.Is(err, sql.ErrNoRows) {
+		s.notFound(w, r)
+		return
+	}
+	if err != nil {
+		s.serverError(w, r, err)
+		return
+	}
+
+	permissions, err := s.db.GetUserPermissions(targetId)
+	if err != nil {
+		s.serverError(w, r, err)
+		return
+	}
+	if slices.Contains(permissions, database.PermAdminAccess) {
+		s.errorMessage(w, r, http.StatusForbidden, "users with admin access cannot be impersonated", nil)
+		return
+	}
+
+	// Impersonating must not lend the impersonator permissions they do not have themselves
+	granted, r, err := s.permissions(r)
+	if err != nil {
+		s.serverError(w, r, err)
+		return
+	}
+	for _, permission := range permissions {
+		if !granted[permission] {
+			s.errorMessage(w, r, http.StatusForbidden, "users with permissions you do not have cannot be impersonated", nil)
+			return
+		}
+	}
+
+	admin, err := s.db.GetUserById(adminId)
+	if err != nil {
+		s.serverError(w, r, err)
+		return
+	}
+
+	// The impersonation is a session of its own, so that it can be revoked without touching the user's sessions
+	jti := uuid.NewString()
+	sessionId := uuid.NewString()
+	expiresAt := time.Now().Add(impersonationTTL)
+	tokenClaims := map[string]interface{}{
+		"jti":          jti,
+		"user_id":      targetId,
+		"sid":          sessionId,
+		"role":         target.Role,
+		"impersonator": adminId,
+	}
+	jwtauth.SetExpiry(tokenClaims, expiresAt)
+	jwtauth.SetIssuedNow(tokenClaims)
+
+	_, tokenString, err := s.tokenAuth.Encode(tokenClaims)
+	if err != nil {
+		s.serverError(w, r, err)
+		return
+	}
+
+	impersonation, err := s.db.StartImpersonation(&database.Impersonation{
+		AdminId:       adminId,
+		AdminUsername: admin.Username,
+		UserId:        targetId,
+		SessionId:     sessionId,
+		Reason:        req.Reason,
+		IpAddress:     clientIP(r),
+		UserAgent:     r.UserAgent(),
+		ExpiresAt:     expiresAt,
+	}, jti, hashToken(tokenString))
+	if err != nil {
+		s.serverError(w, r, err)
+		return
+	}
+
+	s.logger.Warn("impersonation started",
+		slog.String("admin_id", adminId),
+		slog.String("user_id", targetId),
+		slog.String("session_id", sessionId),
+		slog.String("reason", req.Reason),
+	)
+	s.audit(r, database.AuditEvent{
+		Type: auditImpersonation, ActorId: adminId, Username: admin.Username,
+		Details: map[string]any{"user_id": targetId, "session_id": sessionId, "reason": req.Reason},
+	})
+
+	err = response.JSON(w, http.StatusCreated, ImpersonateResp{
+		Token:         tokenString,
+		ExpiresIn:     int64(impersonationTTL.Seconds()),
+		Impersonation: impersonation,
+	})
+	if err != nil {
+		s.serverError(w, r, err)
+	}
+}
+
+// GetImpersonations lists the latest impersonations, of one user with ?user_id=
+func (s *Server) GetImpersonations(w http.ResponseWriter, r *http.Request) {
+	userId := r.URL.Query().Get("user_id")
+	if userId != "" {
+		if _, err := uuid.Parse(userId); err != nil {
+			s.badRequest(w, r, fmt.Errorf("invalid user_id"))
+			return
+		}
+	}
+
+	impersonations, err := s.db.GetImpersonations(userId, 100)
+	if err != nil {
+		s.serverError(w, r, err)
+		return
+	}
+
+	err = response.JSON(w, http.StatusOK, ImpersonationsResp{Impersonations: impersonations})
+	if err != nil {
+		s.serverError(w, r, err)
+	}
+}
+
+// impersonator returns the id of the admin acting as the logged-in user, it is empty for the user's own sessions
+func impersonator(r *http.Request) string {
+	principal, err := auth.FromContext(r.Context())
+	if err != nil {
+		return ""
+	}
+	return principal.Impersonator
+}
+
+// rejectImpersonation keeps impersonating admins away from sensitive actions such as changing the
+// password or creating API keys. It has to run after the authenticator.
+func (s *Server) rejectImpersonation() func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		hfn := func(w http.ResponseWriter, r *http.Request) {
+			if impersonator(r) != "" {
+				s.errorMessage(w, r, http.StatusForbidden, "this action is not allowed while impersonating a user", nil)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		}
+		return http.HandlerFunc(hfn)
+	}
+}
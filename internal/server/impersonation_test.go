@@ -0,0 +1,75 @@
+package server
+
+import (
+	"context"
+	"github.com/go-chi/chi/v5"
+	"net/http"
+	"net/http/httptest"
+	"new_project/internal/auth"
+	"new_project/internal/database"
+	"strings"
+	"testing"
+)
+
+func TestRejectImpersonation(t *testing.T) {
+	s := &Server{}
+	handler := s.rejectImpersonation()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	tests := map[string]struct {
+		principal auth.Principal
+		want      int
+	}{
+		"own session":   {auth.Principal{UserID: "u1"}, http.StatusNoContent},
+		"impersonation": {auth.Principal{UserID: "u1", Impersonator: "admin"}, http.StatusForbidden},
+	}
+	for name, tt := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/api/p/v1/user/password", nil)
+		req = req.WithContext(auth.NewContext(req.Context(), &tt.principal))
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != tt.want {
+			t.Errorf("%s: expected status %d, got %d", name, tt.want, rr.Code)
+		}
+	}
+}
+
+// impersonationDB grants the permissions of the map to each user
+type impersonationDB struct {
+	database.Service
+	permissions map[string][]string
+}
+
+func (db *impersonationDB) GetUserById(id string) (*database.User, error) {
+	return &database.User{Id: id, Username: id + "@example.com"}, nil
+}
+
+func (db *impersonationDB) GetUserPermissions(userID string) ([]string, error) {
+	return db.permissions[userID], nil
+}
+
+func TestImpersonateNeedsTargetPermissions(t *testing.T) {
+	const (
+		adminId  = "00000000-0000-0000-0000-000000000001"
+		targetId = "00000000-0000-0000-0000-000000000002"
+	)
+	db := &impersonationDB{permissions: map[string][]string{
+		adminId:  {database.PermUsersImpersonate},
+		targetId: {database.PermRolesManage},
+	}}
+	s := &Server{db: db}
+
+	req := httptest.NewRequest(http.MethodPost, "/api/p/v1/admin/users/"+targetId+"/impersonate", strings.NewReader(`{"reason":"ticket 1234"}`))
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Add("id", targetId)
+	ctx := context.WithValue(req.Context(), chi.RouteCtxKey, rctx)
+	req = req.WithContext(auth.NewContext(ctx, &auth.Principal{UserID: adminId}))
+	rr := httptest.NewRecorder()
+	s.Impersonate(rr, req)
+
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("expected status 403 for a target with more permissions, got %d", rr.Code)
+	}
+}
@@ -0,0 +1,175 @@
+package server
+
+import (
+	"fmt"
+	"github.com/go-chi/chi/v5"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"new_project/internal/auth"
+	"new_project/internal/database"
+	"new_project/internal/response"
+	"time"
+)
+
+// loginThrottleKeys are the counters a login attempt of the username from the request is counted against
+func loginThrottleKeys(r *http.Request, username string) []struct {
+	scope, key  string
+	maxFailures int
+} {
+	return []struct {
+		scope, key  string
+		maxFailures int
+	}{
+		{database.ThrottleScopeUsername, username, loginMaxFailures},
+		{database.ThrottleScopeIP, clientIP(r), loginIPMaxFailures},
+	}
+}
+
+// reserveLoginAttempt counts the attempt against the username and the client IP before the
+// credentials are checked, so that parallel guesses cannot slip past the limits. The attempt stays
+// counted as a failure unless recordLoginSuccess or releaseLoginAttempt takes it back. It refuses
+// the attempt with a 429 response when either key is locked out or still has to wait after its
+// last failures, and returns false when it refused.
+func (s *Server) reserveLoginAttempt(w http.ResponseWriter, r *http.Request, username string) bool {
+	retryAfter := func(throttle *database.LoginThrottle) time.Duration {
+		return loginRetryAfter(throttle, time.Now())
+	}
+
+	keys := loginThrottleKeys(r, username)
+	for i, k := range keys {
+		throttle, wait, err := s.db.ReserveLoginAttempt(k.scope, k.key, loginFailureWindow, k.maxFailures, loginLockoutDuration, retryAfter)
+		if err == nil && wait <= 0 {
+			continue
+		}
+
+		// Give back what the other keys already reserved, the attempt does not happen
+		for _, reserved := range keys[:i] {
+			if err := s.db.ReleaseLoginAttempt(reserved.scope, reserved.key); err != nil {
+				s.reportServerError(r, err)
+			}
+		}
+		if err != nil {
+			s.serverError(w, r, err)
+			return false
+		}
+
+		attrs := []any{
+			slog.String("scope", k.scope),
+			slog.String("username", username),
+			slog.String("ip", clientIP(r)),
+			slog.Duration("retry_after", wait),
+		}
+		if throttle.LockedUntil != nil && throttle.LockedUntil.After(time.Now()) {
+			s.logger.Warn("login locked out", append(attrs, slog.Time("locked_until", *throttle.LockedUntil))...)
+		} else {
+			s.logger.Warn("login throttled", attrs...)
+		}
+		seconds := int(math.Ceil(wait.Seconds()))
+		headers := http.Header{}
+		headers.Set("Retry-After", fmt.Sprint(seconds))
+		s.errorMessage(w, r, http.StatusTooManyRequests, fmt.Sprintf("too many failed login attempts, try again in %d seconds", seconds), headers)
+		return false
+	}
+	return true
+}
+
+// recordLoginFailure logs a failed attempt. It was already counted when reserveLoginAttempt let it through.
+func (s *Server) recordLoginFailure(r *http.Request, username string) {
+	s.logger.Info("login failed",
+		slog.String("username", username),
+		slog.String("ip", clientIP(r)),
+	)
+}
+
+// recordLoginSuccess resets the counter of the username and takes back the attempt from the client IP.
+// The rest of the IP counter is left to expire so that logging into one's own account does not reset
+// the budget of an attacker.
+func (s *Server) recordLoginSuccess(r *http.Request, username string) {
+	if _, err := s.db.ClearLoginThrottle(database.ThrottleScopeUsername, username); err != nil {
+		s.reportServerError(r, err)
+	}
+	if err := s.db.ReleaseLoginAttempt(database.ThrottleScopeIP, clientIP(r)); err != nil {
+		s.reportServerError(r, err)
+	}
+}
+
+// releaseLoginAttempt takes back a reserved attempt that was neither a failure nor a completed login,
+// such as a correct password that still needs its second factor
+func (s *Server) releaseLoginAttempt(r *http.Request, username string) {
+	for _, k := range loginThrottleKeys(r, username) {
+		if err := s.db.ReleaseLoginAttempt(k.scope, k.key); err != nil {
+			s.reportServerError(r, err)
+		}
+	}
+}
+
+// UnlockUser lifts the lockout of a user and resets their failed login counter.
+// The counters of the client IPs the failures came from are kept: they belong to whoever sends the
+// guesses, so clearing them with every unlock would give an attacker a fresh budget. An admin who
+// knows the user's IP can pass it as the ip query parameter to clear that counter as well.
+func (s *Server) UnlockUser(w http.ResponseWriter, r *http.Request) {
+	user, err := s.db.GetUserById(chi.URLParam(r, "id"))
+	if err != nil {
+		s.notFound(w, r)
+		return
+	}
+
+	ip := r.URL.Query().Get("ip")
+	if ip != "" && net.ParseIP(ip) == nil {
+		s.badRequest(w, r, fmt.Errorf("ip must be an IP address"))
+		return
+	}
+
+	cleared, err := s.db.ClearLoginThrottle(database.ThrottleScopeUsername, user.Username)
+	if err != nil {
+		s.serverError(w, r, err)
+		return
+	}
+	if ip != "" {
+		ipCleared, err := s.db.ClearLoginThrottle(database.ThrottleScopeIP, ip)
+		if err != nil {
+			s.serverError(w, r, err)
+			return
+		}
+		cleared = cleared || ipCleared
+	}
+
+	admin, err := auth.FromContext(r.Context())
+	if err != nil {
+		s.unauthorized(w, r)
+		return
+	}
+	s.logger.Info("login unlocked",
+		slog.String("username", user.Username),
+		slog.String("admin_id", admin.UserID),
+		slog.String("ip", ip),
+		slog.Bool("was_throttled", cleared),
+	)
+
+	err = response.JSON(w, http.StatusOK, struct {
+		Message string `json:"message"`
+	}{Message: "user unlocked"})
+	if err != nil {
+		s.serverError(w, r, err)
+	}
+}
+
+// loginRetryAfter returns how long the key has to wait before the next attempt.
+// Once the lockout threshold is reached the key is locked; before that, every failure
+// past loginDelayAfter doubles the delay, up to loginMaxDelay.
+func loginRetryAfter(throttle *database.LoginThrottle, now time.Time) time.Duration {
+	if throttle.LockedUntil != nil && throttle.LockedUntil.After(now) {
+		return throttle.LockedUntil.Sub(now)
+	}
+	if throttle.Failures < loginDelayAfter || throttle.LastFailureAt.Before(now.Add(-loginFailureWindow)) {
+		return 0
+	}
+
+	delay := loginMaxDelay
+	if shift := throttle.Failures - loginDelayAfter; shift < 16 {
+		delay = min(time.Second<<shift, loginMaxDelay)
+	}
+	return throttle.LastFailureAt.Add(delay).Sub(now)
+}
@@ -0,0 +1,181 @@
+package server
+
+import (
+	"context"
+	"github.com/go-chi/chi/v5"
+	"golang.org/x/crypto/bcrypt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"new_project/internal/auth"
+	"new_project/internal/database"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLoginRetryAfter(t *testing.T) {
+	now := time.Now()
+	locked := now.Add(10 * time.Minute)
+	expired := now.Add(-time.Minute)
+
+	tests := []struct {
+		name     string
+		throttle database.LoginThrottle
+		want     time.Duration
+	}{
+		{"no failures", database.LoginThrottle{}, 0},
+		{"below delay threshold", database.LoginThrottle{Failures: loginDelayAfter - 1, LastFailureAt: now}, 0},
+		{"first delay", database.LoginThrottle{Failures: loginDelayAfter, LastFailureAt: now}, time.Second},
+		{"doubled delay", database.LoginThrottle{Failures: loginDelayAfter + 2, LastFailureAt: now}, 4 * time.Second},
+		{"capped delay", database.LoginThrottle{Failures: loginDelayAfter + 40, LastFailureAt: now}, loginMaxDelay},
+		{"delay partly elapsed", database.LoginThrottle{Failures: loginDelayAfter, LastFailureAt: now.Add(-400 * time.Millisecond)}, 600 * time.Millisecond},
+		{"outside window", database.LoginThrottle{Failures: loginDelayAfter + 2, LastFailureAt: now.Add(-loginFailureWindow - time.Second)}, 0},
+		{"locked", database.LoginThrottle{LastFailureAt: now, LockedUntil: &locked}, 10 * time.Minute},
+		{"lock expired", database.LoginThrottle{LastFailureAt: now.Add(-time.Hour), LockedUntil: &expired}, 0},
+	}
+	for _, tt := range tests {
+		if got := loginRetryAfter(&tt.throttle, now); got != tt.want {
+			t.Errorf("%s: loginRetryAfter = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+// throttleDB keeps the counters in memory, reservations are serialized like the row lock does
+type throttleDB struct {
+	database.Service
+	hash string
+
+	mu       sync.Mutex
+	counters map[string]*database.LoginThrottle
+	checked  int
+}
+
+func (db *throttleDB) ReserveLoginAttempt(scope string, key string, window time.Duration, maxFailures int, lockout time.Duration, retryAfter func(*database.LoginThrottle) time.Duration) (*database.LoginThrottle, time.Duration, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	throttle, ok := db.counters[scope+key]
+	if !ok {
+		throttle = &database.LoginThrottle{LastFailureAt: time.Now()}
+		db.counters[scope+key] = throttle
+	}
+	if wait := retryAfter(throttle); wait > 0 {
+		return throttle, wait, nil
+	}
+	if throttle.Failures >= maxFailures {
+		until := time.Now().Add(lockout)
+		throttle.Failures, throttle.LockedUntil = 0, &until
+		return throttle, lockout, nil
+	}
+	throttle.Failures++
+	throttle.LastFailureAt = time.Now()
+	return throttle, 0, nil
+}
+
+func (db *throttleDB) ReleaseLoginAttempt(scope string, key string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if throttle, ok := db.counters[scope+key]; ok && throttle.Failures > 0 {
+		throttle.Failures--
+	}
+	return nil
+}
+
+func (db *throttleDB) GetHashedPassword(username string) (string, string, error) {
+	db.mu.Lock()
+	db.checked++
+	db.mu.Unlock()
+	return "u1", db.hash, nil
+}
+
+func (db *throttleDB) InsertAuditEvent(event *database.AuditEvent) error {
+	return nil
+}
+
+func TestNewLoginConcurrentAttempts(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("correct horse"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := &throttleDB{hash: string(hash), counters: map[string]*database.LoginThrottle{}}
+	s := &Server{db: db, logger: slog.New(slog.NewTextHandler(io.Discard, nil))}
+
+	// Guesses sent at once must not all pass the check before any of them is counted
+	const attempts = 20
+	codes := make(chan int, attempts)
+	var wg sync.WaitGroup
+	for i := 0; i < attempts; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req := httptest.NewRequest(http.MethodPost, "/api/p/v1/login", strings.NewReader(`{"username":"jane","password":"guess"}`))
+			rr := httptest.NewRecorder()
+			s.NewLogin(rr, req)
+			codes <- rr.Code
+		}()
+	}
+	wg.Wait()
+	close(codes)
+
+	refused := 0
+	for code := range codes {
+		if code == http.StatusTooManyRequests {
+			refused++
+		}
+	}
+	if db.checked != loginDelayAfter || refused != attempts-loginDelayAfter {
+		t.Errorf("expected %d password checks and %d refusals, got %d and %d", loginDelayAfter, attempts-loginDelayAfter, db.checked, refused)
+	}
+}
+
+func (db *throttleDB) GetUserById(id string) (*database.User, error) {
+	return &database.User{Id: id, Username: "jane"}, nil
+}
+
+func (db *throttleDB) ClearLoginThrottle(scope string, key string) (bool, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	_, ok := db.counters[scope+key]
+	delete(db.counters, scope+key)
+	return ok, nil
+}
+
+func TestUnlockUser(t *testing.T) {
+	locked := time.Now().Add(time.Hour)
+	db := &throttleDB{counters: map[string]*database.LoginThrottle{
+		database.ThrottleScopeUsername + "jane": {LockedUntil: &locked},
+		database.ThrottleScopeIP + "192.0.2.1":  {LockedUntil: &locked},
+		database.ThrottleScopeIP + "192.0.2.2":  {LockedUntil: &locked},
+	}}
+	s := &Server{db: db, logger: slog.New(slog.NewTextHandler(io.Discard, nil))}
+
+	unlock := func(query string) int {
+		req := httptest.NewRequest(http.MethodPost, "/api/p/v1/admin/users/u1/unlock"+query, nil)
+		rctx := chi.NewRouteContext()
+		rctx.URLParams.Add("id", "u1")
+		ctx := context.WithValue(req.Context(), chi.RouteCtxKey, rctx)
+		req = req.WithContext(auth.NewContext(ctx, &auth.Principal{UserID: "admin"}))
+		rr := httptest.NewRecorder()
+		s.UnlockUser(rr, req)
+		return rr.Code
+	}
+
+	// The IP counters are only cleared when the admin names the IP
+	if code := unlock(""); code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", code)
+	}
+	if len(db.counters) != 2 {
+		t.Errorf("expected only the username counter to be cleared, got %v", db.counters)
+	}
+	if code := unlock("?ip=192.0.2.1"); code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", code)
+	}
+	if _, ok := db.counters[database.ThrottleScopeIP+"192.0.2.2"]; !ok || len(db.counters) != 1 {
+		t.Errorf("expected only the named IP counter to be cleared, got %v", db.counters)
+	}
+	if code := unlock("?ip=nope"); code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an invalid IP, got %d", code)
+	}
+}
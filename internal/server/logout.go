@@ -0,0 +1,108 @@
+package server
+
+import (
+	"errors"
+	"github.com/google/uuid"
+	"net/http"
+	"new_project/internal/auth"
+	"new_project/internal/database"
+)
+
+// logoutEverywhere reports whether the request asked with ?everywhere=true to end every session of the user.
+// Browsers send the session cookies along on their own, so requests authenticated by cookies have to
+// prove it with the CSRF token, otherwise a link on another site could log the user out of every device.
+func (s *Server) logoutEverywhere(r *http.Request, principal *auth.Principal, csrfToken string) (bool, error) {
+	if r.URL.Query().Get("everywhere") != "true" {
+		return false, nil
+	}
+	if principal == nil || principal.SessionID == "" {
+		if principal != nil && principal.Method == auth.MethodAPIKey {
+			return false, errors.New("API keys cannot log out every session")
+		}
+		return false, errors.New("there is no session to log out")
+	}
+	if principal.Impersonator != "" {
+		return false, errors.New("impersonating admins cannot log the user out of every session")
+	}
+	if principal.Method == auth.MethodCookie {
+		if csrfSessionId, ok := s.verifyCSRFToken(r, csrfToken); !ok || csrfSessionId != principal.SessionID {
+			return false, errors.New("missing or invalid CSRF token")
+		}
+	}
+	return true, nil
+}
+
+// endSession invalidates the access and refresh tokens of the session of the request, or of every
+// session of the user, and records the logout. The principal has to be in the request context.
+func (s *Server) endSession(r *http.Request, everywhere bool, details map[string]any) error {
+	principal, err := auth.FromContext(r.Context())
+	if err != nil {
+		return nil
+	}
+	userId := principal.UserID
+	sessionId := principal.SessionID
+
+	sessions := 0
+	switch {
+	case sessionId != "":
+		if _, err := uuid.Parse(sessionId); err != nil {
+			return nil
+		}
+		owner, n, err := s.db.EndSession(sessionId, everywhere)
+		if err != nil {
+			return err
+		}
+		if userId == "" {
+			userId = owner
+		}
+		sessions = n
+	case principal.TokenID != "":
+		// Tokens issued before sessions had an id only end themselves
+		if err := s.db.InvalidateToken(principal.TokenID); err != nil {
+			return err
+		}
+	default:
+		// Requests made with an API key have no session to end
+		return nil
+	}
+
+	if userId != "" {
+		s.tokenCache.revokeUser(userId)
+	}
+
+	if details == nil {
+		details = map[string]any{}
+	}
+	details["session_id"] = sessionId
+	details["everywhere"] = everywhere
+	details["sessions_ended"] = sessions
+	s.audit(r, database.AuditEvent{Type: auditLogout, ActorId: userId, Details: details})
+	return nil
+}
+
+// sessionFromCookies puts the principal of a browser session in the request context, for routes outside
+// the authenticated group. The signature of the jwt cookie is checked but not its expiry, the cookie
+// may outlive the token by a few seconds. Once it is gone, the session is known from the CSRF cookie.
+func (s *Server) sessionFromCookies(r *http.Request) *http.Request {
+	if cookie, err := r.Cookie(sessionCookie); err == nil {
+		if token, err := s.tokenAuth.Decode(cookie.Value); err == nil {
+			if claims, err := token.AsMap(r.Context()); err == nil {
+				if principal, err := auth.FromClaims(claims, auth.MethodCookie); err == nil {
+					return r.WithContext(auth.NewContext(r.Context(), principal))
+				}
+			}
+		}
+	}
+
+	cookie, err := r.Cookie(csrfCookie)
+	if err != nil {
+		return r
+	}
+	var sessionId string
+	if err := s.signer.Verify(purposeCSRF, cookie.Value, &sessionId); err != nil {
+		return r
+	}
+	// The user is found from the session when it is ended
+	principal := &auth.Principal{SessionID: sessionId, Method: auth.MethodCookie}
+	return r.WithContext(auth.NewContext(r.Context(), principal))
+}
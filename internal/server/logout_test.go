@@ -0,0 +1,61 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"new_project/internal/auth"
+	"new_project/internal/signing"
+	"testing"
+	"time"
+)
+
+func TestLogoutEverywhere(t *testing.T) {
+	s := &Server{signer: signing.New([]byte("secret"))}
+	csrfToken, _ := s.signer.Sign(purposeCSRF, "session-1", time.Hour)
+	otherSession, _ := s.signer.Sign(purposeCSRF, "session-2", time.Hour)
+
+	tests := []struct {
+		name      string
+		query     string
+		principal *auth.Principal
+		csrf      string
+		want      bool
+		wantErr   bool
+	}{
+		{"this session only", "", &auth.Principal{SessionID: "session-1", Method: auth.MethodCookie}, "", false, false},
+		{"bearer token", "?everywhere=true", &auth.Principal{SessionID: "session-1", Method: auth.MethodBearer}, "", true, false},
+		{"cookies with csrf token", "?everywhere=true", &auth.Principal{SessionID: "session-1", Method: auth.MethodCookie}, csrfToken, true, false},
+		{"cookies without csrf token", "?everywhere=true", &auth.Principal{SessionID: "session-1", Method: auth.MethodCookie}, "", false, true},
+		{"csrf token of another session", "?everywhere=true", &auth.Principal{SessionID: "session-1", Method: auth.MethodCookie}, otherSession, false, true},
+		{"impersonation", "?everywhere=true", &auth.Principal{SessionID: "session-1", Impersonator: "admin", Method: auth.MethodBearer}, "", false, true},
+		{"api key", "?everywhere=true", &auth.Principal{UserID: "u1", Method: auth.MethodAPIKey}, "", false, true},
+		{"no session", "?everywhere=true", nil, "", false, true},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/logout/google"+tt.query, nil)
+		req.AddCookie(&http.Cookie{Name: csrfCookie, Value: csrfToken})
+
+		got, err := s.logoutEverywhere(req, tt.principal, tt.csrf)
+		if got != tt.want || (err != nil) != tt.wantErr {
+			t.Errorf("%s: expected %v (error %v), got %v (%v)", tt.name, tt.want, tt.wantErr, got, err)
+		}
+	}
+}
+
+func TestSessionFromCSRFCookie(t *testing.T) {
+	s := &Server{signer: signing.New([]byte("secret"))}
+	csrfToken, _ := s.signer.Sign(purposeCSRF, "session-1", time.Hour)
+
+	req := httptest.NewRequest(http.MethodGet, "/logout/google", nil)
+	req.AddCookie(&http.Cookie{Name: csrfCookie, Value: csrfToken})
+	principal, err := auth.FromContext(s.sessionFromCookies(req).Context())
+	if err != nil || principal.SessionID != "session-1" || principal.Method != auth.MethodCookie {
+		t.Errorf("expected the session of the CSRF cookie, got %+v (%v)", principal, err)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/logout/google", nil)
+	req.AddCookie(&http.Cookie{Name: csrfCookie, Value: "forged"})
+	if _, err := auth.FromContext(s.sessionFromCookies(req).Context()); err == nil {
+		t.Error("expected no session for a forged CSRF cookie")
+	}
+}
@@ -0,0 +1,234 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"new_project/internal/database"
+	"new_project/internal/mailer"
+	"new_project/internal/response"
+	"new_project/internal/signing"
+	"time"
+)
+
+// purposeMagicLink binds signed magic links to the passwordless login
+const purposeMagicLink = "magic-link"
+
+type magicLinkClaims struct {
+	// LinkId is the row in magic_links that makes the link single-use
+	LinkId string `json:"l"`
+	UserId string `json:"u"`
+	Email  string `json:"e"`
+}
+
+// MagicLinkRequest represents the data needed to request a magic login link
+type MagicLinkRequest struct {
+	Email string `json:"email"`
+}
+
+// MagicLinkVerifyRequest represents the data needed to log in with a magic link
+type MagicLinkVerifyRequest struct {
+	Token string `json:"token"`
+}
+
+// MagicLinkLogin emails a single-use login link to the account registered with the address.
+// The response is the same whether or not the account exists.
+func (s *Server) MagicLinkLogin(w http.ResponseWriter, r *http.Request) {
+	if !magicLinkEnabled {
+		s.notFound(w, r)
+		return
+	}
+
+	var req MagicLinkRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.badRequest(w, r, err)
+		return
+	}
+
+	address, err := mail.ParseAddress(req.Email)
+	if err != nil {
+		s.badRequest(w, r, fmt.Errorf("a valid email is required"))
+		return
+	}
+	email := address.Address
+
+	// Locked out usernames and IPs do not get links either. Asking for a link is no guess,
+	// so the attempt is given back right away.
+	if !s.reserveLoginAttempt(w, r, email) {
+		s.audit(r, database.AuditEvent{Type: auditLoginMagicLink, Outcome: database.AuditFailure, Reason: auditReasonLockedOut, Username: email})
+		return
+	}
+	s.releaseLoginAttempt(r, email)
+
+	// Like the password reset, the lookup and the mail happen in the background so that
+	// the response time does not reveal whether the account exists
+	s.backgroundTask(r, func() error {
+		userID, _, err := s.db.GetHashedPassword(email)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		linkID := uuid.NewString()
+		err = s.db.CreateMagicLink(userID, linkID, time.Now().Add(magicLinkTTL), magicLinkResendInterval)
+		if errors.Is(err, database.ErrMagicLinkThrottled) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		token, err := s.signer.Sign(purposeMagicLink, magicLinkClaims{LinkId: linkID, UserId: userID, Email: email}, magicLinkTTL)
+		if err != nil {
+			return err
+		}
+		link, err := url.Parse(magicLinkURL)
+		if err != nil {
+			return err
+		}
+		query := link.Query()
+		query.Set("token", token)
+		link.RawQuery = query.Encode()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		return s.mailer.Send(ctx, mailer.Message{
+			To:      email,
+			Subject: "Your login link",
+			Body: fmt.Sprintf("Someone asked to log in to your account without a password.\n\n"+
+				"Open the link below to log in. It expires in %s and can only be used once.\n\n%s\n\n"+
+				"If this was not you, you can ignore this email.\n", magicLinkTTL, link),
+		})
+	})
+
+	err = response.JSON(w, http.StatusAccepted, struct {
+		Message string `json:"message"`
+	}{Message: "if an account exists for this email, a login link has been sent"})
+	if err != nil {
+		s.serverError(w, r, err)
+	}
+}
+
+// MagicLinkVerify exchanges the token of a magic link for a session. Users with two-factor
+// authentication get the challenge of /api/v1/login/mfa instead.
+func (s *Server) MagicLinkVerify(w http.ResponseWriter, r *http.Request) {
+	if !magicLinkEnabled {
+		s.notFound(w, r)
+		return
+	}
+
+	var req MagicLinkVerifyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.badRequest(w, r, err)
+		return
+	}
+
+	var claims magicLinkClaims
+	err := s.signer.Verify(purposeMagicLink, req.Token, &claims)
+	if err != nil {
+		if errors.Is(err, signing.ErrExpired) {
+			s.errorMessage(w, r, http.StatusUnauthorized, "login link has expired, please request a new one", nil)
+			return
+		}
+		s.errorMessage(w, r, http.StatusUnauthorized, "invalid login link", nil)
+		return
+	}
+
+	// The link only logs in while the address it was sent to is still the username
+	user, err := s.db.GetUserById(claims.UserId)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		s.serverError(w, r, err)
+		return
+	}
+	if user == nil || user.Username != claims.Email {
+		s.errorMessage(w, r, http.StatusUnauthorized, "invalid login link", nil)
+		return
+	}
+
+	if !s.reserveLoginAttempt(w, r, user.Username) {
+		s.audit(r, database.AuditEvent{Type: auditLoginMagicLink, Outcome: database.AuditFailure, Reason: auditReasonLockedOut, ActorId: user.Id, Username: user.Username})
+		return
+	}
+
+	// Opening the link proves the user owns the address. When the password was chosen at a registration
+	// nobody verified, it may have been set by someone else and is cleared along with their sessions.
+	// The owner is told in the response and by email, and can choose a new one with the password reset.
+	claimed, err := s.db.UseMagicLink(claims.LinkId, user.Id, claims.Email)
+	if errors.Is(err, database.ErrMagicLinkInvalid) {
+		s.recordLoginFailure(r, user.Username)
+		s.audit(r, database.AuditEvent{Type: auditLoginMagicLink, Outcome: database.AuditFailure, Reason: "link_used", ActorId: user.Id, Username: user.Username})
+		s.errorMessage(w, r, http.StatusUnauthorized, err.Error(), nil)
+		return
+	}
+	if err != nil {
+		s.serverError(w, r, err)
+		return
+	}
+	if claimed {
+		s.tokenCache.revokeUser(user.Id)
+		s.audit(r, database.AuditEvent{Type: auditPasswordCleared, ActorId: user.Id, Username: user.Username})
+		s.sendPasswordRemovedEmail(r, user.Username)
+	}
+
+	totpConfig, err := s.db.GetTOTP(user.Id)
+	if err != nil {
+		s.serverError(w, r, err)
+		return
+	}
+	if totpConfig.Enabled {
+		challenge, err := s.mfaChallenge(user.Id)
+		if err != nil {
+			s.serverError(w, r, err)
+			return
+		}
+		challenge.PasswordRemoved = claimed
+		s.audit(r, database.AuditEvent{
+			Type: auditLoginMagicLink, ActorId: user.Id, Username: user.Username,
+			Details: map[string]any{"mfa_required": true},
+		})
+		err = response.JSON(w, http.StatusOK, challenge)
+		if err != nil {
+			s.serverError(w, r, err)
+		}
+		return
+	}
+
+	s.recordLoginSuccess(r, user.Username)
+	if err := s.db.SetLastLoginProvider(user.Id, "magic_link"); err != nil {
+		s.reportServerError(r, err)
+	}
+	s.audit(r, database.AuditEvent{Type: auditLoginMagicLink, ActorId: user.Id, Username: user.Username})
+
+	tokens, err := s.createToken(r, user.Id)
+	if err != nil {
+		s.createTokenError(w, r, err)
+		return
+	}
+	tokens.PasswordRemoved = claimed
+
+	s.writeSession(w, r, tokens)
+}
+
+// sendPasswordRemovedEmail tells the owner of the address that a magic link cleared the password of the account
+func (s *Server) sendPasswordRemovedEmail(r *http.Request, email string) {
+	s.backgroundTask(r, func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		return s.mailer.Send(ctx, mailer.Message{
+			To:      email,
+			Subject: "The password of your account was removed",
+			Body: "You just logged in with a login link, which verified your email address for the first time.\n\n" +
+				"The password of your account was set before anyone proved to own this address, possibly by " +
+				"someone else, so it has been removed and every other session was logged out.\n\n" +
+				"To log in with a password again, choose a new one with the password reset.\n",
+		})
+	})
+}
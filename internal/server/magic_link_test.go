@@ -0,0 +1,98 @@
+package server
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"new_project/internal/database"
+	"new_project/internal/signing"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMagicLinkVerifyRejectsTokens(t *testing.T) {
+	s := &Server{signer: signing.New([]byte("secret"))}
+
+	// Tokens signed for another flow must not log anyone in
+	otherPurpose, err := s.signer.Sign(purposeVerifyEmail, emailVerificationClaims{UserId: "u1", Email: "jane@example.com"}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired, err := s.signer.Sign(purposeMagicLink, magicLinkClaims{LinkId: "l1", UserId: "u1", Email: "jane@example.com"}, -time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, token := range map[string]string{"other purpose": otherPurpose, "expired": expired, "garbage": "abc"} {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/login/magic/verify", strings.NewReader(`{"token":"`+token+`"}`))
+		rr := httptest.NewRecorder()
+		s.MagicLinkVerify(rr, req)
+
+		if rr.Code != http.StatusUnauthorized {
+			t.Errorf("%s: expected status 401, got %d", name, rr.Code)
+		}
+	}
+}
+
+func TestMagicLinkDisabled(t *testing.T) {
+	defer func(enabled bool) { magicLinkEnabled = enabled }(magicLinkEnabled)
+	magicLinkEnabled = false
+
+	s := &Server{}
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/login/magic", strings.NewReader(`{"email":"jane@example.com"}`))
+	rr := httptest.NewRecorder()
+	s.MagicLinkLogin(rr, req)
+
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("expected status 404, got %d", rr.Code)
+	}
+}
+
+type magicLinkDB struct {
+	database.Service
+	lookupErr error
+}
+
+func (db *magicLinkDB) ReserveLoginAttempt(scope string, key string, window time.Duration, maxFailures int, lockout time.Duration, retryAfter func(*database.LoginThrottle) time.Duration) (*database.LoginThrottle, time.Duration, error) {
+	return &database.LoginThrottle{Failures: 1}, 0, nil
+}
+
+func (db *magicLinkDB) ReleaseLoginAttempt(scope string, key string) error {
+	return nil
+}
+
+func (db *magicLinkDB) GetHashedPassword(username string) (string, string, error) {
+	return "", "", db.lookupErr
+}
+
+func TestMagicLinkLoginReportsLookupErrors(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		wantLogged bool
+	}{
+		{"unknown address", sql.ErrNoRows, false},
+		{"database down", errors.New("connection refused"), true},
+	}
+	for _, tt := range tests {
+		var logs bytes.Buffer
+		s := &Server{db: &magicLinkDB{lookupErr: tt.err}, logger: slog.New(slog.NewTextHandler(&logs, nil))}
+
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/login/magic", strings.NewReader(`{"email":"jane@example.com"}`))
+		rr := httptest.NewRecorder()
+		s.MagicLinkLogin(rr, req)
+		s.wg.Wait()
+
+		// The answer does not tell either way, the log does
+		if rr.Code != http.StatusAccepted {
+			t.Errorf("%s: expected status 202, got %d", tt.name, rr.Code)
+		}
+		if logged := strings.Contains(logs.String(), "connection refused"); logged != tt.wantLogged {
+			t.Errorf("%s: expected logged %t, got %t (%s)", tt.name, tt.wantLogged, logged, logs.String())
+		}
+	}
+}
@@ -0,0 +1,295 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"new_project/internal/auth"
+	"new_project/internal/database"
+	"new_project/internal/response"
+	"new_project/internal/signing"
+	"new_project/internal/totp"
+	"strings"
+	"time"
+)
+
+// purposeMFAChallenge binds the challenge handed out by NewLogin to the second login step
+const purposeMFAChallenge = "mfa-challenge"
+
+// recoveryCodeCount is the number of recovery codes handed out when TOTP is enabled
+const recoveryCodeCount = 10
+
+type mfaChallengeClaims struct {
+	UserId string `json:"user_id"`
+}
+
+// MFAChallengeResponse is returned by NewLogin instead of a token when the user enabled TOTP
+type MFAChallengeResponse struct {
+	MFARequired bool   `json:"mfa_required"`
+	MFAToken    string `json:"mfa_token"`
+	ExpiresIn   int64  `json:"expires_in"`
+	// PasswordRemoved is set when the magic link that led here cleared a password set by someone else
+	PasswordRemoved bool `json:"password_removed,omitempty"`
+}
+
+// TOTPCodeRequest represents a TOTP or recovery code sent by the user
+type TOTPCodeRequest struct {
+	Code string `json:"code"`
+}
+
+// LoginMFARequest represents the data needed for the second login step
+type LoginMFARequest struct {
+	MFAToken string `json:"mfa_token"`
+	Code     string `json:"code"`
+}
+
+// EnrollTOTP starts TOTP enrollment and returns the secret and the otpauth URI to scan
+func (s *Server) EnrollTOTP(w http.ResponseWriter, r *http.Request) {
+	principal, err := auth.FromContext(r.Context())
+	if err != nil {
+		s.unauthorized(w, r)
+		return
+	}
+	userId := principal.UserID
+
+	user, err := s.db.GetUserById(userId)
+	if err != nil {
+		s.serverError(w, r, err)
+		return
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		s.serverError(w, r, err)
+		return
+	}
+
+	ok, err := s.db.SetPendingTOTPSecret(userId, secret)
+	if err != nil {
+		s.serverError(w, r, err)
+		return
+	}
+	if !ok {
+		s.errorMessage(w, r, http.StatusConflict, "two-factor authentication is already enabled", nil)
+		return
+	}
+
+	err = response.JSON(w, http.StatusOK, struct {
+		Secret     string `json:"secret"`
+		OtpauthURI string `json:"otpauth_uri"`
+	}{Secret: secret, OtpauthURI: totp.URI(totpIssuer, user.Username, secret)})
+	if err != nil {
+		s.serverError(w, r, err)
+	}
+}
+
+// ConfirmTOTP enables TOTP once the user proves the authenticator app works, and returns the recovery codes.
+// The recovery codes are only shown once.
+func (s *Server) ConfirmTOTP(w http.ResponseWriter, r *http.Request) {
+	var req TOTPCodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.badRequest(w, r, err)
+		return
+	}
+
+	principal, err := auth.FromContext(r.Context())
+	if err != nil {
+		s.unauthorized(w, r)
+		return
+	}
+	userId := principal.UserID
+
+	config, err := s.db.GetTOTP(userId)
+	if err != nil {
+		s.serverError(w, r, err)
+		return
+	}
+	if config.Enabled {
+		s.errorMessage(w, r, http.StatusConflict, "two-factor authentication is already enabled", nil)
+		return
+	}
+	if config.Secret == "" {
+		s.badRequest(w, r, fmt.Errorf("start the enrollment first"))
+		return
+	}
+
+	step, ok := totp.Validate(config.Secret, req.Code, time.Now())
+	if !ok {
+		s.badRequest(w, r, fmt.Errorf("invalid code"))
+		return
+	}
+
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		codes[i] = generateRecoveryCode()
+		hashes[i] = hashToken(normalizeRecoveryCode(codes[i]))
+	}
+
+	err = s.db.EnableTOTP(userId, config.Secret, step, hashes)
+	if errors.Is(err, database.ErrTOTPEnrollmentChanged) {
+		s.errorMessage(w, r, http.StatusConflict, err.Error(), nil)
+		return
+	}
+	if err != nil {
+		s.serverError(w, r, err)
+		return
+	}
+
+	err = response.JSON(w, http.StatusOK, struct {
+		Message       string   `json:"message"`
+		RecoveryCodes []string `json:"recovery_codes"`
+	}{Message: "two-factor authentication enabled", RecoveryCodes: codes})
+	if err != nil {
+		s.serverError(w, r, err)
+	}
+}
+
+// DisableTOTP turns TOTP off, it requires a current TOTP or recovery code
+func (s *Server) DisableTOTP(w http.ResponseWriter, r *http.Request) {
+	var req TOTPCodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.badRequest(w, r, err)
+		return
+	}
+
+	principal, err := auth.FromContext(r.Context())
+	if err != nil {
+		s.unauthorized(w, r)
+		return
+	}
+	userId := principal.UserID
+
+	ok, err := s.verifySecondFactor(userId, req.Code)
+	if err != nil {
+		s.serverError(w, r, err)
+		return
+	}
+	if !ok {
+		s.badRequest(w, r, fmt.Errorf("invalid code"))
+		return
+	}
+
+	err = s.db.DisableTOTP(userId)
+	if err != nil {
+		s.serverError(w, r, err)
+		return
+	}
+
+	err = response.JSON(w, http.StatusOK, struct {
+		Message string `json:"message"`
+	}{Message: "two-factor authentication disabled"})
+	if err != nil {
+		s.serverError(w, r, err)
+	}
+}
+
+// LoginMFA exchanges the challenge returned by NewLogin and a TOTP or recovery code for a session token
+func (s *Server) LoginMFA(w http.ResponseWriter, r *http.Request) {
+	var req LoginMFARequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.badRequest(w, r, err)
+		return
+	}
+
+	var challenge mfaChallengeClaims
+	err := s.signer.Verify(purposeMFAChallenge, req.MFAToken, &challenge)
+	if err != nil {
+		if errors.Is(err, signing.ErrExpired) {
+			s.errorMessage(w, r, http.StatusUnauthorized, "login has expired, please log in again", nil)
+			return
+		}
+		s.errorMessage(w, r, http.StatusUnauthorized, "invalid mfa token", nil)
+		return
+	}
+
+	// Guessed codes count against the same budget as guessed passwords
+	user, err := s.db.GetUserById(challenge.UserId)
+	if err != nil {
+		s.serverError(w, r, err)
+		return
+	}
+	if !s.reserveLoginAttempt(w, r, user.Username) {
+		s.audit(r, database.AuditEvent{Type: auditLoginMFA, Outcome: database.AuditFailure, Reason: auditReasonLockedOut, ActorId: user.Id, Username: user.Username})
+		return
+	}
+
+	ok, err := s.verifySecondFactor(challenge.UserId, req.Code)
+	if err != nil {
+		s.serverError(w, r, err)
+		return
+	}
+	if !ok {
+		s.recordLoginFailure(r, user.Username)
+		s.audit(r, database.AuditEvent{Type: auditLoginMFA, Outcome: database.AuditFailure, Reason: auditReasonBadMFACode, ActorId: user.Id, Username: user.Username})
+		s.errorMessage(w, r, http.StatusUnauthorized, "invalid code", nil)
+		return
+	}
+	s.recordLoginSuccess(r, user.Username)
+	s.audit(r, database.AuditEvent{Type: auditLoginMFA, ActorId: user.Id, Username: user.Username})
+	if err := s.db.SetLastLoginProvider(user.Id, "web"); err != nil {
+		s.reportServerError(r, err)
+	}
+
+	tokens, err := s.createToken(r, challenge.UserId)
+	if err != nil {
+		s.createTokenError(w, r, err)
+		return
+	}
+
+	s.writeSession(w, r, tokens)
+}
+
+// mfaChallenge returns the challenge NewLogin hands out instead of a token
+func (s *Server) mfaChallenge(userId string) (*MFAChallengeResponse, error) {
+	token, err := s.signer.Sign(purposeMFAChallenge, mfaChallengeClaims{UserId: userId}, mfaChallengeTTL)
+	if err != nil {
+		return nil, err
+	}
+	return &MFAChallengeResponse{
+		MFARequired: true,
+		MFAToken:    token,
+		ExpiresIn:   int64(mfaChallengeTTL.Seconds()),
+	}, nil
+}
+
+// verifySecondFactor checks a TOTP code, or else a recovery code, of a user with TOTP enabled.
+// Both kinds of codes can only be used once.
+func (s *Server) verifySecondFactor(userId string, code string) (bool, error) {
+	config, err := s.db.GetTOTP(userId)
+	if err != nil {
+		return false, err
+	}
+	if !config.Enabled {
+		return false, nil
+	}
+
+	if step, ok := totp.Validate(config.Secret, code, time.Now()); ok {
+		return s.db.UseTOTPStep(userId, step)
+	}
+
+	code = normalizeRecoveryCode(code)
+	if len(code) != 10 {
+		return false, nil
+	}
+	return s.db.UseRecoveryCode(userId, hashToken(code))
+}
+
+// generateRecoveryCode returns a code such as "k7q2m-x9d4t"
+func generateRecoveryCode() string {
+	const charset = "abcdefghijkmnpqrstuvwxyz23456789"
+	b := make([]byte, 10)
+	rand.Read(b)
+	for i := range b {
+		b[i] = charset[b[i]%byte(len(charset))]
+	}
+	return string(b[:5]) + "-" + string(b[5:])
+}
+
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	code = strings.ReplaceAll(code, "-", "")
+	return strings.ReplaceAll(code, " ", "")
+}
@@ -0,0 +1,163 @@
+package server
+
+import (
+	"errors"
+	"github.com/google/uuid"
+	"github.com/markbates/goth"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"new_project/internal/database"
+	"strings"
+	"time"
+)
+
+// purposeOAuthState binds the state parameter to the OAuth login flow
+const purposeOAuthState = "oauth-state"
+
+// oauthStateTTL is how long the user has to complete the provider's consent screen
+const oauthStateTTL = 10 * time.Minute
+
+// Error codes passed to the OAuth error page in ?error=
+const (
+	oauthErrInvalidRequest      = "invalid_request"
+	oauthErrInvalidRedirect     = "invalid_redirect"
+	oauthErrUnknownProvider     = "unknown_provider"
+	oauthErrInvalidState        = "invalid_state"
+	oauthErrAccessDenied        = "access_denied"
+	oauthErrProvider            = "provider_error"
+	oauthErrEmailMissing        = "email_missing"
+	oauthErrAccountExists       = "account_exists"
+	oauthErrIdentityLinked      = "identity_linked_elsewhere"
+	oauthErrProviderLinked      = "provider_already_linked"
+	oauthErrSessionLimitReached = "session_limit_reached"
+	oauthErrServerError         = "server_error"
+)
+
+// errEmailMissing is returned when a new user signs up through a provider that did not share an email address
+var errEmailMissing = errors.New("the provider did not share an email address")
+
+// oauthState is carried through the provider in the signed state parameter
+type oauthState struct {
+	// Nonce makes every state unique, gothic compares it with the one stored in its session cookie
+	Nonce string `json:"n"`
+	// ReturnTo is the allow-listed page the browser lands on after the callback
+	ReturnTo string `json:"r"`
+	// LinkUserId is set when the flow links the identity to this user instead of logging in
+	LinkUserId string `json:"l,omitempty"`
+	// LinkNonce is the nonce of the link cookie the callback has to find in the browser
+	LinkNonce string `json:"ln,omitempty"`
+}
+
+// newOAuthState signs the state of a login started at /auth/{provider}, link is nil for logins
+func (s *Server) newOAuthState(returnTo string, link *linkIdentityClaims) (string, error) {
+	state := oauthState{
+		Nonce:    uuid.NewString(),
+		ReturnTo: returnTo,
+	}
+	if link != nil {
+		state.LinkUserId, state.LinkNonce = link.UserId, link.Nonce
+	}
+	return s.signer.Sign(purposeOAuthState, state, oauthStateTTL)
+}
+
+// checkLinkState makes sure the callback of a link flow runs in the browser that started it
+func (s *Server) checkLinkState(r *http.Request, state oauthState) error {
+	link, err := s.linkFromCookie(r)
+	if err != nil {
+		return err
+	}
+	if link.UserId != state.LinkUserId || link.Nonce == "" || link.Nonce != state.LinkNonce {
+		return errors.New("the link cookie does not match the OAuth state")
+	}
+	return nil
+}
+
+// oauthRedirectError sends the browser to the OAuth error page with a machine-readable error code
+func (s *Server) oauthRedirectError(w http.ResponseWriter, r *http.Request, code string, err error) {
+	attrs := []any{slog.String("code", code), slog.String("provider", oauthProvider(r))}
+	if err != nil {
+		attrs = append(attrs, slog.String("error", err.Error()))
+	}
+	s.logger.Warn("oauth login failed", attrs...)
+
+	target, parseErr := url.Parse(oauthErrorURL)
+	if parseErr != nil {
+		s.serverError(w, r, parseErr)
+		return
+	}
+	query := target.Query()
+	query.Set("error", code)
+	if provider := oauthProvider(r); provider != "" {
+		query.Set("provider", provider)
+	}
+	target.RawQuery = query.Encode()
+	http.Redirect(w, r, target.String(), http.StatusFound)
+}
+
+// oauthLoginErrorCode maps the errors of logging in or linking an identity to an error code
+func oauthLoginErrorCode(err error) string {
+	switch {
+	case errors.Is(err, errEmailMissing):
+		return oauthErrEmailMissing
+	case errors.Is(err, database.ErrUsernameTaken):
+		return oauthErrAccountExists
+	case errors.Is(err, database.ErrIdentityLinkedElsewhere):
+		return oauthErrIdentityLinked
+	case errors.Is(err, database.ErrProviderAlreadyLinked):
+		return oauthErrProviderLinked
+	case errors.Is(err, database.ErrSessionLimitReached):
+		return oauthErrSessionLimitReached
+	default:
+		return oauthErrServerError
+	}
+}
+
+// resolveReturnTo resolves return_to against the default OAuth redirect and checks it against
+// the allow-list. It returns false for targets outside the allow-list.
+func resolveReturnTo(returnTo string) (string, bool) {
+	base, err := url.Parse(oauthRedirectURL)
+	if err != nil {
+		return "", false
+	}
+	if returnTo == "" {
+		return base.String(), true
+	}
+
+	// Backslashes are treated as slashes by browsers, "/\evil.com" would leave the site
+	if strings.Contains(returnTo, `\`) {
+		return "", false
+	}
+	target, err := base.Parse(returnTo)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.User != nil {
+		return "", false
+	}
+
+	allowed := oauthAllowedRedirects
+	if len(allowed) == 0 {
+		allowed = []string{base.Scheme + "://" + base.Host}
+	}
+	for _, prefix := range allowed {
+		p, err := url.Parse(prefix)
+		if err != nil {
+			continue
+		}
+		if target.Scheme != p.Scheme || target.Host != p.Host {
+			continue
+		}
+		path := strings.TrimSuffix(p.Path, "/")
+		if path == "" || target.Path == path || strings.HasPrefix(target.Path, path+"/") {
+			return target.String(), true
+		}
+	}
+	return "", false
+}
+
+// oauthProvider returns the provider of an /auth/{provider} route, as long as it is registered
+func oauthProvider(r *http.Request) string {
+	provider, _ := r.Context().Value("provider").(string)
+	if _, err := goth.GetProvider(provider); err != nil {
+		return ""
+	}
+	return provider
+}
@@ -0,0 +1,93 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"new_project/internal/signing"
+	"testing"
+)
+
+func TestResolveReturnTo(t *testing.T) {
+	defer func(url string, allowed []string) { oauthRedirectURL, oauthAllowedRedirects = url, allowed }(oauthRedirectURL, oauthAllowedRedirects)
+	oauthRedirectURL = "https://app.example.com/dashboard"
+	oauthAllowedRedirects = []string{"https://app.example.com", "https://admin.example.com/console/"}
+
+	tests := []struct {
+		returnTo string
+		want     string
+		ok       bool
+	}{
+		{"", "https://app.example.com/dashboard", true},
+		{"/settings?tab=security", "https://app.example.com/settings?tab=security", true},
+		{"https://app.example.com/a/b", "https://app.example.com/a/b", true},
+		{"https://admin.example.com/console", "https://admin.example.com/console", true},
+		{"https://admin.example.com/console/users", "https://admin.example.com/console/users", true},
+		{"https://admin.example.com/consoles", "", false},
+		{"https://admin.example.com/", "", false},
+		{"https://evil.example.com/", "", false},
+		{"//evil.example.com/", "", false},
+		{`/\evil.example.com`, "", false},
+		{"http://app.example.com/", "", false},
+		{"https://app.example.com.evil.com/", "", false},
+		{"https://user@app.example.com/", "", false},
+		{"javascript:alert(1)", "", false},
+	}
+	for _, tt := range tests {
+		got, ok := resolveReturnTo(tt.returnTo)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("resolveReturnTo(%q) = %q, %t, want %q, %t", tt.returnTo, got, ok, tt.want, tt.ok)
+		}
+	}
+
+	// Without an allow-list only the origin of the default redirect is allowed
+	oauthAllowedRedirects = nil
+	if _, ok := resolveReturnTo("/settings"); !ok {
+		t.Error("expected a path on the default origin to be allowed")
+	}
+	if _, ok := resolveReturnTo("https://admin.example.com/console"); ok {
+		t.Error("expected another origin to be refused")
+	}
+}
+
+func TestCheckLinkState(t *testing.T) {
+	s := &Server{signer: signing.New([]byte("secret"))}
+	cookie := func(link linkIdentityClaims) *http.Cookie {
+		token, err := s.signer.Sign(purposeLinkIdentity, link, linkIdentityTTL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &http.Cookie{Name: linkIdentityCookie, Value: token}
+	}
+
+	// The attacker starts a link for their own account and sends the URL to the victim
+	attacker := linkIdentityClaims{UserId: "attacker", Nonce: "n1"}
+	signed, err := s.newOAuthState("https://app.example.com/", &attacker)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var state oauthState
+	if err := s.signer.Verify(purposeOAuthState, signed, &state); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		cookie  *http.Cookie
+		wantErr bool
+	}{
+		{"browser that started the link", cookie(attacker), false},
+		{"browser without the cookie", nil, true},
+		{"link of another user", cookie(linkIdentityClaims{UserId: "victim", Nonce: "n2"}), true},
+		{"another link of the same user", cookie(linkIdentityClaims{UserId: "attacker", Nonce: "n3"}), true},
+		{"forged cookie", &http.Cookie{Name: linkIdentityCookie, Value: "forged"}, true},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/auth/google/callback", nil)
+		if tt.cookie != nil {
+			req.AddCookie(tt.cookie)
+		}
+		if err := s.checkLinkState(req, state); (err != nil) != tt.wantErr {
+			t.Errorf("%s: expected error %t, got %v", tt.name, tt.wantErr, err)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/bcrypt"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"new_project/internal/database"
+	"new_project/internal/mailer"
+	"new_project/internal/response"
+	"time"
+)
+
+// ForgotPasswordRequest represents the data needed to request a password reset
+type ForgotPasswordRequest struct {
+	Email string `json:"email"`
+}
+
+// ResetPasswordRequest represents the data needed to set a new password
+type ResetPasswordRequest struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+// ForgotPassword emails a single-use reset link to the account registered with the address.
+// The response is the same whether or not the account exists, and whether or not a link was sent
+// less than PASSWORD_RESET_RESEND_INTERVAL ago, in which case no new one is sent.
+func (s *Server) ForgotPassword(w http.ResponseWriter, r *http.Request) {
+	var req ForgotPasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.badRequest(w, r, err)
+		return
+	}
+
+	address, err := mail.ParseAddress(req.Email)
+	if err != nil {
+		s.badRequest(w, r, fmt.Errorf("a valid email is required"))
+		return
+	}
+
+	// Usernames are email addresses, the lookup and the mail happen in the background
+	// so that the response time does not reveal whether the account exists
+	email := address.Address
+	s.backgroundTask(r, func() error {
+		userID, _, err := s.db.GetHashedPassword(email)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		token := generateOpaqueToken()
+		err = s.db.CreatePasswordReset(userID, hashToken(token), time.Now().Add(passwordResetTTL), passwordResetResendInterval)
+		if errors.Is(err, database.ErrPasswordResetThrottled) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		link, err := url.Parse(passwordResetURL)
+		if err != nil {
+			return err
+		}
+		query := link.Query()
+		query.Set("token", token)
+		link.RawQuery = query.Encode()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		return s.mailer.Send(ctx, mailer.Message{
+			To:      email,
+			Subject: "Reset your password",
+			Body: fmt.Sprintf("Someone asked to reset the password of your account.\n\n"+
+				"Open the link below to choose a new password. It expires in %s and can only be used once.\n\n%s\n\n"+
+				"If this was not you, you can ignore this email.\n", passwordResetTTL, link),
+		})
+	})
+
+	err = response.JSON(w, http.StatusAccepted, struct {
+		Message string `json:"message"`
+	}{Message: "if an account exists for this email, a reset link has been sent"})
+	if err != nil {
+		s.serverError(w, r, err)
+	}
+}
+
+// ResetPassword sets a new password using a reset token and logs the user out everywhere
+func (s *Server) ResetPassword(w http.ResponseWriter, r *http.Request) {
+	var req ResetPasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.badRequest(w, r, err)
+		return
+	}
+
+	if req.Token == "" {
+		s.badRequest(w, r, fmt.Errorf("token is required"))
+		return
+	}
+	if err := validatePassword(req.Password); err != nil {
+		s.badRequest(w, r, err)
+		return
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	if err != nil {
+		s.serverError(w, r, err)
+		return
+	}
+
+	_, err = s.db.ResetPassword(hashToken(req.Token), string(hashedPassword))
+	if err != nil {
+		if errors.Is(err, database.ErrResetTokenInvalid) {
+			s.badRequest(w, r, err)
+			return
+		}
+		s.serverError(w, r, err)
+		return
+	}
+
+	err = response.JSON(w, http.StatusOK, struct {
+		Message string `json:"message"`
+	}{Message: "password has been reset, please log in again"})
+	if err != nil {
+		s.serverError(w, r, err)
+	}
+}
+
+// validatePassword checks the rules for new passwords
+func validatePassword(password string) error {
+	switch {
+	case len(password) < 8:
+		return fmt.Errorf("password must be at least 8 characters long")
+	case len(password) > 72:
+		// bcrypt ignores everything after 72 bytes
+		return fmt.Errorf("password must not be longer than 72 bytes")
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+package server
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"new_project/internal/database"
+	"strings"
+	"testing"
+)
+
+type resetDB struct {
+	database.Service
+	lookupErr error
+}
+
+func (db *resetDB) GetHashedPassword(username string) (string, string, error) {
+	return "", "", db.lookupErr
+}
+
+func TestForgotPasswordReportsLookupErrors(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		wantLogged bool
+	}{
+		{"unknown address", sql.ErrNoRows, false},
+		{"database down", errors.New("connection refused"), true},
+	}
+	for _, tt := range tests {
+		var logs bytes.Buffer
+		s := &Server{db: &resetDB{lookupErr: tt.err}, logger: slog.New(slog.NewTextHandler(&logs, nil))}
+
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/password/forgot", strings.NewReader(`{"email":"jane@example.com"}`))
+		rr := httptest.NewRecorder()
+		s.ForgotPassword(rr, req)
+		s.wg.Wait()
+
+		if rr.Code != http.StatusAccepted {
+			t.Errorf("%s: expected status 202, got %d", tt.name, rr.Code)
+		}
+		if logged := strings.Contains(logs.String(), "connection refused"); logged != tt.wantLogged {
+			t.Errorf("%s: expected logged %t, got %t (%s)", tt.name, tt.wantLogged, logged, logs.String())
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/bcrypt"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"new_project/internal/auth"
+	"new_project/internal/database"
+	"new_project/internal/response"
+	"strings"
+	"unicode/utf8"
+)
+
+// UpdateUserRequest represents the profile fields to change, omitted fields are left as they are.
+// The username is the login, changing it needs the current password.
+type UpdateUserRequest struct {
+	Username        *string `json:"username"`
+	FullName        *string `json:"full_name"`
+	UserImage       *string `json:"user_image"`
+	CurrentPassword string  `json:"current_password"`
+}
+
+// ChangePasswordRequest represents the data needed to change the password of the logged-in user
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
+// UpdateUser changes the profile of the logged-in user and returns the updated user
+func (s *Server) UpdateUser(w http.ResponseWriter, r *http.Request) {
+	var req UpdateUserRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.badRequest(w, r, err)
+		return
+	}
+
+	if err := req.validate(); err != nil {
+		s.badRequest(w, r, err)
+		return
+	}
+
+	principal, err := auth.FromContext(r.Context())
+	if err != nil {
+		s.unauthorized(w, r)
+		return
+	}
+	userId := principal.UserID
+
+	user, err := s.db.GetUserById(userId)
+	if err != nil {
+		s.serverError(w, r, err)
+		return
+	}
+
+	// Whoever controls the username can take over the account through the password reset,
+	// so a stolen access token alone is not enough to change it
+	if req.Username != nil && *req.Username != user.Username {
+		if !s.checkCurrentPassword(w, r, user.Username, req.CurrentPassword) {
+			return
+		}
+	}
+
+	renamed, err := s.db.UpdateUser(userId, &database.UserUpdate{
+		Username:  req.Username,
+		FullName:  req.FullName,
+		UserImage: req.UserImage,
+	}, usernameReservationPeriod)
+	if err != nil {
+		if errors.Is(err, database.ErrUsernameTaken) {
+			s.errorMessage(w, r, http.StatusConflict, err.Error(), nil)
+			return
+		}
+		s.serverError(w, r, err)
+		return
+	}
+
+	// The new address has to be verified again
+	if renamed {
+		if _, err := mail.ParseAddress(*req.Username); err == nil {
+			if err := s.sendVerificationEmail(r, userId); err != nil {
+				s.reportServerError(r, err)
+			}
+		}
+	}
+
+	user, err = s.db.GetUserById(userId)
+	if err != nil {
+		s.serverError(w, r, err)
+		return
+	}
+
+	err = response.JSON(w, http.StatusOK, user)
+	if err != nil {
+		s.serverError(w, r, err)
+	}
+}
+
+// ChangePassword replaces the password of the logged-in user after checking the current one,
+// every other session of the user is logged out
+func (s *Server) ChangePassword(w http.ResponseWriter, r *http.Request) {
+	var req ChangePasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.badRequest(w, r, err)
+		return
+	}
+
+	if err := validatePassword(req.NewPassword); err != nil {
+		s.badRequest(w, r, err)
+		return
+	}
+
+	principal, err := auth.FromContext(r.Context())
+	if err != nil {
+		s.unauthorized(w, r)
+		return
+	}
+	userId := principal.UserID
+	currentSessionId := principal.SessionID
+
+	user, err := s.db.GetUserById(userId)
+	if err != nil {
+		s.serverError(w, r, err)
+		return
+	}
+
+	if !s.checkCurrentPassword(w, r, user.Username, req.CurrentPassword) {
+		return
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(req.NewPassword), bcrypt.DefaultCost)
+	if err != nil {
+		s.serverError(w, r, err)
+		return
+	}
+
+	err = s.db.ChangePassword(userId, string(hash), currentSessionId)
+	if err != nil {
+		s.serverError(w, r, err)
+		return
+	}
+
+	err = response.JSON(w, http.StatusOK, struct {
+		Message string `json:"message"`
+	}{Message: "password changed, your other sessions have been logged out and your API keys revoked"})
+	if err != nil {
+		s.serverError(w, r, err)
+	}
+}
+
+// checkCurrentPassword confirms a sensitive change with the password of the logged-in user.
+// It writes the error response and returns false when the password is missing or wrong.
+func (s *Server) checkCurrentPassword(w http.ResponseWriter, r *http.Request, username string, password string) bool {
+	// The current password is as guessable here as on the login page
+	if !s.reserveLoginAttempt(w, r, username) {
+		return false
+	}
+
+	_, hashedPassword, err := s.db.GetHashedPassword(username)
+	if err != nil {
+		s.serverError(w, r, err)
+		return false
+	}
+	if hashedPassword == "" {
+		s.releaseLoginAttempt(r, username)
+		s.badRequest(w, r, fmt.Errorf("your account has no password yet, use the password reset to set one"))
+		return false
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(password)); err != nil {
+		s.recordLoginFailure(r, username)
+		s.badRequest(w, r, fmt.Errorf("current password is incorrect"))
+		return false
+	}
+	s.releaseLoginAttempt(r, username)
+	return true
+}
+
+func (req *UpdateUserRequest) validate() error {
+	if req.Username != nil {
+		username := strings.TrimSpace(*req.Username)
+		req.Username = &username
+		switch {
+		case len(username) < 3 || len(username) > 50:
+			return fmt.Errorf("username must be between 3 and 50 characters long")
+		case requireVerifiedEmail:
+			// Unverified accounts are locked out, so the username has to be an address we can verify
+			if _, err := mail.ParseAddress(username); err != nil {
+				return fmt.Errorf("username must be a valid email address")
+			}
+		}
+	}
+
+	if req.FullName != nil {
+		fullName := strings.TrimSpace(*req.FullName)
+		req.FullName = &fullName
+		if fullName == "" || utf8.RuneCountInString(fullName) > 100 {
+			return fmt.Errorf("full_name must be between 1 and 100 characters long")
+		}
+	}
+
+	if req.UserImage != nil && *req.UserImage != "" {
+		image, err := url.Parse(*req.UserImage)
+		if err != nil || (image.Scheme != "https" && image.Scheme != "http") || image.Host == "" || len(*req.UserImage) > 2048 {
+			return fmt.Errorf("user_image must be an http(s) URL of at most 2048 characters")
+		}
+	}
+	return nil
+}
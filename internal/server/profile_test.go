@@ -0,0 +1,115 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"golang.org/x/crypto/bcrypt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"new_project/internal/auth"
+	"new_project/internal/database"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUpdateUserRequestValidate(t *testing.T) {
+	str := func(s string) *string { return &s }
+
+	tests := []struct {
+		name string
+		req  UpdateUserRequest
+		ok   bool
+	}{
+		{"empty", UpdateUserRequest{}, true},
+		{"full name", UpdateUserRequest{FullName: str("  Jane Doe ")}, true},
+		{"blank full name", UpdateUserRequest{FullName: str("   ")}, false},
+		{"long full name", UpdateUserRequest{FullName: str(strings.Repeat("é", 101))}, false},
+		{"image", UpdateUserRequest{UserImage: str("https://cdn.example.com/a.png")}, true},
+		{"remove image", UpdateUserRequest{UserImage: str("")}, true},
+		{"relative image", UpdateUserRequest{UserImage: str("/a.png")}, false},
+		{"javascript image", UpdateUserRequest{UserImage: str("javascript:alert(1)")}, false},
+		{"username", UpdateUserRequest{Username: str("jane@example.com")}, true},
+		{"short username", UpdateUserRequest{Username: str("ja")}, false},
+		{"long username", UpdateUserRequest{Username: str(strings.Repeat("a", 51))}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.req.validate(); (err == nil) != tt.ok {
+			t.Errorf("%s: validate() = %v, want ok %t", tt.name, err, tt.ok)
+		}
+	}
+
+	req := UpdateUserRequest{FullName: str("  Jane  ")}
+	req.validate()
+	if *req.FullName != "Jane" {
+		t.Errorf("expected full name to be trimmed, got %q", *req.FullName)
+	}
+}
+
+// profileDB holds a single user with a password
+type profileDB struct {
+	database.Service
+	username string
+	hash     string
+	updates  []database.UserUpdate
+}
+
+func (db *profileDB) GetUserById(userId string) (*database.User, error) {
+	return &database.User{Id: userId, Username: db.username}, nil
+}
+
+func (db *profileDB) GetHashedPassword(username string) (string, string, error) {
+	return "u1", db.hash, nil
+}
+
+func (db *profileDB) ReserveLoginAttempt(scope string, key string, window time.Duration, maxFailures int, lockout time.Duration, retryAfter func(*database.LoginThrottle) time.Duration) (*database.LoginThrottle, time.Duration, error) {
+	return &database.LoginThrottle{Failures: 1}, 0, nil
+}
+
+func (db *profileDB) ReleaseLoginAttempt(scope string, key string) error {
+	return nil
+}
+
+func (db *profileDB) UpdateUser(userId string, update *database.UserUpdate, reservation time.Duration) (bool, error) {
+	db.updates = append(db.updates, *update)
+	return update.Username != nil && *update.Username != db.username, nil
+}
+
+func TestUpdateUserUsernameNeedsPassword(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("correct horse"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		body        map[string]string
+		want        int
+		wantUpdated bool
+	}{
+		{"rename without password", map[string]string{"username": "mallory"}, http.StatusBadRequest, false},
+		{"rename with wrong password", map[string]string{"username": "mallory", "current_password": "guess"}, http.StatusBadRequest, false},
+		{"rename with password", map[string]string{"username": "jane_doe", "current_password": "correct horse"}, http.StatusOK, true},
+		{"full name only", map[string]string{"full_name": "Jane"}, http.StatusOK, true},
+		{"unchanged username", map[string]string{"username": "jane", "full_name": "Jane"}, http.StatusOK, true},
+	}
+	for _, tt := range tests {
+		db := &profileDB{username: "jane", hash: string(hash)}
+		s := &Server{db: db, logger: slog.New(slog.NewTextHandler(io.Discard, nil))}
+
+		body, _ := json.Marshal(tt.body)
+		req := httptest.NewRequest(http.MethodPatch, "/api/p/v1/user", bytes.NewReader(body))
+		req = req.WithContext(auth.NewContext(req.Context(), &auth.Principal{UserID: "u1", Method: auth.MethodBearer}))
+		rr := httptest.NewRecorder()
+		s.UpdateUser(rr, req)
+
+		if rr.Code != tt.want {
+			t.Errorf("%s: expected status %d, got %d (%s)", tt.name, tt.want, rr.Code, rr.Body.String())
+		}
+		if updated := len(db.updates) > 0; updated != tt.wantUpdated {
+			t.Errorf("%s: expected updated %t, got %t", tt.name, tt.wantUpdated, updated)
+		}
+	}
+}
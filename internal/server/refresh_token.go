@@ -0,0 +1,187 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-chi/jwtauth/v5"
+	"github.com/google/uuid"
+	"log/slog"
+	"net/http"
+	"new_project/internal/database"
+	"new_project/internal/response"
+	"time"
+)
+
+const refreshTokenCookie = "refresh_token"
+
+// TokenPair is returned to clients on login and on every refresh
+type TokenPair struct {
+	AccessToken  string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int64  `json:"expires_in"`
+	// PasswordRemoved is set when a magic link login cleared a password set by someone else
+	PasswordRemoved bool `json:"password_removed,omitempty"`
+	// sessionId is the token family, CSRF tokens of cookie mode are bound to it
+	sessionId string
+}
+
+// RefreshRequest represents the data needed to rotate a refresh token
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// RefreshToken exchanges a refresh token for a new access token and a new refresh token.
+// The refresh token can be sent in the body or, for browser clients, in the refresh_token cookie.
+func (s *Server) RefreshToken(w http.ResponseWriter, r *http.Request) {
+	var req RefreshRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			s.badRequest(w, r, err)
+			return
+		}
+	}
+
+	fromCookie := false
+	if req.RefreshToken == "" {
+		if cookie, err := r.Cookie(refreshTokenCookie); err == nil {
+			req.RefreshToken = cookie.Value
+			fromCookie = true
+		}
+	}
+	if req.RefreshToken == "" {
+		s.badRequest(w, r, fmt.Errorf("refresh token is required"))
+		return
+	}
+
+	// Browsers send the cookie on their own, so the CSRF token is checked before anything is rotated
+	if fromCookie {
+		if _, ok := s.csrfSessionId(r); !ok {
+			s.errorMessage(w, r, http.StatusForbidden, "missing or invalid CSRF token", nil)
+			return
+		}
+	}
+
+	// The access token is recorded together with the rotation, a failure leaves the old refresh token usable
+	newRefreshToken := generateOpaqueToken()
+	var accessToken string
+	issue := func(userId string, familyId string) (*database.AccessToken, error) {
+		tokenString, record, err := s.signAccessToken(userId, familyId)
+		accessToken = tokenString
+		return record, err
+	}
+	rotated, err := s.db.RotateRefreshToken(hashToken(req.RefreshToken), hashToken(newRefreshToken), time.Now().Add(refreshTokenTTL), issue)
+	switch {
+	case errors.Is(err, database.ErrRefreshTokenReused):
+		s.logger.Warn("refresh token reuse detected, token family revoked",
+			slog.String("ip", r.RemoteAddr),
+			slog.String("user_agent", r.UserAgent()),
+		)
+		s.audit(r, database.AuditEvent{Type: auditTokenReused, Outcome: database.AuditFailure, Reason: "refresh_token_reused"})
+		s.errorMessage(w, r, http.StatusUnauthorized, "refresh token has been revoked, please log in again", nil)
+		return
+	case errors.Is(err, database.ErrRefreshTokenInvalid):
+		s.errorMessage(w, r, http.StatusUnauthorized, err.Error(), nil)
+		return
+	case err != nil:
+		s.serverError(w, r, err)
+		return
+	}
+
+	pair := &TokenPair{
+		AccessToken:  accessToken,
+		RefreshToken: newRefreshToken,
+		ExpiresIn:    int64(accessTokenTTL.Seconds()),
+		sessionId:    rotated.FamilyId,
+	}
+
+	// Cookie mode sessions get their tokens back in cookies only
+	if fromCookie {
+		session, err := s.setSessionCookies(w, pair)
+		if err != nil {
+			s.serverError(w, r, err)
+			return
+		}
+		err = response.JSON(w, http.StatusOK, session)
+		if err != nil {
+			s.serverError(w, r, err)
+		}
+		return
+	}
+
+	err = response.JSON(w, http.StatusOK, pair)
+	if err != nil {
+		s.serverError(w, r, err)
+	}
+}
+
+// issueAccessToken signs a short-lived JWT for the user and records it under the given token family
+func (s *Server) issueAccessToken(userId string, familyId string) (string, error) {
+	tokenString, record, err := s.signAccessToken(userId, familyId)
+	if err != nil {
+		return "", err
+	}
+
+	err = s.db.InsertToken(userId, familyId, record.Jti, record.TokenHash, record.ExpiresAt)
+	if err != nil {
+		return "", err
+	}
+	return tokenString, nil
+}
+
+// signAccessToken signs a short-lived JWT for the user in the given token family, and returns
+// it with the record the tokens table needs for it
+func (s *Server) signAccessToken(userId string, familyId string) (string, *database.AccessToken, error) {
+	// The role is read again on every refresh, so role changes apply within accessTokenTTL
+	user, err := s.db.GetUserById(userId)
+	if err != nil {
+		return "", nil, err
+	}
+
+	// The jti identifies the token in the tokens table, so that it can be revoked before it expires
+	jti := uuid.NewString()
+	claims := map[string]interface{}{
+		"jti":     jti,
+		"user_id": userId,
+		"sid":     familyId,
+		"role":    user.Role,
+	}
+	jwtauth.SetExpiryIn(claims, accessTokenTTL)
+	jwtauth.SetIssuedNow(claims)
+
+	_, tokenString, err := s.tokenAuth.Encode(claims)
+	if err != nil {
+		return "", nil, err
+	}
+	return tokenString, &database.AccessToken{Jti: jti, TokenHash: hashToken(tokenString), ExpiresAt: time.Now().Add(accessTokenTTL)}, nil
+}
+
+// generateOpaqueToken returns a random, URL-safe token used for refresh tokens and emailed links
+func generateOpaqueToken() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// hashToken returns the hex encoded SHA-256 digest under which a token is stored
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func setRefreshTokenCookie(w http.ResponseWriter, refreshToken string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     refreshTokenCookie,
+		Value:    refreshToken,
+		Path:     "/api/v1/token",
+		MaxAge:   int(refreshTokenTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   cookieSecure,
+		SameSite: http.SameSiteLaxMode,
+		Domain:   cookieDomain,
+	})
+}
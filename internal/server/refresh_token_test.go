@@ -0,0 +1,57 @@
+package server
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"new_project/internal/database"
+	"strings"
+	"testing"
+	"time"
+)
+
+type refreshDB struct {
+	database.Service
+	rotateErr error
+	audited   []database.AuditEvent
+}
+
+func (db *refreshDB) RotateRefreshToken(tokenHash string, newTokenHash string, expiresAt time.Time, issue func(userID string, familyID string) (*database.AccessToken, error)) (*database.RefreshToken, error) {
+	return nil, db.rotateErr
+}
+
+func (db *refreshDB) InsertAuditEvent(event *database.AuditEvent) error {
+	db.audited = append(db.audited, *event)
+	return nil
+}
+
+func TestRefreshTokenRejected(t *testing.T) {
+	tests := []struct {
+		name      string
+		err       error
+		wantAudit string
+	}{
+		{"rotated or expired", database.ErrRefreshTokenInvalid, ""},
+		{"replayed", database.ErrRefreshTokenReused, auditTokenReused},
+	}
+	for _, tt := range tests {
+		db := &refreshDB{rotateErr: tt.err}
+		s := &Server{db: db, logger: slog.New(slog.NewTextHandler(io.Discard, nil))}
+
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/token/refresh", strings.NewReader(`{"refresh_token":"old"}`))
+		rr := httptest.NewRecorder()
+		s.RefreshToken(rr, req)
+
+		if rr.Code != http.StatusUnauthorized {
+			t.Errorf("%s: expected status 401, got %d", tt.name, rr.Code)
+		}
+		var audited string
+		if len(db.audited) > 0 {
+			audited = db.audited[0].Type
+		}
+		if audited != tt.wantAudit {
+			t.Errorf("%s: expected audit event %q, got %q", tt.name, tt.wantAudit, audited)
+		}
+	}
+}
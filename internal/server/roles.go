@@ -0,0 +1,173 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"net/http"
+	"new_project/internal/database"
+	"new_project/internal/response"
+	"regexp"
+)
+
+// roleName keeps custom roles in the style of the seeded USER and ADMIN roles
+var roleName = regexp.MustCompile(`^[A-Z][A-Z0-9_]{1,49}$`)
+
+type RolesResp struct {
+	Roles []database.Role `json:"roles"`
+}
+
+type PermissionsResp struct {
+	Permissions []database.Permission `json:"permissions"`
+}
+
+// RoleRequest represents the data needed to create or change a custom role
+type RoleRequest struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Permissions []string `json:"permissions"`
+}
+
+// UserRoleRequest represents the role to assign to a user
+type UserRoleRequest struct {
+	Role string `json:"role"`
+}
+
+// GetPermissions lists the permissions roles can be granted
+func (s *Server) GetPermissions(w http.ResponseWriter, r *http.Request) {
+	permissions, err := s.db.GetPermissions()
+	if err != nil {
+		s.serverError(w, r, err)
+		return
+	}
+
+	err = response.JSON(w, http.StatusOK, PermissionsResp{Permissions: permissions})
+	if err != nil {
+		s.serverError(w, r, err)
+	}
+}
+
+// GetRoles lists the roles and their permissions
+func (s *Server) GetRoles(w http.ResponseWriter, r *http.Request) {
+	roles, err := s.db.GetRoles()
+	if err != nil {
+		s.serverError(w, r, err)
+		return
+	}
+
+	err = response.JSON(w, http.StatusOK, RolesResp{Roles: roles})
+	if err != nil {
+		s.serverError(w, r, err)
+	}
+}
+
+// CreateRole adds a custom role
+func (s *Server) CreateRole(w http.ResponseWriter, r *http.Request) {
+	var req RoleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.badRequest(w, r, err)
+		return
+	}
+
+	if !roleName.MatchString(req.Name) {
+		s.badRequest(w, r, fmt.Errorf("name must be 2 to 50 upper-case letters, digits or underscores, starting with a letter"))
+		return
+	}
+
+	role, err := s.db.CreateRole(&database.Role{Name: req.Name, Description: req.Description, Permissions: req.Permissions})
+	if err != nil {
+		s.roleError(w, r, err)
+		return
+	}
+
+	err = response.JSON(w, http.StatusCreated, role)
+	if err != nil {
+		s.serverError(w, r, err)
+	}
+}
+
+// UpdateRole replaces the description and permissions of a custom role
+func (s *Server) UpdateRole(w http.ResponseWriter, r *http.Request) {
+	var req RoleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.badRequest(w, r, err)
+		return
+	}
+
+	role, err := s.db.UpdateRole(chi.URLParam(r, "name"), req.Description, req.Permissions)
+	if err != nil {
+		s.roleError(w, r, err)
+		return
+	}
+
+	err = response.JSON(w, http.StatusOK, role)
+	if err != nil {
+		s.serverError(w, r, err)
+	}
+}
+
+// DeleteRole removes a custom role that is no longer assigned to any user
+func (s *Server) DeleteRole(w http.ResponseWriter, r *http.Request) {
+	err := s.db.DeleteRole(chi.URLParam(r, "name"))
+	if err != nil {
+		s.roleError(w, r, err)
+		return
+	}
+
+	err = response.JSON(w, http.StatusOK, struct {
+		Message string `json:"message"`
+	}{Message: "role deleted"})
+	if err != nil {
+		s.serverError(w, r, err)
+	}
+}
+
+// SetUserRole assigns a role to a user, it applies to permission checks right away
+func (s *Server) SetUserRole(w http.ResponseWriter, r *http.Request) {
+	userId := chi.URLParam(r, "id")
+	if _, err := uuid.Parse(userId); err != nil {
+		s.notFound(w, r)
+		return
+	}
+
+	var req UserRoleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.badRequest(w, r, err)
+		return
+	}
+
+	found, err := s.db.SetUserRole(userId, req.Role)
+	if err != nil {
+		s.roleError(w, r, err)
+		return
+	}
+	if !found {
+		s.notFound(w, r)
+		return
+	}
+
+	err = response.JSON(w, http.StatusOK, struct {
+		Message string `json:"message"`
+	}{Message: fmt.Sprintf("role %s assigned", req.Role)})
+	if err != nil {
+		s.serverError(w, r, err)
+	}
+}
+
+// roleError writes the response for a failed role operation
+func (s *Server) roleError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, database.ErrRoleNotFound):
+		s.errorMessage(w, r, http.StatusNotFound, err.Error(), nil)
+	case errors.Is(err, database.ErrRoleExists), errors.Is(err, database.ErrRoleInUse):
+		s.errorMessage(w, r, http.StatusConflict, err.Error(), nil)
+	case errors.Is(err, database.ErrSystemRole):
+		s.errorMessage(w, r, http.StatusForbidden, err.Error(), nil)
+	case errors.Is(err, database.ErrUnknownPermission):
+		s.badRequest(w, r, err)
+	default:
+		s.serverError(w, r, err)
+	}
+}
@@ -2,10 +2,13 @@ package server
 
 import (
 	"encoding/json"
+	"expvar"
 	"github.com/go-chi/cors"
 	"github.com/go-chi/jwtauth/v5"
 	"log"
 	"net/http"
+	"new_project/internal/auth"
+	"new_project/internal/database"
 	"new_project/internal/response"
 
 	"fmt"
@@ -17,17 +20,6 @@ import (
 	"github.com/coder/websocket"
 )
 
-var tokenAuth *jwtauth.JWTAuth
-
-func init() {
-	tokenAuth = jwtauth.New("HS256", []byte("secret"), nil)
-
-	// For debugging/example purposes, we generate and print
-	// a sample jwt token with claims `user_id:123` here:
-	_, tokenString, _ := tokenAuth.Encode(map[string]interface{}{"user_id": 123})
-	fmt.Printf("DEBUG: a sample jwt is %s\n\n", tokenString)
-}
-
 func (s *Server) RegisterRoutes() http.Handler {
 	r := chi.NewRouter()
 	r.Use(middleware.RequestID)
@@ -35,14 +27,20 @@ func (s *Server) RegisterRoutes() http.Handler {
 	r.Use(middleware.Logger)
 	r.Use(middleware.Recoverer)
 	//r.Use(response.JSONErrorMiddleware)
+	// Cookie mode sessions only work cross-origin for the origins listed in CORS_ALLOWED_ORIGINS,
+	// any origin may call the API with an Authorization header
+	allowedOrigins, allowCredentials := []string{"https://*", "http://*"}, false
+	if len(corsAllowedOrigins) > 0 {
+		allowedOrigins, allowCredentials = corsAllowedOrigins, true
+	}
 	r.Use(cors.Handler(cors.Options{
 		// AllowedOrigins:   []string{"https://foo.com"}, // Use this to allow specific origin hosts
-		AllowedOrigins: []string{"https://*", "http://*"},
+		AllowedOrigins: allowedOrigins,
 		// AllowOriginFunc:  func(r *http.Request, origin string) bool { return true },
-		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
+		AllowedMethods:   []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
 		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token"},
 		ExposedHeaders:   []string{"Link"},
-		AllowCredentials: false,
+		AllowCredentials: allowCredentials,
 		MaxAge:           300, // Maximum value not ignored by any of major browsers
 	}))
 
@@ -68,11 +66,13 @@ func (s *Server) RegisterRoutes() http.Handler {
 
 	r.Get("/health", s.healthHandler)
 
+	r.Get("/.well-known/jwks.json", s.jwksHandler)
+
 	//r.Post("/login", s.Login)
 	// Protected routes
 	r.Group(func(r chi.Router) {
 		// Seek, verify and validate JWT tokens
-		r.Use(jwtauth.Verifier(tokenAuth))
+		r.Use(s.tokenAuth.Verifier())
 
 		// Handle valid / invalid tokens. In this example, we use
 		// the provided authenticator middleware, but you can write your
@@ -80,43 +80,135 @@ func (s *Server) RegisterRoutes() http.Handler {
 		// and tweak it, its not scary.
 		//r.Use(jwtauth.Authenticator(tokenAuth))
 		r.Use(s.authenticator())
+		r.Use(s.csrfProtect())
 
-		r.Get("/admin", func(w http.ResponseWriter, r *http.Request) {
-			_, claims, _ := jwtauth.FromContext(r.Context())
-			message := fmt.Sprintf("protected area. hi %v", claims["user_id"])
+		r.With(s.RequirePermission(database.PermAdminAccess)).Get("/admin", func(w http.ResponseWriter, r *http.Request) {
+			principal, err := auth.FromContext(r.Context())
+			if err != nil {
+				s.unauthorized(w, r)
+				return
+			}
+			message := fmt.Sprintf("protected area. hi %v", principal.UserID)
 
 			resp := make(map[string]string)
 			resp["message"] = message
-			err := response.JSON(w, http.StatusOK, resp)
+			err = response.JSON(w, http.StatusOK, resp)
 			if err != nil {
 				s.serverError(w, r, err)
 			}
 		})
 
 		r.Route("/api/p/v1", func(r chi.Router) {
+			// Reachable before the email address is verified
 			r.Get("/logout", s.Logout)
 			r.Get("/user", s.GetUserDetailsByUserId)
-
-			r.Post("/workspace", s.AddWorkspace)
-			r.Get("/workspace", s.GetAllWorkspace)
-			r.Get("/workspace/{workspaceId}", s.GetWorkspaceById)
+			r.With(s.rejectAPIKeys(), s.rejectImpersonation()).Patch("/user", s.UpdateUser)
+			// Exporting and deleting the account needs an interactive login of the user
+			r.With(s.rejectAPIKeys(), s.rejectImpersonation()).Get("/user/export", s.ExportUserData)
+			r.With(s.rejectAPIKeys(), s.rejectImpersonation()).Delete("/user", s.DeleteUser)
+			r.Post("/email/verification/resend", s.ResendVerificationEmail)
+
+			r.Group(func(r chi.Router) {
+				r.Use(s.requireVerifiedEmailMiddleware())
+
+				// Managing the account itself needs an interactive login of the user
+				r.Group(func(r chi.Router) {
+					r.Use(s.rejectAPIKeys())
+					r.Use(s.rejectImpersonation())
+
+					r.Post("/user/password", s.ChangePassword)
+
+					r.Post("/mfa/totp/enroll", s.EnrollTOTP)
+					r.Post("/mfa/totp/confirm", s.ConfirmTOTP)
+					r.Post("/mfa/totp/disable", s.DisableTOTP)
+
+					r.Get("/identities", s.GetIdentities)
+					r.Post("/identities/{provider}", s.LinkIdentity)
+					r.Delete("/identities/{provider}", s.UnlinkIdentity)
+
+					r.Get("/sessions", s.GetSessions)
+					r.Delete("/sessions/{id}", s.RevokeSession)
+					r.Post("/sessions/revoke-all", s.RevokeOtherSessions)
+
+					r.Get("/api-keys", s.GetAPIKeys)
+					r.Post("/api-keys", s.CreateAPIKey)
+					r.Delete("/api-keys/{id}", s.RevokeAPIKey)
+				})
+
+				r.Route("/admin", func(r chi.Router) {
+					r.Use(s.RequirePermission(database.PermAdminAccess))
+
+					// Runtime and token janitor metrics
+					r.Get("/metrics", expvar.Handler().ServeHTTP)
+
+					r.Group(func(r chi.Router) {
+						r.Use(s.RequirePermission(database.PermSessionPoliciesManage))
+						r.Get("/session-policies", s.GetSessionPolicies)
+						r.Put("/session-policies", s.PutSessionPolicy)
+						r.Delete("/session-policies/{id}", s.DeleteSessionPolicy)
+					})
+
+					r.Group(func(r chi.Router) {
+						r.Use(s.RequirePermission(database.PermRolesManage))
+						r.Get("/permissions", s.GetPermissions)
+						r.Get("/roles", s.GetRoles)
+						r.Post("/roles", s.CreateRole)
+						r.Put("/roles/{name}", s.UpdateRole)
+						r.Delete("/roles/{name}", s.DeleteRole)
+						r.Put("/users/{id}/role", s.SetUserRole)
+					})
+
+					r.With(s.RequirePermission(database.PermUsersUnlock)).Post("/users/{id}/unlock", s.UnlockUser)
+					r.With(s.RequirePermission(database.PermAuditRead)).Get("/audit-events", s.GetAuditEvents)
+
+					r.Group(func(r chi.Router) {
+						r.Use(s.RequirePermission(database.PermUsersImpersonate))
+						r.Get("/impersonations", s.GetImpersonations)
+						r.With(s.rejectAPIKeys()).Post("/users/{id}/impersonate", s.Impersonate)
+					})
+				})
+
+				// Short URLs created here belong to the user and are part of the data export
+				r.Post("/url", s.GetShortenedUrl)
+
+				r.Post("/workspace", s.AddWorkspace)
+				r.Get("/workspace", s.GetAllWorkspace)
+				r.Get("/workspace/{workspaceId}", s.GetWorkspaceById)
+			})
 		})
 	})
 
 	r.Route("/api/v1", func(r chi.Router) {
 		r.Post("/url", s.GetShortenedUrl)
 		r.Post("/login", s.NewLogin)
+		r.Post("/login/mfa", s.LoginMFA)
+		r.Post("/login/magic", s.MagicLinkLogin)
+		r.Post("/login/magic/verify", s.MagicLinkVerify)
 		r.Post("/register", s.Register)
+		r.Post("/token/refresh", s.RefreshToken)
+		r.Post("/password/forgot", s.ForgotPassword)
+		r.Post("/password/reset", s.ResetPassword)
+		r.Post("/email/verify", s.VerifyEmail)
 
-		r.Post("/animal", s.AddAnimals)
 		r.Get("/animal/{id}", s.GetAnimalsById)
 		r.Get("/animal", s.GetAllAnimals)
+
+		// Animals are read by everyone but only written by users with the animals:write permission
+		r.Group(func(r chi.Router) {
+			r.Use(s.tokenAuth.Verifier())
+			r.Use(s.authenticator())
+			r.Use(s.csrfProtect())
+			r.Use(s.RequirePermission(database.PermAnimalsWrite))
+
+			r.Post("/animal", s.AddAnimals)
+		})
 	})
 
 	//r.Route("/api", func(r chi.Router) {
 	r.Get("/auth/{provider}/callback", s.getAuthCallbackFunction)
 	r.Get("/auth/{provider}", s.beginAuthProvideCallback)
 	r.Get("/logout/{provider}", s.logOutProvider)
+	r.Post("/logout/{provider}", s.logOutProvider)
 	//})
 
 	r.Get("/short/{shortKey}", s.HandleRedirect)
@@ -132,6 +224,16 @@ func (s *Server) healthHandler(w http.ResponseWriter, r *http.Request) {
 	_, _ = w.Write(jsonResp)
 }
 
+// jwksHandler publishes the public keys used to sign access tokens so that other services can verify them
+func (s *Server) jwksHandler(w http.ResponseWriter, r *http.Request) {
+	headers := http.Header{}
+	headers.Set("Cache-Control", "public, max-age=300")
+	err := response.JSONWithHeaders(w, http.StatusOK, s.tokenAuth.PublicKeys(), headers)
+	if err != nil {
+		s.serverError(w, r, err)
+	}
+}
+
 func (s *Server) websocketHandler(w http.ResponseWriter, r *http.Request) {
 	socket, err := websocket.Accept(w, r, nil)
 
@@ -180,7 +282,7 @@ func (s *Server) Login(w http.ResponseWriter, r *http.Request) {
 	jwtauth.SetExpiryIn(claims, time.Hour*15)
 	jwtauth.SetIssuedNow(claims)
 
-	_, tokenString, _ := tokenAuth.Encode(claims)
+	_, tokenString, _ := s.tokenAuth.Encode(claims)
 
 	// Return the token
 	//w.Header().Set("Content-Type", "application/json")
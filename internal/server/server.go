@@ -1,8 +1,10 @@
 package server
 
 import (
+	"context"
 	"fmt"
 	_ "github.com/joho/godotenv/autoload"
+	"log"
 	"log/slog"
 	"net/http"
 	"os"
@@ -10,25 +12,70 @@ import (
 	"sync"
 	"time"
 
+	"new_project/internal/authenticate"
 	"new_project/internal/database"
+	"new_project/internal/jwtkeys"
+	"new_project/internal/mailer"
+	"new_project/internal/signing"
 )
 
 type Server struct {
-	port   int
-	db     database.Service
-	logger *slog.Logger
-	wg     sync.WaitGroup
+	port      int
+	db        database.Service
+	logger    *slog.Logger
+	tokenAuth *jwtkeys.KeyRing
+	mailer    mailer.Mailer
+	signer    *signing.Signer
+	// tokenCache saves the database lookup of access tokens on most requests
+	tokenCache *tokenCache
+	wg         sync.WaitGroup
 }
 
-func NewServer() *http.Server {
+// NewServer returns the HTTP server and the Server handling its requests. Wait on the latter after
+// shutting the HTTP server down lets the background tasks of the last requests finish.
+func NewServer() (*http.Server, *Server) {
+	// The identity providers are registered first, the roles they map to are checked below
+	authenticate.NewAuth(cookieSecure)
+
 	port, _ := strconv.Atoi(os.Getenv("PORT"))
 	logger := slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	tokenAuth, err := jwtkeys.LoadFromEnv()
+	if err != nil {
+		log.Fatalf("Unable to load JWT signing keys: %v", err)
+	}
+	logger.Info("loaded JWT signing keys", slog.String("active_kid", tokenAuth.ActiveKeyID()))
+
+	signer, err := signing.NewFromEnv()
+	if err != nil {
+		log.Fatalf("Unable to configure link signing: %v", err)
+	}
+
+	mail, err := mailer.NewFromEnv(logger)
+	if err != nil {
+		log.Fatalf("Unable to configure mailer: %v", err)
+	}
+
 	NewServer := &Server{
-		port:   port,
-		db:     database.New(),
-		logger: logger,
+		port:       port,
+		db:         database.New(),
+		logger:     logger,
+		tokenAuth:  tokenAuth,
+		mailer:     mail,
+		signer:     signer,
+		tokenCache: newTokenCache(tokenCacheSize, tokenCacheTTL),
+	}
+
+	if err := checkMappedRoles(NewServer.db, authenticate.MappedRoles()); err != nil {
+		log.Fatalf("Unable to check identity provider roles: %v", err)
 	}
 
+	// Revoked tokens are dropped from the cache of every replica through Postgres notifications
+	watchCtx, stopWatching := context.WithCancel(context.Background())
+	go NewServer.db.WatchTokenRevocations(watchCtx, NewServer.tokenCache.revokeUser, func(listening bool) {
+		NewServer.tokenCache.setListening(listening)
+		logger.Info("token revocation cache", slog.Bool("enabled", listening))
+	})
+
 	// Declare Server config
 	server := &http.Server{
 		Addr:    fmt.Sprintf(":%d", NewServer.port),
@@ -42,5 +89,7 @@ func NewServer() *http.Server {
 		WriteTimeout: 5 * time.Minute,
 	}
 
-	return server
+	server.RegisterOnShutdown(stopWatching)
+
+	return server, NewServer
 }
@@ -0,0 +1,137 @@
+package server
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"new_project/internal/auth"
+)
+
+const (
+	// sessionCookie holds the access token in cookie mode, it is the cookie jwtauth.TokenFromCookie reads
+	sessionCookie = "jwt"
+	// csrfCookie holds the CSRF token in cookie mode, it is readable by JavaScript so that the
+	// frontend can echo it in the csrfHeader
+	csrfCookie = "csrf_token"
+	csrfHeader = "X-CSRF-Token"
+	// purposeCSRF binds CSRF tokens to the session they were issued for
+	purposeCSRF = "csrf"
+	// legacyTokenCookie is the cookie the OAuth callback used to store a readable access token in,
+	// for the localhost domain
+	legacyTokenCookie = "token"
+)
+
+// CookieSession is returned instead of the tokens to clients in cookie mode
+type CookieSession struct {
+	CSRFToken string `json:"csrf_token"`
+	ExpiresIn int64  `json:"expires_in"`
+	// PasswordRemoved is copied from the TokenPair of the session
+	PasswordRemoved bool `json:"password_removed,omitempty"`
+}
+
+// cookieMode reports whether a login asked for its session in cookies with ?mode=cookie
+func cookieMode(r *http.Request) bool {
+	return r.URL.Query().Get("mode") == "cookie"
+}
+
+// setSessionCookies stores the tokens of a session in HttpOnly cookies, together with a CSRF token
+// signed for the session that the frontend has to send back in the X-CSRF-Token header
+func (s *Server) setSessionCookies(w http.ResponseWriter, pair *TokenPair) (*CookieSession, error) {
+	csrfToken, err := s.signer.Sign(purposeCSRF, pair.sessionId, refreshTokenTTL)
+	if err != nil {
+		return nil, err
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    pair.AccessToken,
+		Path:     "/",
+		MaxAge:   int(accessTokenTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   cookieSecure,
+		SameSite: http.SameSiteLaxMode,
+		Domain:   cookieDomain,
+	})
+	setRefreshTokenCookie(w, pair.RefreshToken)
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookie,
+		Value:    csrfToken,
+		Path:     "/",
+		MaxAge:   int(refreshTokenTTL.Seconds()),
+		Secure:   cookieSecure,
+		SameSite: http.SameSiteLaxMode,
+		Domain:   cookieDomain,
+	})
+
+	return &CookieSession{CSRFToken: csrfToken, ExpiresIn: pair.ExpiresIn, PasswordRemoved: pair.PasswordRemoved}, nil
+}
+
+// clearSessionCookies removes the cookies set by setSessionCookies, and the legacy token cookie
+// browsers may still hold from before cookie sessions
+func clearSessionCookies(w http.ResponseWriter) {
+	for _, cookie := range []*http.Cookie{
+		{Name: sessionCookie, Path: "/"},
+		{Name: refreshTokenCookie, Path: "/api/v1/token"},
+		{Name: csrfCookie, Path: "/"},
+	} {
+		cookie.MaxAge = -1
+		cookie.Secure = cookieSecure
+		cookie.Domain = cookieDomain
+		http.SetCookie(w, cookie)
+	}
+	// A cookie is only replaced with the domain and path it was set with
+	http.SetCookie(w, &http.Cookie{Name: legacyTokenCookie, Path: "/", Domain: "localhost", MaxAge: -1, Secure: true})
+}
+
+// csrfSessionId checks the double-submitted CSRF token, the X-CSRF-Token header has to match the
+// csrf_token cookie and carry our signature. It returns the session the token was issued for.
+func (s *Server) csrfSessionId(r *http.Request) (string, bool) {
+	return s.verifyCSRFToken(r, r.Header.Get(csrfHeader))
+}
+
+// verifyCSRFToken checks a CSRF token submitted with the request, in a header or a form field,
+// against the csrf_token cookie. It returns the session the token was issued for.
+func (s *Server) verifyCSRFToken(r *http.Request, token string) (string, bool) {
+	cookie, err := r.Cookie(csrfCookie)
+	if token == "" || err != nil || subtle.ConstantTimeCompare([]byte(token), []byte(cookie.Value)) != 1 {
+		return "", false
+	}
+
+	var sessionId string
+	if err := s.signer.Verify(purposeCSRF, token, &sessionId); err != nil {
+		return "", false
+	}
+	return sessionId, true
+}
+
+// csrfProtect requires a valid CSRF token on state-changing requests authenticated by the session
+// cookie. Requests authenticated by a bearer token or an API key are not exposed to CSRF and pass
+// through, any other Authorization header does not matter as long as the cookie is what authenticated.
+// It has to run after the authenticator.
+func (s *Server) csrfProtect() func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		hfn := func(w http.ResponseWriter, r *http.Request) {
+			switch r.Method {
+			case http.MethodGet, http.MethodHead, http.MethodOptions:
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			principal, err := auth.FromContext(r.Context())
+			if err != nil {
+				s.unauthorized(w, r)
+				return
+			}
+			if principal.Method != auth.MethodCookie {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if csrfSessionId, ok := s.csrfSessionId(r); !ok || csrfSessionId != principal.SessionID {
+				s.errorMessage(w, r, http.StatusForbidden, "missing or invalid CSRF token", nil)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		}
+		return http.HandlerFunc(hfn)
+	}
+}
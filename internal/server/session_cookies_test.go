@@ -0,0 +1,93 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"new_project/internal/database"
+	"new_project/internal/signing"
+	"testing"
+	"time"
+)
+
+// validTokenDB considers every access token valid
+type validTokenDB struct {
+	database.Service
+}
+
+func (db validTokenDB) IsTokenValid(jti string) (bool, error) {
+	return true, nil
+}
+
+func TestCSRFProtect(t *testing.T) {
+	s := &Server{signer: signing.New([]byte("secret")), tokenAuth: testKeyRing(t), db: validTokenDB{}, tokenCache: newTokenCache(0, 0)}
+	handler := s.tokenAuth.Verifier()(s.authenticator()(s.csrfProtect()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))))
+
+	_, tokenString, err := s.tokenAuth.Encode(map[string]interface{}{"user_id": "u1", "sid": "session-1", "jti": "token-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	csrfToken, _ := s.signer.Sign(purposeCSRF, "session-1", time.Hour)
+	otherSession, _ := s.signer.Sign(purposeCSRF, "session-2", time.Hour)
+
+	tests := []struct {
+		name          string
+		method        string
+		authorization string
+		cookie        string
+		header        string
+		want          int
+	}{
+		{"safe method", http.MethodGet, "", "", "", http.StatusNoContent},
+		{"bearer token", http.MethodPost, "Bearer " + tokenString, "", "", http.StatusNoContent},
+		{"missing token", http.MethodPost, "", "", "", http.StatusForbidden},
+		{"header without cookie", http.MethodPost, "", "", csrfToken, http.StatusForbidden},
+		{"valid token", http.MethodPost, "", csrfToken, csrfToken, http.StatusNoContent},
+		{"token of another session", http.MethodPost, "", otherSession, otherSession, http.StatusForbidden},
+		{"forged token", http.MethodPost, "", "forged", "forged", http.StatusForbidden},
+		// A header that is not a bearer token leaves the session cookie to authenticate
+		{"cookie with basic authorization", http.MethodPost, "Basic eDp5", "", "", http.StatusForbidden},
+		{"cookie with basic authorization and token", http.MethodPost, "Basic eDp5", csrfToken, csrfToken, http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, "/api/p/v1/workspace", nil)
+		req.AddCookie(&http.Cookie{Name: sessionCookie, Value: tokenString})
+		if tt.authorization != "" {
+			req.Header.Set("Authorization", tt.authorization)
+		}
+		if tt.cookie != "" {
+			req.AddCookie(&http.Cookie{Name: csrfCookie, Value: tt.cookie})
+		}
+		if tt.header != "" {
+			req.Header.Set(csrfHeader, tt.header)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != tt.want {
+			t.Errorf("%s: expected status %d, got %d", tt.name, tt.want, rr.Code)
+		}
+	}
+}
+
+func TestClearSessionCookies(t *testing.T) {
+	rr := httptest.NewRecorder()
+	clearSessionCookies(rr)
+
+	cleared := map[string]*http.Cookie{}
+	for _, cookie := range rr.Result().Cookies() {
+		if cookie.MaxAge >= 0 {
+			t.Errorf("expected cookie %s to be expired", cookie.Name)
+		}
+		cleared[cookie.Name] = cookie
+	}
+	for _, name := range []string{sessionCookie, refreshTokenCookie, csrfCookie} {
+		if cleared[name] == nil {
+			t.Errorf("expected cookie %s to be cleared", name)
+		}
+	}
+	if legacy := cleared[legacyTokenCookie]; legacy == nil || legacy.Domain != "localhost" || legacy.Path != "/" {
+		t.Errorf("expected the legacy token cookie to be cleared for localhost, got %+v", legacy)
+	}
+}
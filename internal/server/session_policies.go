@@ -0,0 +1,126 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"net/http"
+	"new_project/internal/database"
+	"new_project/internal/response"
+	"slices"
+)
+
+type SessionPoliciesResp struct {
+	SessionPolicies []database.SessionPolicy `json:"session_policies"`
+}
+
+// GetSessionPolicies lists the configured role and user session policies
+func (s *Server) GetSessionPolicies(w http.ResponseWriter, r *http.Request) {
+	policies, err := s.db.GetSessionPolicies()
+	if err != nil {
+		s.serverError(w, r, err)
+		return
+	}
+
+	err = response.JSON(w, http.StatusOK, SessionPoliciesResp{SessionPolicies: policies})
+	if err != nil {
+		s.serverError(w, r, err)
+	}
+}
+
+// PutSessionPolicy creates or replaces the session policy of a role or of a user
+func (s *Server) PutSessionPolicy(w http.ResponseWriter, r *http.Request) {
+	var req database.SessionPolicy
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.badRequest(w, r, err)
+		return
+	}
+
+	if (req.Role == "") == (req.UserId == "") {
+		s.badRequest(w, r, fmt.Errorf("exactly one of role or user_id is required"))
+		return
+	}
+	if req.Role != "" {
+		if _, err := s.db.GetRole(req.Role); err != nil {
+			if errors.Is(err, database.ErrRoleNotFound) {
+				s.badRequest(w, r, fmt.Errorf("unknown role %q", req.Role))
+				return
+			}
+			s.serverError(w, r, err)
+			return
+		}
+	}
+	if req.UserId != "" {
+		if _, err := uuid.Parse(req.UserId); err != nil {
+			s.badRequest(w, r, fmt.Errorf("invalid user_id"))
+			return
+		}
+	}
+	if req.OnLimit == "" {
+		req.OnLimit = database.OnLimitEvictOldest
+	}
+	if req.OnLimit != database.OnLimitEvictOldest && req.OnLimit != database.OnLimitRejectNew {
+		s.badRequest(w, r, fmt.Errorf("on_limit must be %s or %s", database.OnLimitEvictOldest, database.OnLimitRejectNew))
+		return
+	}
+	if req.MaxSessions < 0 {
+		s.badRequest(w, r, fmt.Errorf("max_sessions must not be negative"))
+		return
+	}
+	if req.DeviceLimits == nil {
+		req.DeviceLimits = map[string]int{}
+	}
+	for device, limit := range req.DeviceLimits {
+		if !slices.Contains(deviceTypes, device) {
+			s.badRequest(w, r, fmt.Errorf("unknown device type %q, expected one of %v", device, deviceTypes))
+			return
+		}
+		if limit < 1 {
+			s.badRequest(w, r, fmt.Errorf("device limit for %s must be at least 1", device))
+			return
+		}
+	}
+
+	policy, err := s.db.UpsertSessionPolicy(&req)
+	if errors.Is(err, database.ErrSessionPolicyTarget) {
+		s.badRequest(w, r, err)
+		return
+	}
+	if err != nil {
+		s.serverError(w, r, err)
+		return
+	}
+
+	err = response.JSON(w, http.StatusOK, policy)
+	if err != nil {
+		s.serverError(w, r, err)
+	}
+}
+
+// DeleteSessionPolicy removes a session policy, users fall back to the policy of their role
+func (s *Server) DeleteSessionPolicy(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	if _, err := uuid.Parse(id); err != nil {
+		s.notFound(w, r)
+		return
+	}
+
+	found, err := s.db.DeleteSessionPolicy(id)
+	if err != nil {
+		s.serverError(w, r, err)
+		return
+	}
+	if !found {
+		s.notFound(w, r)
+		return
+	}
+
+	err = response.JSON(w, http.StatusOK, struct {
+		Message string `json:"message"`
+	}{Message: "session policy deleted"})
+	if err != nil {
+		s.serverError(w, r, err)
+	}
+}
@@ -0,0 +1,43 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"new_project/internal/database"
+	"strings"
+	"testing"
+)
+
+type sessionPolicyDB struct {
+	database.Service
+	err error
+}
+
+func (db *sessionPolicyDB) UpsertSessionPolicy(policy *database.SessionPolicy) (*database.SessionPolicy, error) {
+	return nil, db.err
+}
+
+func TestPutSessionPolicyErrors(t *testing.T) {
+	tests := map[string]struct {
+		err  error
+		want int
+	}{
+		"unknown user":   {database.ErrSessionPolicyTarget, http.StatusBadRequest},
+		"database error": {errors.New("connection refused"), http.StatusInternalServerError},
+	}
+	for name, tt := range tests {
+		s := &Server{db: &sessionPolicyDB{err: tt.err}, logger: slog.New(slog.NewTextHandler(io.Discard, nil))}
+
+		body := `{"user_id":"00000000-0000-0000-0000-000000000001","max_sessions":1}`
+		req := httptest.NewRequest(http.MethodPut, "/api/p/v1/admin/session-policies", strings.NewReader(body))
+		rr := httptest.NewRecorder()
+		s.PutSessionPolicy(rr, req)
+
+		if rr.Code != tt.want {
+			t.Errorf("%s: expected status %d, got %d", name, tt.want, rr.Code)
+		}
+	}
+}
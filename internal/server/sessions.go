@@ -0,0 +1,139 @@
+package server
+
+import (
+	"fmt"
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"net"
+	"net/http"
+	"new_project/internal/auth"
+	"new_project/internal/database"
+	"new_project/internal/response"
+	"strings"
+)
+
+type SessionsResp struct {
+	Sessions []database.Session `json:"sessions"`
+}
+
+// GetSessions lists the active sessions of the logged-in user
+func (s *Server) GetSessions(w http.ResponseWriter, r *http.Request) {
+	principal, err := auth.FromContext(r.Context())
+	if err != nil {
+		s.unauthorized(w, r)
+		return
+	}
+	userId := principal.UserID
+	currentSessionId := principal.SessionID
+
+	sessions, err := s.db.GetSessions(userId)
+	if err != nil {
+		s.serverError(w, r, err)
+		return
+	}
+
+	for i := range sessions {
+		sessions[i].Current = sessions[i].Id == currentSessionId
+	}
+
+	err = response.JSON(w, http.StatusOK, SessionsResp{Sessions: sessions})
+	if err != nil {
+		s.serverError(w, r, err)
+	}
+}
+
+// RevokeSession logs out one session of the logged-in user
+func (s *Server) RevokeSession(w http.ResponseWriter, r *http.Request) {
+	sessionId := chi.URLParam(r, "id")
+	if _, err := uuid.Parse(sessionId); err != nil {
+		s.notFound(w, r)
+		return
+	}
+
+	principal, err := auth.FromContext(r.Context())
+	if err != nil {
+		s.unauthorized(w, r)
+		return
+	}
+	userId := principal.UserID
+
+	found, err := s.db.RevokeSession(userId, sessionId)
+	if err != nil {
+		s.serverError(w, r, err)
+		return
+	}
+	if !found {
+		s.notFound(w, r)
+		return
+	}
+
+	err = response.JSON(w, http.StatusOK, struct {
+		Message string `json:"message"`
+	}{Message: "session revoked"})
+	if err != nil {
+		s.serverError(w, r, err)
+	}
+}
+
+// RevokeOtherSessions logs out every session of the logged-in user except the current one
+func (s *Server) RevokeOtherSessions(w http.ResponseWriter, r *http.Request) {
+	principal, err := auth.FromContext(r.Context())
+	if err != nil {
+		s.unauthorized(w, r)
+		return
+	}
+	userId := principal.UserID
+	currentSessionId := principal.SessionID
+
+	count, err := s.db.RevokeOtherSessions(userId, currentSessionId)
+	if err != nil {
+		s.serverError(w, r, err)
+		return
+	}
+
+	err = response.JSON(w, http.StatusOK, struct {
+		Message string `json:"message"`
+		Revoked int    `json:"revoked"`
+	}{Message: fmt.Sprintf("revoked %d other sessions", count), Revoked: count})
+	if err != nil {
+		s.serverError(w, r, err)
+	}
+}
+
+// sessionInfo captures the client details stored with a new session
+func sessionInfo(r *http.Request) database.SessionInfo {
+	return database.SessionInfo{
+		IpAddress:  clientIP(r),
+		UserAgent:  r.UserAgent(),
+		DeviceType: deviceType(r.UserAgent()),
+	}
+}
+
+// Device types used in session listings and per-device session limits
+var deviceTypes = []string{"mobile", "tablet", "desktop", "other"}
+
+// deviceType classifies a client by its user agent
+func deviceType(userAgent string) string {
+	ua := strings.ToLower(userAgent)
+	switch {
+	case strings.Contains(ua, "ipad"), strings.Contains(ua, "tablet"):
+		return "tablet"
+	case strings.Contains(ua, "mobi"), strings.Contains(ua, "iphone"), strings.Contains(ua, "android"),
+		strings.Contains(ua, "okhttp"), strings.Contains(ua, "cfnetwork"), strings.Contains(ua, "dart:io"):
+		// the last three are the default agents of native Android, iOS and Flutter apps
+		return "mobile"
+	case strings.Contains(ua, "windows"), strings.Contains(ua, "macintosh"), strings.Contains(ua, "x11"),
+		strings.Contains(ua, "cros"):
+		return "desktop"
+	}
+	return "other"
+}
+
+// clientIP returns the client address set by middleware.RealIP, without the port
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,112 @@
+package server
+
+import (
+	"encoding/json"
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"new_project/internal/auth"
+	"new_project/internal/database"
+	"testing"
+)
+
+func TestDeviceType(t *testing.T) {
+	tests := map[string]string{
+		"Mozilla/5.0 (iPhone; CPU iPhone OS 17_0 like Mac OS X) AppleWebKit/605.1.15 Mobile/15E148":     "mobile",
+		"Mozilla/5.0 (Linux; Android 14; Pixel 8) AppleWebKit/537.36 Chrome/120.0 Mobile Safari/537.36": "mobile",
+		"okhttp/4.12.0": "mobile",
+		"Mozilla/5.0 (iPad; CPU OS 17_0 like Mac OS X) AppleWebKit/605.1.15":                             "tablet",
+		"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 Chrome/120.0 Safari/537.36":        "desktop",
+		"Mozilla/5.0 (Macintosh; Intel Mac OS X 14_0) AppleWebKit/605.1.15 Version/17.0 Safari/605.1.15": "desktop",
+		"curl/8.4.0": "other",
+		"":           "other",
+	}
+	for ua, want := range tests {
+		if got := deviceType(ua); got != want {
+			t.Errorf("deviceType(%q) = %q, want %q", ua, got, want)
+		}
+	}
+}
+
+// sessionsDB keeps the owner of every active session
+type sessionsDB struct {
+	database.Service
+	owners map[string]string
+}
+
+func (db *sessionsDB) RevokeSession(userID string, sessionID string) (bool, error) {
+	if db.owners[sessionID] != userID {
+		return false, nil
+	}
+	delete(db.owners, sessionID)
+	return true, nil
+}
+
+func (db *sessionsDB) RevokeOtherSessions(userID string, currentSessionID string) (int, error) {
+	count := 0
+	for sessionID, owner := range db.owners {
+		if owner == userID && sessionID != currentSessionID {
+			delete(db.owners, sessionID)
+			count++
+		}
+	}
+	return count, nil
+}
+
+func TestRevokeSessions(t *testing.T) {
+	janeCurrent, janeOther, joeSession := uuid.NewString(), uuid.NewString(), uuid.NewString()
+	db := &sessionsDB{owners: map[string]string{janeCurrent: "jane", janeOther: "jane", joeSession: "joe"}}
+	s := &Server{db: db, logger: slog.New(slog.NewTextHandler(io.Discard, nil))}
+
+	r := chi.NewRouter()
+	r.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			principal := &auth.Principal{UserID: "jane", SessionID: janeCurrent, Method: auth.MethodBearer}
+			next.ServeHTTP(w, r.WithContext(auth.NewContext(r.Context(), principal)))
+		})
+	})
+	r.Delete("/sessions/{id}", s.RevokeSession)
+	r.Post("/sessions/revoke-all", s.RevokeOtherSessions)
+
+	do := func(method, path string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, httptest.NewRequest(method, path, nil))
+		return rr
+	}
+
+	// The session of another user looks like one that does not exist
+	if rr := do(http.MethodDelete, "/sessions/"+joeSession); rr.Code != http.StatusNotFound {
+		t.Errorf("expected status 404 for the session of another user, got %d", rr.Code)
+	}
+	if db.owners[joeSession] != "joe" {
+		t.Error("expected the session of another user to stay")
+	}
+	if rr := do(http.MethodDelete, "/sessions/not-a-uuid"); rr.Code != http.StatusNotFound {
+		t.Errorf("expected status 404 for a malformed id, got %d", rr.Code)
+	}
+
+	// Revoking everything else keeps the session making the request
+	rr := do(http.MethodPost, "/sessions/revoke-all")
+	var resp struct {
+		Revoked int `json:"revoked"`
+	}
+	if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil || rr.Code != http.StatusOK || resp.Revoked != 1 {
+		t.Errorf("expected one revoked session, got status %d and %+v (%v)", rr.Code, resp, err)
+	}
+	if _, ok := db.owners[janeCurrent]; !ok {
+		t.Error("expected the current session to stay")
+	}
+	if _, ok := db.owners[janeOther]; ok {
+		t.Error("expected the other session to be revoked")
+	}
+	if db.owners[joeSession] != "joe" {
+		t.Error("expected the sessions of other users to stay")
+	}
+
+	if rr := do(http.MethodDelete, "/sessions/"+janeCurrent); rr.Code != http.StatusOK {
+		t.Errorf("expected status 200 for an own session, got %d", rr.Code)
+	}
+}
@@ -0,0 +1,114 @@
+package server
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// tokenCache remembers whether access tokens are valid so that the authenticator does not ask the
+// database on every request. It holds at most size tokens, dropping the least recently used ones.
+// Revocations reach it through Postgres notifications; while those are not being received, e.g.
+// during a reconnect, the cache is bypassed.
+type tokenCache struct {
+	mu        sync.Mutex
+	size      int
+	ttl       time.Duration
+	listening bool
+	// epoch changes with every revocation, lookups started before one are not cached
+	epoch   uint64
+	entries map[string]*list.Element
+	order   *list.List
+}
+
+type tokenCacheEntry struct {
+	jti     string
+	userId  string
+	valid   bool
+	expires time.Time
+}
+
+func newTokenCache(size int, ttl time.Duration) *tokenCache {
+	return &tokenCache{
+		size:    size,
+		ttl:     ttl,
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+// get returns the cached validity of a token, ok is false when it has to be looked up.
+// epoch has to be passed to add once the token was looked up.
+func (c *tokenCache) get(jti string) (valid bool, ok bool, epoch uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.listening || c.size <= 0 {
+		return false, false, c.epoch
+	}
+	el, found := c.entries[jti]
+	if !found {
+		return false, false, c.epoch
+	}
+	entry := el.Value.(*tokenCacheEntry)
+	if time.Now().After(entry.expires) {
+		c.remove(el)
+		return false, false, c.epoch
+	}
+	c.order.MoveToFront(el)
+	return entry.valid, true, c.epoch
+}
+
+// add caches the validity of a token until it expires or the cache TTL is over, whichever comes first.
+// Nothing is cached when a revocation arrived since get returned epoch.
+func (c *tokenCache) add(jti string, userId string, valid bool, expires time.Time, epoch uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.listening || c.size <= 0 || epoch != c.epoch {
+		return
+	}
+	if limit := time.Now().Add(c.ttl); expires.IsZero() || expires.After(limit) {
+		expires = limit
+	}
+
+	if el, found := c.entries[jti]; found {
+		c.remove(el)
+	}
+	c.entries[jti] = c.order.PushFront(&tokenCacheEntry{jti: jti, userId: userId, valid: valid, expires: expires})
+	for c.order.Len() > c.size {
+		c.remove(c.order.Back())
+	}
+}
+
+// revokeUser drops the cached tokens of a user, they are looked up again on their next use
+func (c *tokenCache) revokeUser(userId string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.epoch++
+	for el := c.order.Front(); el != nil; {
+		next := el.Next()
+		if el.Value.(*tokenCacheEntry).userId == userId {
+			c.remove(el)
+		}
+		el = next
+	}
+}
+
+// setListening enables the cache while revocations are received. Either way the cache starts
+// empty, since revocations may have been missed.
+func (c *tokenCache) setListening(listening bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.listening = listening
+	c.epoch++
+	clear(c.entries)
+	c.order.Init()
+}
+
+func (c *tokenCache) remove(el *list.Element) {
+	c.order.Remove(el)
+	delete(c.entries, el.Value.(*tokenCacheEntry).jti)
+}
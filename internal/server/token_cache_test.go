@@ -0,0 +1,54 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenCache(t *testing.T) {
+	c := newTokenCache(2, time.Minute)
+	expires := time.Now().Add(time.Hour)
+
+	// Nothing is cached until revocations are received
+	_, _, epoch := c.get("a")
+	c.add("a", "u1", true, expires, epoch)
+	if _, ok, _ := c.get("a"); ok {
+		t.Fatal("expected the cache to be bypassed while not listening")
+	}
+
+	c.setListening(true)
+	_, _, epoch = c.get("a")
+	c.add("a", "u1", true, expires, epoch)
+	c.add("b", "u2", false, expires, epoch)
+	if valid, ok, _ := c.get("a"); !ok || !valid {
+		t.Errorf("expected a to be cached as valid, got %v %v", valid, ok)
+	}
+	if valid, ok, _ := c.get("b"); !ok || valid {
+		t.Errorf("expected b to be cached as invalid, got %v %v", valid, ok)
+	}
+
+	// a was used least recently and is evicted
+	c.add("c", "u1", true, expires, epoch)
+	if _, ok, _ := c.get("a"); ok {
+		t.Error("expected a to be evicted")
+	}
+
+	c.revokeUser("u1")
+	if _, ok, _ := c.get("c"); ok {
+		t.Error("expected the tokens of u1 to be dropped")
+	}
+	if _, ok, _ := c.get("b"); !ok {
+		t.Error("expected the tokens of u2 to stay cached")
+	}
+
+	// A lookup that raced with the revocation is not cached
+	c.add("c", "u1", true, expires, epoch)
+	if _, ok, _ := c.get("c"); ok {
+		t.Error("expected a lookup from before the revocation not to be cached")
+	}
+
+	c.setListening(false)
+	if _, ok, _ := c.get("b"); ok {
+		t.Error("expected the cache to be cleared when revocations are no longer received")
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"log"
 	"math/rand"
 	"net/http"
+	"new_project/internal/auth"
 	"new_project/internal/database"
 	"time"
 )
@@ -38,6 +39,10 @@ func (s *Server) GetShortenedUrl(w http.ResponseWriter, r *http.Request) {
 	shortenedURL := fmt.Sprintf("http://localhost:8080/short/%s", shortKey)
 
 	urlObj := Url{Key: shortKey, LongUrl: longUrl}
+	// Only set on /api/p/v1/url, anonymous URLs have no owner
+	if principal, err := auth.FromContext(r.Context()); err == nil {
+		urlObj.UserId = principal.UserID
+	}
 	err = s.db.AddShortenedUrl(&urlObj)
 
 	//err = s.db.AddShortenedUrl(&Url{ // this way of writing struct and dynamically passing address also works
@@ -4,8 +4,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/go-chi/chi/v5"
-	"github.com/go-chi/jwtauth/v5"
 	"net/http"
+	"new_project/internal/auth"
 	"new_project/internal/models"
 	"new_project/internal/response"
 )
@@ -26,13 +26,17 @@ func (s *Server) AddWorkspace(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	_, claims, _ := jwtauth.FromContext(r.Context())
-	//userId := fmt.Sprintf("protected area. hi %v", claims["user_id"])
-	userId := claims["user_id"].(string)
+	principal, err := auth.FromContext(r.Context())
+	if err != nil {
+		s.unauthorized(w, r)
+		return
+	}
+	//userId := fmt.Sprintf("protected area. hi %v", principal.UserID)
+	userId := principal.UserID
 
 	joinCode := generateShortKey(8)
 
-	err := s.db.AddWorkspace(userId, req.Name, joinCode)
+	err = s.db.AddWorkspace(userId, req.Name, joinCode)
 	if err != nil {
 		//http.Error(w, err.Error(), http.StatusBadRequest)
 		s.badRequest(w, r, err)
@@ -54,8 +58,12 @@ type WorkspaceResp struct {
 
 func (s *Server) GetAllWorkspace(w http.ResponseWriter, r *http.Request) {
 
-	_, claims, _ := jwtauth.FromContext(r.Context())
-	userId := claims["user_id"].(string)
+	principal, err := auth.FromContext(r.Context())
+	if err != nil {
+		s.unauthorized(w, r)
+		return
+	}
+	userId := principal.UserID
 
 	var workspaceResp WorkspaceResp
 
@@ -85,8 +93,12 @@ func (s *Server) GetWorkspaceById(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	_, claims, _ := jwtauth.FromContext(r.Context())
-	userId := claims["user_id"].(string)
+	principal, err := auth.FromContext(r.Context())
+	if err != nil {
+		s.unauthorized(w, r)
+		return
+	}
+	userId := principal.UserID
 
 	workspace, err := s.db.GetWorkspacesById(userId, workspaceId)
 	if err != nil {
@@ -0,0 +1,79 @@
+package signing
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+type payload struct {
+	UserId string `json:"user_id"`
+}
+
+func TestSignVerify(t *testing.T) {
+	s := New([]byte("secret"))
+
+	token, err := s.Sign("verify-email", payload{UserId: "abc"}, time.Minute)
+	if err != nil {
+		t.Fatalf("Sign: %v", err)
+	}
+
+	var got payload
+	if err := s.Verify("verify-email", token, &got); err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	if got.UserId != "abc" {
+		t.Fatalf("expected user_id abc, got %q", got.UserId)
+	}
+}
+
+func TestVerifyRejects(t *testing.T) {
+	s := New([]byte("secret"))
+	token, _ := s.Sign("verify-email", payload{UserId: "abc"}, time.Minute)
+	expired, _ := s.Sign("verify-email", payload{UserId: "abc"}, -time.Minute)
+
+	tests := []struct {
+		name    string
+		signer  *Signer
+		purpose string
+		token   string
+		want    error
+	}{
+		{"other purpose", s, "magic-link", token, ErrInvalid},
+		{"other key", New([]byte("other")), "verify-email", token, ErrInvalid},
+		{"tampered", s, "verify-email", "x" + token, ErrInvalid},
+		{"malformed", s, "verify-email", "not-a-token", ErrInvalid},
+		{"expired", s, "verify-email", expired, ErrExpired},
+	}
+	for _, tt := range tests {
+		var got payload
+		if err := tt.signer.Verify(tt.purpose, tt.token, &got); !errors.Is(err, tt.want) {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.want, err)
+		}
+	}
+}
+
+func TestNewFromEnv(t *testing.T) {
+	t.Setenv("ALLOW_EPHEMERAL_KEYS", "")
+	t.Setenv("SIGNING_SECRET", "")
+	if _, err := NewFromEnv(); err == nil {
+		t.Error("expected an error without SIGNING_SECRET")
+	}
+
+	t.Setenv("SIGNING_SECRET", "too-short")
+	if _, err := NewFromEnv(); err == nil {
+		t.Error("expected an error for a short SIGNING_SECRET")
+	}
+
+	t.Setenv("SIGNING_SECRET", strings.Repeat("s", MinSecretLength))
+	if _, err := NewFromEnv(); err != nil {
+		t.Errorf("expected a long enough secret to be accepted, got %v", err)
+	}
+
+	t.Setenv("SIGNING_SECRET", "")
+	t.Setenv("ALLOW_EPHEMERAL_KEYS", "true")
+	if _, err := NewFromEnv(); err != nil {
+		t.Errorf("expected an ephemeral key in development, got %v", err)
+	}
+}